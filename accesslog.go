@@ -0,0 +1,246 @@
+package gosigsrv
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	accessLogCombined string = "combined"
+	accessLogJSON     string = "json"
+)
+
+// accessLogFormat is the format requests are logged in (empty disables the access log)
+var accessLogFormat string
+
+// accessLogOutput is where access log lines are written
+var accessLogOutput io.Writer = os.Stdout
+var accessLogMutex sync.Mutex
+
+// What to do with access log lines when the buffer is full
+const (
+	accessLogBlock string = "block"
+	accessLogDrop  string = "drop"
+)
+
+// accessLogBufferSize is how many access log lines can wait to be written (0 writes them right away)
+var accessLogBufferSize int
+
+// accessLogFlushInterval is how often buffered access log lines are flushed
+var accessLogFlushInterval = time.Second
+
+// accessLogOverflow is whether requests block or their lines are dropped when the buffer is full
+var accessLogOverflow = accessLogBlock
+
+// accessLogBuffer writes access log lines in the background when accessLogBufferSize is set
+var accessLogBuffer *asyncLog
+
+// requestIDHeader carries the id of a request, taken from the client or proxy if it sent one
+const requestIDHeader string = "X-Request-Id"
+
+// accessRecord is a single line in the json access log
+type accessRecord struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	PeerID     string    `json:"peer_id,omitempty"`
+	RemoteIP   string    `json:"remote_ip"`
+	RequestID  string    `json:"request_id"`
+}
+
+// accessLogWriter records the status and size of a response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// newRequestID returns a random id for a request that didn't come with one
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// accessLogMiddleware logs every request in accessLogFormat once it has been handled
+//
+//   Every response gets an X-Request-Id header (the request's own if it had one)
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if accessLogFormat == "" {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		start := time.Now()
+		requestID := req.Header.Get(requestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		res.Header().Set(requestIDHeader, requestID)
+
+		writer := &accessLogWriter{ResponseWriter: res}
+		next.ServeHTTP(writer, req)
+		if writer.status == 0 {
+			writer.status = http.StatusOK
+		}
+
+		// Sign in responses carry the new peer's id in the Pragma header
+		peerID := req.URL.Query().Get(peerIDParamName)
+		if peerID == "" {
+			peerID = res.Header().Get("Pragma")
+		}
+		record := accessRecord{start.UTC(), req.Method, req.URL.Path, writer.status, writer.bytes,
+			float64(time.Since(start).Microseconds()) / 1000, peerID, clientIP(req).String(), requestID}
+		writeAccessLog(record, req)
+	})
+}
+
+// writeAccessLog writes a record to the access log in accessLogFormat
+func writeAccessLog(record accessRecord, req *http.Request) {
+	var line string
+	switch accessLogFormat {
+	case accessLogJSON:
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			fmt.Printf("ERROR: Could not encode access log record: %v\n", err)
+			return
+		}
+		line = string(encoded)
+	default:
+		// Apache combined log format
+		line = fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d %q %q",
+			record.RemoteIP, record.Time.Format("02/Jan/2006:15:04:05 -0700"), record.Method, req.URL.RequestURI(),
+			req.Proto, record.Status, record.Bytes, req.Referer(), req.UserAgent())
+	}
+
+	if accessLogBuffer != nil {
+		accessLogBuffer.Write(line)
+		return
+	}
+
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	fmt.Fprintln(accessLogOutput, line)
+}
+
+// asyncLog writes lines to an output from a background goroutine, through a buffer
+// that is flushed every flushInterval, so requests don't wait on the output
+type asyncLog struct {
+	lines   chan string
+	done    chan struct{}
+	drop    bool
+	dropped int64
+
+	// Guards closing lines against writes still coming in
+	closeMutex sync.RWMutex
+	closed     bool
+}
+
+// newAsyncLog starts writing lines to out in the background
+//
+//   Up to size lines can be waiting, after which Write blocks or (with drop) throws lines away
+func newAsyncLog(out io.Writer, size int, flushInterval time.Duration, drop bool) *asyncLog {
+	l := &asyncLog{lines: make(chan string, size), done: make(chan struct{}), drop: drop}
+	go l.run(bufio.NewWriter(out), flushInterval)
+	return l
+}
+
+func (l *asyncLog) run(out *bufio.Writer, flushInterval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line, ok := <-l.lines:
+			if !ok {
+				if err := out.Flush(); err != nil {
+					fmt.Printf("ERROR: Could not flush access log: %v\n", err)
+				}
+				return
+			}
+			out.WriteString(line)
+			out.WriteByte('\n')
+		case <-ticker.C:
+			if err := out.Flush(); err != nil {
+				fmt.Printf("ERROR: Could not flush access log: %v\n", err)
+			}
+		}
+	}
+}
+
+// Write queues a line to be written
+func (l *asyncLog) Write(line string) {
+	l.closeMutex.RLock()
+	defer l.closeMutex.RUnlock()
+	if l.closed {
+		return
+	}
+
+	if !l.drop {
+		l.lines <- line
+		return
+	}
+	select {
+	case l.lines <- line:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+// Close writes out every queued line and stops the background goroutine
+//
+//   Returns the number of lines that were dropped because the buffer was full
+func (l *asyncLog) Close() int64 {
+	l.closeMutex.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.lines)
+	}
+	l.closeMutex.Unlock()
+
+	<-l.done
+	return atomic.LoadInt64(&l.dropped)
+}
@@ -0,0 +1,125 @@
+package gosigsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loggedRequest runs a request through the access log middleware and returns the logged line
+func loggedRequest(t *testing.T, format string, path string) string {
+	defer func(previous string) { accessLogFormat = previous }(accessLogFormat)
+	accessLogFormat = format
+	defer func(previous io.Writer) { accessLogOutput = previous }(accessLogOutput)
+	var output bytes.Buffer
+	accessLogOutput = &output
+
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "198.51.100.4:4321"
+	handler := accessLogMiddleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.Error(res, "Unknown peer", http.StatusBadRequest)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	return strings.TrimSpace(output.String())
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	line := loggedRequest(t, accessLogJSON, "/wait?peer_id=42")
+
+	var record accessRecord
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatalf("Access log line is not valid json (%v): %s", err, line)
+	}
+	if record.Status != http.StatusBadRequest {
+		t.Errorf("Logged wrong status expected %v, got %v", http.StatusBadRequest, record.Status)
+	}
+	if record.PeerID != "42" || record.Path != "/wait" || record.RemoteIP != "198.51.100.4" || record.RequestID == "" {
+		t.Errorf("Logged record is missing fields: %s", line)
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	line := loggedRequest(t, accessLogCombined, "/wait?peer_id=42")
+	if !strings.HasPrefix(line, "198.51.100.4 - - [") || !strings.Contains(line, "\"GET /wait?peer_id=42 HTTP/1.1\" 400 ") {
+		t.Errorf("Access log line is not in combined format: %s", line)
+	}
+}
+
+// lockedBuffer is a buffer that can be read while the access log is writing to it
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestBufferedAccessLogFlushedPeriodically(t *testing.T) {
+	var output lockedBuffer
+	log := newAsyncLog(&output, 10, 10*time.Millisecond, false)
+	defer log.Close()
+
+	log.Write("first")
+	deadline := time.Now().Add(5 * time.Second)
+	for output.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if line := output.String(); line != "first\n" {
+		t.Errorf("Expected the line to be flushed, got %q", line)
+	}
+}
+
+func TestBufferedAccessLogLosesNothingOnClose(t *testing.T) {
+	var output lockedBuffer
+	log := newAsyncLog(&output, 4, time.Hour, false)
+
+	const lines = 1000
+	for i := 0; i < lines; i++ {
+		log.Write(fmt.Sprintf("line %d", i))
+	}
+	if dropped := log.Close(); dropped != 0 {
+		t.Errorf("Expected no lines dropped when blocking, got %d", dropped)
+	}
+
+	written := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(written) != lines || written[lines-1] != fmt.Sprintf("line %d", lines-1) {
+		t.Errorf("Expected %d lines in order, got %d", lines, len(written))
+	}
+	log.Write("after close")
+	if strings.Contains(output.String(), "after close") {
+		t.Errorf("Lines written after close should be ignored")
+	}
+}
+
+func TestBufferedAccessLogThroughMiddleware(t *testing.T) {
+	defer func(previous *asyncLog) { accessLogBuffer = previous }(accessLogBuffer)
+	var output lockedBuffer
+	accessLogBuffer = newAsyncLog(&output, 10, time.Hour, true)
+
+	if line := loggedRequest(t, accessLogJSON, "/wait?peer_id=7"); line != "" {
+		t.Errorf("Buffered lines should not be written right away, got %q", line)
+	}
+	accessLogBuffer.Close()
+	if !strings.Contains(output.String(), `"peer_id":"7"`) {
+		t.Errorf("Buffered line was not written on close: %q", output.String())
+	}
+}
@@ -0,0 +1,310 @@
+package gosigsrv
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// adminToken is the bearer token admin requests must carry (empty disables the admin endpoints)
+var adminToken string
+
+// adminAuthMiddleware only lets requests with the admin token through
+//
+//   Expects an "Authorization: Bearer <token>" header
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if adminToken == "" {
+			http.Error(res, "Admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+
+		token, bearer := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !bearer || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			fmt.Printf("WARNING: Unauthorized admin request for %s from %s\n", req.URL.Path, req.RemoteAddr)
+			http.Error(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// adminCleanupResponse is the body of an /admin/cleanup response
+type adminCleanupResponse struct {
+	Removed int `json:"removed"`
+}
+
+// adminCleanupHandler runs a cleanup pass right away and reports how many peers were removed
+func adminCleanupHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	removed := runCleanup()
+	fmt.Printf("admin cleanup - removed %d peers\n", removed)
+	printStats()
+
+	writeJSON(res, http.StatusOK, adminCleanupResponse{removed})
+}
+
+// adminResetPeakResponse is the body of an /admin/reset-peak response
+type adminResetPeakResponse struct {
+	PreviousPeak int64 `json:"previous_peak"`
+	Peers        int   `json:"peers"`
+}
+
+// adminResetPeakHandler starts the peak peers since reset over from the current number of peers
+func adminResetPeakHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	peerMutex.Lock()
+	previous := atomic.LoadInt64(&peakPeersSinceReset)
+	resetPeakPeers()
+	count := len(peers)
+	peerMutex.Unlock()
+	fmt.Printf("admin reset-peak - peak was %d peers, %d now\n", previous, count)
+
+	writeJSON(res, http.StatusOK, adminResetPeakResponse{previous, count})
+}
+
+// adminMetricsResetResponse is the body of an /admin/metrics/reset response
+type adminMetricsResetResponse struct {
+	Previous map[string]int64 `json:"previous"`
+}
+
+// adminMetricsResetHandler zeroes the resettable counters and reports what they were
+//
+//   The cumulative counters exported by /metrics are left alone
+func adminMetricsResetHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	previous := resetCounters()
+	fmt.Printf("admin metrics reset - counters were %v\n", previous)
+
+	writeJSON(res, http.StatusOK, adminMetricsResetResponse{previous})
+}
+
+// waiterView is the json representation of a peer waiting on /wait
+type waiterView struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	WaitStartedAt  time.Time `json:"wait_started_at"`
+	WaitingSeconds float64   `json:"waiting_seconds"`
+}
+
+// adminWaitersHandler lists the peers currently waiting on /wait, longest waiting first
+func adminWaitersHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	waiters := []waiterView{}
+	peerMutex.Lock()
+	for _, v := range peers {
+		if v != nil && v.Waiting {
+			waiters = append(waiters, waiterView{v.ID, v.Name, v.WaitStartedAt, now.Sub(v.WaitStartedAt).Seconds()})
+		}
+	}
+	peerMutex.Unlock()
+	sort.Slice(waiters, func(i, j int) bool { return waiters[i].WaitStartedAt.Before(waiters[j].WaitStartedAt) })
+
+	writeJSON(res, http.StatusOK, waiters)
+}
+
+// adminGraphResponse is the body of an /admin/graph response
+type adminGraphResponse struct {
+	Edges [][2]string `json:"edges"`
+}
+
+// pairingEdges returns each pair of connected peers once, lowest id first
+func pairingEdges() [][2]string {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	edges := [][2]string{}
+	for _, v := range peers {
+		if v == nil {
+			continue
+		}
+		for _, partnerID := range v.ConnectedWith.IDs() {
+			partner, exists := peers[partnerID]
+			if !exists || partner == nil {
+				continue
+			}
+			// Connections are recorded on both peers, so only take the one from the lower id
+			if partner.ConnectedWith.Has(v.ID) && peerIDLess(partner.ID, v.ID) {
+				continue
+			}
+			edges = append(edges, [2]string{v.ID, partner.ID})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return peerIDLess(edges[i][0], edges[j][0]) })
+	return edges
+}
+
+// adminGraphHandler reports which peers are paired with each other
+//
+//   Returns json by default or a graphviz graph with format=dot
+func adminGraphHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	edges := pairingEdges()
+	switch req.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(res, http.StatusOK, adminGraphResponse{edges})
+	case "dot":
+		res.Header().Set("Content-Type", "text/vnd.graphviz")
+		res.WriteHeader(http.StatusOK)
+		fmt.Fprintln(res, "graph peers {")
+		for _, edge := range edges {
+			fmt.Fprintf(res, "  %q -- %q;\n", edge[0], edge[1])
+		}
+		fmt.Fprintln(res, "}")
+	default:
+		http.Error(res, "Invalid format", http.StatusBadRequest)
+	}
+}
+
+// closeRoomDrainTimeout is how long closing a room waits for waiting peers to receive the room closed notice
+var closeRoomDrainTimeout = 2 * time.Second
+
+// closedRoomNoticeTTL is how long a peer signed out with its room can still pick up the room closed notice
+var closedRoomNoticeTTL = time.Minute
+
+// closedRoom is the room a signed out peer was in, until the peer is told it was closed
+type closedRoom struct {
+	Room    string
+	Expires time.Time
+}
+
+var closedRooms = make(map[string]closedRoom)
+var closedRoomMutex sync.Mutex
+
+// rememberClosedRoom keeps the room closed notice for a peer that was signed out before picking it up
+func rememberClosedRoom(peerID string, room string) {
+	closedRoomMutex.Lock()
+	defer closedRoomMutex.Unlock()
+	closedRooms[peerID] = closedRoom{room, time.Now().Add(closedRoomNoticeTTL)}
+}
+
+// takeClosedRoom returns (and forgets) the closed room a signed out peer hasn't been told about yet
+func takeClosedRoom(peerID string) (room string, closed bool) {
+	closedRoomMutex.Lock()
+	defer closedRoomMutex.Unlock()
+
+	entry, closed := closedRooms[peerID]
+	delete(closedRooms, peerID)
+	if !closed || time.Now().After(entry.Expires) {
+		return "", false
+	}
+	return entry.Room, true
+}
+
+// expireClosedRooms forgets closed room notices nobody picked up
+func expireClosedRooms() {
+	closedRoomMutex.Lock()
+	defer closedRoomMutex.Unlock()
+
+	now := time.Now()
+	for peerID, entry := range closedRooms {
+		if now.After(entry.Expires) {
+			delete(closedRooms, peerID)
+		}
+	}
+}
+
+// adminCloseRoomResponse is the body of an /admin/close-room response
+type adminCloseRoomResponse struct {
+	Room    string `json:"room"`
+	Removed int    `json:"removed"`
+}
+
+// closeRoom signs out every peer in a room
+//
+//   Each is sent a room-closed notice first, and peers waiting on /wait get
+//   up to closeRoomDrainTimeout to receive it before they are signed out.
+//   Peers that hadn't picked the notice up by then get it with the 410
+//   their next request for the peer gets instead (see unknownPeerError)
+//   Returns the number of peers removed
+func closeRoom(room string) int {
+	var roomPeers []*peerInfo
+	peerMutex.Lock()
+	for _, v := range peers {
+		if v != nil && v.Room == room {
+			roomPeers = append(roomPeers, v)
+			notifyPeerNotice(v, roomClosedNotice, map[string]string{"room": room})
+		}
+	}
+	peerMutex.Unlock()
+
+	deadline := time.Now().Add(closeRoomDrainTimeout)
+	for waitersPending(roomPeers) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	var removed int
+	for _, v := range roomPeers {
+		if peers[v.ID] != v {
+			continue
+		}
+		fmt.Printf("Removing peer %s from closed room %q\n", v, room)
+		if pendingMessages(v) > 0 {
+			rememberClosedRoom(v.ID, room)
+		}
+		peerEvent(eventSignOut, v, v.ConnectedWith.String())
+		removePeer(v, "room-closed")
+		removed++
+	}
+	return removed
+}
+
+// waitersPending reports whether any of the peers is waiting with messages still to pick up
+func waitersPending(list []*peerInfo) bool {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	for _, v := range list {
+		if v.Waiting && pendingMessages(v) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// adminCloseRoomHandler signs out every peer in a room (see closeRoom)
+func adminCloseRoomHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	room, valid := roomFor(req.URL.Query().Get(roomParamName))
+	if !valid || room == "" {
+		http.Error(res, "Invalid room", http.StatusBadRequest)
+		return
+	}
+
+	removed := closeRoom(room)
+	fmt.Printf("admin close-room - removed %d peers from room %q\n", removed, room)
+	printStats()
+
+	writeJSON(res, http.StatusOK, adminCloseRoomResponse{room, removed})
+}
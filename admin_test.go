@@ -0,0 +1,256 @@
+package gosigsrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testAdminToken string = "test-admin-token"
+
+// adminRequest runs a request through the admin auth middleware and handler with the test admin token
+func adminRequest(t *testing.T, handler http.HandlerFunc, method string, path string) *httptest.ResponseRecorder {
+	defer func(previous string) { adminToken = previous }(adminToken)
+	adminToken = testAdminToken
+
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	rr := httptest.NewRecorder()
+	adminAuthMiddleware(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	defer func(previous string) { adminToken = previous }(adminToken)
+
+	req, err := http.NewRequest("POST", "/admin/cleanup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := adminAuthMiddleware(http.HandlerFunc(adminCleanupHandler))
+
+	adminToken = ""
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("Recieved wrong status code with admin disabled expected %v, got %v", http.StatusForbidden, status)
+	}
+
+	adminToken = testAdminToken
+	req.Header.Set("Authorization", "Bearer wrong")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Recieved wrong status code with wrong token expected %v, got %v", http.StatusUnauthorized, status)
+	}
+
+	for _, authorization := range []string{testAdminToken, "bearer " + testAdminToken, "Basic " + testAdminToken} {
+		req.Header.Set("Authorization", authorization)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusUnauthorized {
+			t.Errorf("Recieved wrong status code with Authorization %q expected %v, got %v", authorization, http.StatusUnauthorized, status)
+		}
+	}
+}
+
+func TestAdminCleanupRemovesStalePeer(t *testing.T) {
+	peerID, err := signIn(t, "client_adminstale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure no other tests' peers are stale
+	for _, v := range peers {
+		v.LastContact = time.Now().UTC()
+	}
+	peers[peerID].LastContact = time.Now().UTC().Add(-2 * staleTimeout)
+
+	rr := adminRequest(t, adminCleanupHandler, "POST", "/admin/cleanup")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	var response adminCleanupResponse
+	if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response is not valid json (%v): %s", err, rr.Body.String())
+	}
+	if response.Removed != 1 {
+		t.Errorf("Expected 1 peer removed, got %d", response.Removed)
+	}
+	if _, exists := peers[peerID]; exists {
+		t.Errorf("Stale peer was not removed")
+	}
+}
+
+// adminWaiters returns the ids listed by /admin/waiters
+func adminWaiters(t *testing.T) map[string]bool {
+	rr := adminRequest(t, adminWaitersHandler, "GET", "/admin/waiters")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	var waiters []waiterView
+	if err := json.Unmarshal(rr.Body.Bytes(), &waiters); err != nil {
+		t.Fatalf("Response is not valid json (%v): %s", err, rr.Body.String())
+	}
+	ids := make(map[string]bool)
+	for _, waiter := range waiters {
+		ids[waiter.ID] = true
+	}
+	return ids
+}
+
+func TestAdminWaitersListsWaitingPeers(t *testing.T) {
+	peerID, err := signIn(t, "client_adminwaiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+	discardMessages(peerID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", "/wait?peer_id="+peerID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		http.HandlerFunc(waitHandler).ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for !adminWaiters(t)[peerID] {
+		if time.Now().After(deadline) {
+			t.Fatalf("Waiting peer %s was not listed", peerID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+	if adminWaiters(t)[peerID] {
+		t.Errorf("Peer %s was still listed after its wait ended", peerID)
+	}
+}
+
+func TestAdminGraphListsPairOnce(t *testing.T) {
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+
+	clientID, err := signIn(t, "client_graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverID, err := signIn(t, "renderingserver_graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := sendMessage(t, clientID, serverID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	rr := adminRequest(t, adminGraphHandler, "GET", "/admin/graph")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+	var response adminGraphResponse
+	if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response is not valid json (%v): %s", err, rr.Body.String())
+	}
+	if len(response.Edges) != 1 || response.Edges[0] != [2]string{clientID, serverID} {
+		t.Errorf("Expected a single edge %s -- %s, got %v", clientID, serverID, response.Edges)
+	}
+}
+
+func TestAdminCloseRoomRemovesAndNotifiesPeers(t *testing.T) {
+	var roomIDs []string
+	for _, name := range []string{"client_closeroom", "renderingserver_closeroom"} {
+		req, err := http.NewRequest("GET", "/sign_in?"+name+"&room=teardown", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+		}
+		roomIDs = append(roomIDs, rr.Header().Get("Pragma"))
+	}
+	otherID, err := signIn(t, "client_otherroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, otherID)
+
+	// A peer in the room that isn't waiting when the room is closed
+	req, err := http.NewRequest("GET", "/sign_in?client_closeroomidle&room=teardown", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+	idleID := rr.Header().Get("Pragma")
+
+	waits := make(chan *httptest.ResponseRecorder, len(roomIDs))
+	for _, peerID := range roomIDs {
+		discardMessages(peerID)
+		go func(peerID string) { waits <- waitForMessage(t, peerID) }(peerID)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, peerID := range roomIDs {
+		for !peerWaiting(peerID) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	rr = adminRequest(t, adminCloseRoomHandler, "POST", "/admin/close-room?room=teardown")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	var response adminCloseRoomResponse
+	if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Removed != 3 {
+		t.Errorf("Expected 3 peers to be removed, got %d", response.Removed)
+	}
+
+	for range roomIDs {
+		var notice map[string]string
+		if err = json.Unmarshal((<-waits).Body.Bytes(), &notice); err != nil {
+			t.Fatal(err)
+		}
+		if notice["type"] != roomClosedNotice || notice["room"] != "teardown" {
+			t.Errorf("Wrong notice recieved: %v", notice)
+		}
+	}
+	for _, peerID := range append(roomIDs, idleID) {
+		if _, exists := peers[peerID]; exists {
+			t.Errorf("Peer %s in the closed room was not removed", peerID)
+		}
+	}
+
+	// The idle peer gets the notice it missed with the 410 for its next wait, and only once
+	rr = waitForMessage(t, idleID)
+	var notice map[string]string
+	if err = json.Unmarshal(rr.Body.Bytes(), &notice); rr.Code != http.StatusGone || err != nil {
+		t.Fatalf("Expected a 410 with the notice for the idle peer, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if notice["type"] != roomClosedNotice || notice["room"] != "teardown" {
+		t.Errorf("Wrong notice recieved: %v", notice)
+	}
+	if rr = waitForMessage(t, idleID); rr.Code != http.StatusBadRequest {
+		t.Errorf("Recieved wrong status code for a signed out peer expected %v, got %v", http.StatusBadRequest, rr.Code)
+	}
+	if _, exists := peers[otherID]; !exists {
+		t.Errorf("Peer outside the closed room was removed")
+	}
+}
@@ -0,0 +1,38 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// nameAllowlistPatterns are regexes peer names must match one of (none allows every name)
+var nameAllowlistPatterns []string
+var nameAllowlist []*regexp.Regexp
+
+// compileNameAllowlist compiles nameAllowlistPatterns into nameAllowlist
+//
+//   Patterns are anchored, so they have to match the whole name
+func compileNameAllowlist() error {
+	nameAllowlist = nil
+	for _, pattern := range nameAllowlistPatterns {
+		compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid name allowlist pattern %s: %v", pattern, err)
+		}
+		nameAllowlist = append(nameAllowlist, compiled)
+	}
+	return nil
+}
+
+// nameAllowed reports whether a peer name matches the name allowlist
+func nameAllowed(name string) bool {
+	if len(nameAllowlist) == 0 {
+		return true
+	}
+	for _, pattern := range nameAllowlist {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSignInNameAllowlist(t *testing.T) {
+	defer func(previous []string) {
+		nameAllowlistPatterns = previous
+		compileNameAllowlist()
+	}(nameAllowlistPatterns)
+	nameAllowlistPatterns = []string{"client_allowed[0-9]+", "renderingserver_.*"}
+	if err := compileNameAllowlist(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		expected int
+	}{
+		{"client_allowed1", http.StatusOK},
+		{"client_allowed1x", http.StatusForbidden},
+		{"client_other", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/sign_in?"+test.name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+		if rr.Code != test.expected {
+			t.Errorf("Sign in as %s: expected %v, got %v", test.name, test.expected, rr.Code)
+		}
+		if rr.Code == http.StatusOK {
+			signOut(t, rr.Header().Get("Pragma"))
+		}
+	}
+}
+
+func TestNameAllowlistInvalidPattern(t *testing.T) {
+	defer func(previous []string) {
+		nameAllowlistPatterns = previous
+		compileNameAllowlist()
+	}(nameAllowlistPatterns)
+	nameAllowlistPatterns = []string{"client_(unclosed"}
+	if err := compileNameAllowlist(); err == nil {
+		t.Errorf("Expected an invalid pattern to fail to compile")
+	}
+}
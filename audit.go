@@ -0,0 +1,93 @@
+package gosigsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// auditRecord is a single line in the audit log
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	PeerID    string    `json:"peer_id"`
+	Name      string    `json:"name,omitempty"`
+	PartnerID string    `json:"partner_id,omitempty"`
+}
+
+// auditFilePath is the file audit records are appended to (empty disables the audit log)
+var auditFilePath string
+
+// auditFsync forces each audit record to stable storage as it is written
+var auditFsync bool
+
+var auditFile *os.File
+var auditMutex sync.Mutex
+
+// openAuditLog opens (or re-opens) the audit log for appending
+//
+//   Any previously opened file is closed, so this can be used
+//   to pick up a new file after the old one was rotated away
+func openAuditLog() error {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if auditFile != nil {
+		auditFile.Close()
+		auditFile = nil
+	}
+	if auditFilePath == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(auditFilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	auditFile = file
+	return nil
+}
+
+// reopenAuditLogOnHangup re-opens the audit log whenever the process gets a SIGHUP
+func reopenAuditLogOnHangup() {
+	hangupChan := make(chan os.Signal, 1)
+	signal.Notify(hangupChan, syscall.SIGHUP)
+
+	for range hangupChan {
+		fmt.Printf("Re-opening audit log %s\n", auditFilePath)
+		if err := openAuditLog(); err != nil {
+			fmt.Printf("ERROR: Could not re-open audit log: %v\n", err)
+		}
+	}
+}
+
+// audit appends a record of a peer event to the audit log (if enabled)
+func audit(event string, peer *peerInfo, partnerID string) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if auditFile == nil {
+		return
+	}
+
+	line, err := json.Marshal(auditRecord{time.Now().UTC(), event, peer.ID, peer.Name, partnerID})
+	if err != nil {
+		fmt.Printf("ERROR: Could not encode audit record: %v\n", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if _, err = auditFile.Write(line); err != nil {
+		fmt.Printf("ERROR: Could not write audit record: %v\n", err)
+		return
+	}
+	if auditFsync {
+		if err = auditFile.Sync(); err != nil {
+			fmt.Printf("ERROR: Could not sync audit log: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package gosigsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditRecordWrittenOnSignIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosigsrv-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(previous string) {
+		auditFilePath = previous
+		openAuditLog()
+	}(auditFilePath)
+	auditFilePath = filepath.Join(dir, "audit.log")
+	if err = openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	peerID, err := signIn(t, "client_audited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+
+	contents, err := ioutil.ReadFile(auditFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 audit record, got %d: %s", len(lines), contents)
+	}
+
+	var record auditRecord
+	if err = json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Audit record is not valid json (%v): %s", err, lines[0])
+	}
+	if record.Event != eventSignIn || record.PeerID != peerID || record.Name != "client_audited" {
+		t.Errorf("Audit record has wrong contents: %+v", record)
+	}
+	if record.Time.IsZero() {
+		t.Errorf("Audit record is missing a timestamp")
+	}
+}
+
+func TestAuditLogReopenFollowsRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosigsrv-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(previous string) {
+		auditFilePath = previous
+		openAuditLog()
+	}(auditFilePath)
+	auditFilePath = filepath.Join(dir, "audit.log")
+	if err = openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	beforeID, err := signIn(t, "client_beforerotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, beforeID)
+	if err = os.Rename(auditFilePath, auditFilePath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	afterID, err := signIn(t, "client_afterrotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, afterID)
+
+	contents, err := ioutil.ReadFile(auditFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "client_afterrotate") || strings.Contains(string(contents), "client_beforerotate") {
+		t.Errorf("Re-opened audit log has wrong contents: %s", contents)
+	}
+}
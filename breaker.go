@@ -0,0 +1,56 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"time"
+)
+
+// breakerThreshold is the number of backed up deliveries to a peer within
+// breakerWindow that opens its circuit breaker (0 disables the breaker)
+var breakerThreshold = 10
+
+// breakerWindow is the window backed up deliveries are counted in, and how
+// long a breaker stays open before the peer is removed
+var breakerWindow = 30 * time.Second
+
+// recordBackedUp counts a delivery to the peer that failed because its buffer was full
+//
+//   Opens the peer's breaker once breakerThreshold deliveries have
+//   failed within breakerWindow
+func recordBackedUp(peer *peerInfo) {
+	if breakerThreshold <= 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(peer.BackedUpSince) > breakerWindow {
+		peer.BackedUpSince = now
+		peer.BackedUpCount = 0
+	}
+	peer.BackedUpCount++
+
+	if peer.BackedUpCount >= breakerThreshold && !breakerOpen(peer) {
+		fmt.Printf("WARNING: Opening circuit breaker for peer %s after %d backed up deliveries\n", peer, peer.BackedUpCount)
+		peer.BreakerOpenedAt = now
+	}
+}
+
+// breakerOpen reports whether messages to the peer are being short circuited
+func breakerOpen(peer *peerInfo) bool {
+	return !peer.BreakerOpenedAt.IsZero()
+}
+
+// breakerExpired reports whether the peer's breaker has been open long enough for it to be removed
+func breakerExpired(peer *peerInfo) bool {
+	return breakerOpen(peer) && time.Now().UTC().Sub(peer.BreakerOpenedAt) > breakerWindow
+}
+
+// resetBreaker closes the peer's breaker (e.g. once it's polling again)
+func resetBreaker(peer *peerInfo) {
+	if breakerOpen(peer) {
+		fmt.Printf("Closing circuit breaker for peer %s\n", peer)
+	}
+	peer.BreakerOpenedAt = time.Time{}
+	peer.BackedUpSince = time.Time{}
+	peer.BackedUpCount = 0
+}
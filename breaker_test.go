@@ -0,0 +1,83 @@
+package gosigsrv
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBreakerShortCircuitsBackedUpPeer(t *testing.T) {
+	defer func(previous int) { breakerThreshold = previous }(breakerThreshold)
+	breakerThreshold = 3
+
+	peerA, err := signIn(t, "client_breakerA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_breakerB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+
+	// Fill up the recipient's buffer
+	for peers[peerB].Channel.Len() < peers[peerB].Channel.Cap() {
+		if status := sendMessage(t, peerA, peerB, "offer").Code; status != http.StatusOK {
+			t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+		}
+	}
+
+	for i := 0; i < breakerThreshold; i++ {
+		if status := sendMessage(t, peerA, peerB, "offer").Code; status != http.StatusServiceUnavailable {
+			t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusServiceUnavailable, status)
+		}
+	}
+	if !breakerOpen(peers[peerB]) {
+		t.Fatalf("Breaker did not open after %d backed up deliveries", breakerThreshold)
+	}
+
+	// Make room, messages should still be refused while the breaker is open
+	discardMessages(peerB)
+	if status := sendMessage(t, peerA, peerB, "offer").Code; status != http.StatusServiceUnavailable {
+		t.Errorf("Recieved wrong status code with breaker open expected %v, got %v", http.StatusServiceUnavailable, status)
+	}
+
+	// Once the peer polls again messages are accepted
+	peers[peerB].Channel.Send(context.Background(), &peerMsg{FromID: peerA, Message: "offer", Priority: normalPriority}, 0)
+	messageQueued()
+	waitForMessage(t, peerB)
+	if status := sendMessage(t, peerA, peerB, "offer").Code; status != http.StatusOK {
+		t.Errorf("Recieved wrong status code after polling expected %v, got %v", http.StatusOK, status)
+	}
+}
+
+func TestBreakerOpenTooLongRemovesPeer(t *testing.T) {
+	peerID, err := signIn(t, "renderingserver_breakerexpired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers[peerID].BreakerOpenedAt = time.Now().UTC().Add(-2 * breakerWindow)
+
+	compactUnreachablePeers()
+
+	if _, exists := peers[peerID]; exists {
+		t.Errorf("Peer with a long open breaker was not removed")
+	}
+}
+
+func TestValidateSettingsRejectsNonPositiveBreakerWindow(t *testing.T) {
+	defer func(previous int) { breakerThreshold = previous }(breakerThreshold)
+	defer func(previous time.Duration) { breakerWindow = previous }(breakerWindow)
+
+	breakerThreshold = 3
+	breakerWindow = 0
+	if err := validateSettings(); err == nil {
+		t.Errorf("A breaker window of 0 should be rejected with a breaker threshold")
+	}
+	breakerThreshold = 0
+	if err := validateSettings(); err != nil {
+		t.Errorf("The breaker window should not matter with the breaker disabled, got %v", err)
+	}
+}
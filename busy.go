@@ -0,0 +1,61 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const busyParamName string = "busy"
+
+// rejectBusy refuses messages to busy peers from peers they aren't connected with (with a 409)
+var rejectBusy bool
+
+// busyConflict reports whether a message should be refused because its recipient is busy
+//
+//   Peers a busy peer is already connected with can always reach it
+func busyConflict(from *peerInfo, to *peerInfo) bool {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	return rejectBusy && to.Busy && !to.ConnectedWith.Has(from.ID)
+}
+
+// busyHandler handles requests from a peer to mark itself busy (or not)
+//
+//   With rejectBusy set, messages to a busy peer from anyone it
+//   isn't connected with get a 409 instead of being queued
+func busyHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	peerIDValues, peerExists := req.URL.Query()[peerIDParamName]
+	if !peerExists {
+		http.Error(res, "Missing Peer ID", http.StatusBadRequest)
+		return
+	}
+	peerID := peerIDValues[0]
+
+	busy, err := strconv.ParseBool(req.URL.Query().Get(busyParamName))
+	if err != nil {
+		http.Error(res, "Invalid busy", http.StatusBadRequest)
+		return
+	}
+
+	peerMutex.Lock()
+	peer, exists := peers[peerID]
+	if !exists || peer == nil {
+		peerMutex.Unlock()
+		unknownPeerError(res, peerID)
+		return
+	}
+	peer.Busy = busy
+	peer.LastContact = time.Now().UTC()
+	fmt.Printf("busy: Peer %s busy=%t\n", peer, busy)
+	peerMutex.Unlock()
+
+	setPragmaHeader(res.Header(), peerID)
+	res.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,68 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setBusyRequest marks a peer busy or not through /busy
+func setBusyRequest(t *testing.T, peerID string, busy string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/busy?peer_id="+peerID+"&busy="+busy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(busyHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestMessageToBusyPeerConflicts(t *testing.T) {
+	serverID, err := signIn(t, "renderingserver_busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	partnerID, err := signIn(t, "client_busypartner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, partnerID)
+	otherID, err := signIn(t, "client_busyother")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, otherID)
+
+	if rr := sendMessage(t, partnerID, serverID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if rr := setBusyRequest(t, serverID, "true"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	if rr := sendMessage(t, otherID, serverID, "offer"); rr.Code != http.StatusOK {
+		t.Errorf("Busy peers should get messages without -reject-busy, got %v", rr.Code)
+	}
+
+	defer func(previous bool) { rejectBusy = previous }(rejectBusy)
+	rejectBusy = true
+
+	rr := sendMessage(t, otherID, serverID, "offer")
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusConflict, rr.Code)
+	}
+	if rr.Header().Get("X-Peer-Busy") != "true" {
+		t.Errorf("Conflict should have the X-Peer-Busy hint")
+	}
+	if rr := sendMessage(t, partnerID, serverID, "candidate"); rr.Code != http.StatusOK {
+		t.Errorf("Busy peers should still get messages from their partner, got %v", rr.Code)
+	}
+
+	if rr := setBusyRequest(t, serverID, "false"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if rr := sendMessage(t, otherID, serverID, "offer"); rr.Code != http.StatusOK {
+		t.Errorf("Peer should get messages once no longer busy, got %v", rr.Code)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/obsoleted/gosigsrv"
+
+func main() {
+	gosigsrv.Main()
+}
@@ -0,0 +1,133 @@
+package gosigsrv
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// gzipResponses compresses responses for clients that accept gzip
+var gzipResponses bool
+
+// gzipMinBytes is the smallest response that is compressed, smaller ones (e.g. most /wait messages) are sent as is
+var gzipMinBytes = 1024
+
+// acceptsGzip reports whether a request's Accept-Encoding allows gzip
+func acceptsGzip(req *http.Request) bool {
+	for _, encoding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds on to a response until it's gzipMinBytes long, then compresses it
+//
+//   Responses that finish (or are flushed) before reaching gzipMinBytes are sent as is
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	buffered []byte
+	decided  bool
+	zipper   *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.decided {
+		if w.zipper != nil {
+			return w.zipper.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buffered = append(w.buffered, b...)
+	if len(w.buffered) >= gzipMinBytes {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide writes the header and anything buffered so far, compressed or not
+func (w *gzipResponseWriter) decide(compress bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	var err error
+	if compress {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.ResponseWriter.WriteHeader(w.status)
+		w.zipper = gzip.NewWriter(w.ResponseWriter)
+		_, err = w.zipper.Write(w.buffered)
+	} else {
+		w.ResponseWriter.WriteHeader(w.status)
+		if len(w.buffered) > 0 {
+			_, err = w.ResponseWriter.Write(w.buffered)
+		}
+	}
+	w.buffered = nil
+	return err
+}
+
+// FlushError sends what has been written so far (so it's sent as is if it's still short)
+func (w *gzipResponseWriter) FlushError() error {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.zipper != nil {
+		if err := w.zipper.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close finishes the response
+func (w *gzipResponseWriter) Close() error {
+	if !w.decided {
+		return w.decide(false)
+	}
+	if w.zipper != nil {
+		return w.zipper.Close()
+	}
+	return nil
+}
+
+// gzipMiddleware compresses responses of at least gzipMinBytes for clients that accept gzip
+//
+//   Upgrade requests (i.e. websockets) are left alone
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !gzipResponses || !acceptsGzip(req) || req.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		res.Header().Add("Vary", "Accept-Encoding")
+		writer := &gzipResponseWriter{ResponseWriter: res}
+		next.ServeHTTP(writer, req)
+		if err := writer.Close(); err != nil {
+			fmt.Printf("ERROR: Could not finish response for %s: %v\n", req.URL.Path, err)
+		}
+	})
+}
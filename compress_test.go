@@ -0,0 +1,59 @@
+package gosigsrv
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipOnlyAboveThreshold(t *testing.T) {
+	defer func(previous bool) { gzipResponses = previous }(gzipResponses)
+	gzipResponses = true
+	defer func(previous int) { gzipMinBytes = previous }(gzipMinBytes)
+	gzipMinBytes = 1024
+
+	handler := gzipMiddleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body := strings.Repeat("a", 10)
+		if req.URL.Query().Get("size") == "large" {
+			body = strings.Repeat("a", 4096)
+		}
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte(body))
+	}))
+	get := func(size string, acceptEncoding string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/wait?size="+size, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := get("small", "gzip"); rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != strings.Repeat("a", 10) {
+		t.Errorf("Small response was compressed (%s): %q", rr.Header().Get("Content-Encoding"), rr.Body.String())
+	}
+	if rr := get("large", "deflate, gzip;q=0"); rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Large response was compressed for a client that doesn't accept gzip")
+	}
+
+	rr := get("large", "deflate, gzip")
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Large response was not compressed")
+	}
+	unzipper, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(unzipper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != strings.Repeat("a", 4096) {
+		t.Errorf("Compressed response decompressed to %d bytes", len(body))
+	}
+}
@@ -0,0 +1,47 @@
+package gosigsrv
+
+import (
+	"time"
+)
+
+// maxSignInNotifications is how many available peers are told about a new peer right away (0 for no limit)
+var maxSignInNotifications int
+
+// signInNotificationDelay is how long apart the rest of the available peers are told about it, maxSignInNotifications at a time
+var signInNotificationDelay = 100 * time.Millisecond
+
+// notifySignIn sends a new peer's info to the peers that were available to it
+//
+//   With maxSignInNotifications only that many of the most recently active
+//   are told right away, and the rest in batches of the same size
+//   signInNotificationDelay apart. Must be called with peerMutex held
+func notifySignIn(available []*peerInfo, peer *peerInfo, peerInfoString string) {
+	limit := maxSignInNotifications
+	if limit <= 0 || len(available) <= limit {
+		notifyAvailablePeers(available, peer, peerInfoString)
+		return
+	}
+
+	recent := sortPeers(append([]*peerInfo(nil), available...), sortByRecent)
+	notifyAvailablePeers(recent[:limit], peer, peerInfoString)
+	deferSignInNotifications(recent[limit:], peer, limit)
+}
+
+// deferSignInNotifications tells the next batch of limit peers about a new peer after signInNotificationDelay
+//
+//   Nobody is told about a peer that has signed out in the meantime
+func deferSignInNotifications(rest []*peerInfo, peer *peerInfo, limit int) {
+	time.AfterFunc(signInNotificationDelay, func() {
+		peerMutex.Lock()
+		defer peerMutex.Unlock()
+		if peers[peer.ID] != peer {
+			return
+		}
+		batch := rest
+		if len(batch) > limit {
+			batch = rest[:limit]
+			deferSignInNotifications(rest[limit:], peer, limit)
+		}
+		notifyAvailablePeers(batch, peer, peer.InfoString())
+	})
+}
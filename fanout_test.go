@@ -0,0 +1,69 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignInNotificationsCapped(t *testing.T) {
+	defer func(previous int) { maxSignInNotifications = previous }(maxSignInNotifications)
+	maxSignInNotifications = 3
+	defer func(previous time.Duration) { signInNotificationDelay = previous }(signInNotificationDelay)
+	signInNotificationDelay = 300 * time.Millisecond
+
+	signInToRoom := func(name string) string {
+		req, err := http.NewRequest("GET", "/sign_in?"+name+"&room=fanout", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		signinHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Sign in of %s failed with %d", name, rr.Code)
+		}
+		return rr.Header().Get("Pragma")
+	}
+
+	var serverIDs []string
+	for i := 0; i < 7; i++ {
+		serverID := signInToRoom("renderingserver_fanout" + string(rune('a'+i)))
+		defer signOut(t, serverID)
+		serverIDs = append(serverIDs, serverID)
+	}
+	// The first servers are the most recently active
+	now := time.Now().UTC()
+	peerMutex.Lock()
+	for i, serverID := range serverIDs {
+		peers[serverID].LastContact = now.Add(time.Duration(-i) * time.Minute)
+	}
+	peerMutex.Unlock()
+
+	clientID := signInToRoom("client_fanout")
+	defer signOut(t, clientID)
+
+	notified := func() []string {
+		peerMutex.Lock()
+		defer peerMutex.Unlock()
+		var notifiedIDs []string
+		for _, serverID := range serverIDs {
+			for _, message := range queuedMessages(peers[serverID]) {
+				if strings.Contains(message, ","+clientID+",") {
+					notifiedIDs = append(notifiedIDs, serverID)
+				}
+			}
+		}
+		return notifiedIDs
+	}
+
+	if notifiedIDs := notified(); strings.Join(notifiedIDs, " ") != strings.Join(serverIDs[:3], " ") {
+		t.Errorf("Expected the 3 most recently active servers %v to be notified right away, got %v", serverIDs[:3], notifiedIDs)
+	}
+
+	time.Sleep(3 * signInNotificationDelay)
+	if notifiedIDs := notified(); strings.Join(notifiedIDs, " ") != strings.Join(serverIDs[3:], " ") {
+		t.Errorf("Expected the other servers %v to be notified later, got %v", serverIDs[3:], notifiedIDs)
+	}
+}
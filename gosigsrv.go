@@ -1,56 +1,379 @@
-package main
+package gosigsrv
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-type peerKind int
+// peerKind is the role a peer plays (e.g. client or server)
+type peerKind string
 
 const (
-	client peerKind = iota
-	server
+	client peerKind = "client"
+	server peerKind = "server"
+	// Observers are told about every peer event but are never paired or advertised
+	observer peerKind = "observer"
+)
+
+// serverNamePrefix marks peers as servers when they sign in without an explicit kind
+const serverNamePrefix string = "renderingserver_"
+
+// Peer discovery modes
+const (
+	// Peers only discover peers of a different kind
+	discoverOppositeKind string = "opposite-role"
+	// Peers discover all other peers (mesh)
+	discoverAllPeers string = "all-other-peers"
+)
+
+// msgPriority decides which of a peer's queues a message waits in
+type msgPriority int
+
+const (
+	normalPriority msgPriority = iota
+	// High priority messages (server notifications) are delivered before any normal ones
+	highPriority
 )
 
 type peerMsg struct {
-	FromID  string
-	Message string
+	FromID      string
+	Message     string
+	ContentType string
+	Priority    msgPriority
+
+	// Peer info lines about other peers are presence, and are dropped
+	// if they were queued more than presenceMaxAge ago
+	Presence bool
+	QueuedAt time.Time
+
+	// Set on a message delivered again after the peer reconnected (see reconnect.go)
+	Replay bool
 }
 
 type peerInfo struct {
 	Kind          peerKind
 	Name          string
 	ID            string
-	Channel       chan *peerMsg
-	ConnectedWith string
+	Channel       messageQueue
+	ConnectedWith partnerSet
 	LastContact   time.Time
+	SignedInAt    time.Time
 	Waiting       bool
+	WaitStartedAt time.Time
+	FailedSends   int
+	RemoteIP      net.IP
+	ClientVersion string
+	Room          string
+	QueuedSeq     uint64
+	Trace         bool
+
+	// High priority messages skip ahead of everything in Channel
+	PriorityChannel messageQueue
+
+	// Circuit breaker state for deliveries to the peer (see breaker.go)
+	BackedUpCount   int
+	BackedUpSince   time.Time
+	BreakerOpenedAt time.Time
+
+	// Closed when a paused peer is resumed, and when a peer is paused (see pause.go)
+	Unpaused chan struct{}
+	Paused   chan struct{}
+
+	// Set by the peer itself while it doesn't want new partners (see busy.go)
+	Busy bool
+
+	// The last relayed message delivered, kept with replayLastMessage (see reconnect.go)
+	LastDelivered *peerMsg
+
+	// Content types of the last message the peer sent and received, for diagnosing protocol mismatches
+	LastSentContentType     string
+	LastReceivedContentType string
+
+	// Out of room warnings are rate limited per sender
+	OutOfRoomWarnedAt   time.Time
+	OutOfRoomSuppressed int
+
+	// Pending notification of the peer's new name (see rename.go)
+	RenameTimer *time.Timer
+
+	// Set while a signed out peer is kept for signOutGrace (see leaving.go)
+	Leaving *time.Timer
+
+	// Messages relayed from the peer since it (last) signed in, capped by maxMessagesPerPeer
+	MessagesSent int
+
+	// The last contact the peer was warned it would be removed for inactivity after (see inactivity.go)
+	InactivityWarnedFor time.Time
+
+	// Cancels the peer's current /wait, for -wait-takeover (see takeover.go)
+	CancelWait context.CancelCauseFunc
 }
 
 func (m peerInfo) String() string {
 	return fmt.Sprintf("%s@%s[%s]", m.Name, m.ID, m.ConnectedWith)
 }
 
+// methodHint is the body of a response to a request made with the wrong method
+type methodHint struct {
+	Error  string   `json:"error"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+	Hint   string   `json:"hint"`
+}
+
+// peerView is the json representation of a peer
+type peerView struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Kind          peerKind  `json:"kind"`
+	ConnectedWith string    `json:"connected_with"`
+	LastContact   time.Time `json:"last_contact"`
+	Waiting       bool      `json:"waiting"`
+	ClientVersion string    `json:"client_version,omitempty"`
+	Room          string    `json:"room,omitempty"`
+	Leaving       bool      `json:"leaving,omitempty"`
+
+	LastSentContentType     string `json:"last_sent_content_type,omitempty"`
+	LastReceivedContentType string `json:"last_received_content_type,omitempty"`
+}
+
+func (m peerInfo) View() peerView {
+	return peerView{m.ID, m.Name, m.Kind, m.ConnectedWith.String(), m.LastContact, m.Waiting, m.ClientVersion, m.Room, m.Leaving != nil, m.LastSentContentType, m.LastReceivedContentType}
+}
+
+// InfoString is the peer info line sent to other peers
+//
+//   The last field is always 1 unless reportAvailability is set, in
+//   which case it's 0 for peers that can't be connected with another
 func (m peerInfo) InfoString() string {
-	return fmt.Sprintf("%s,%s,1\n", m.Name, m.ID)
+	available := 1
+	if reportAvailability && !m.canTakePartner() {
+		available = 0
+	}
+	return fmt.Sprintf("%s,%s,%d\n", m.Name, m.ID, available)
 }
 
 const peerIDParamName string = "peer_id"
 const toParamName string = "to"
+const nameParamName string = "name"
+const sortParamName string = "sort"
+const offsetParamName string = "offset"
+const kindParamName string = "kind"
+const roomParamName string = "room"
+
+// maxRoomNameLength is the longest room name a peer can sign in to
+const maxRoomNameLength int = 64
+
+// maxPeers is the most peers that can be signed in at once (0 for no limit)
+var maxPeers int
+
+// maxConcurrentSignIns is the most sign ins handled at once (0 for no limit)
+var maxConcurrentSignIns int64
+
+// signInsInFlight counts the sign ins being handled
+var signInsInFlight int64
+
+// maxNamesPerIP limits how many distinct peer names can be signed in from one client ip (0 for no limit)
+var maxNamesPerIP int
+
+// maxRoomsPerName limits how many rooms peers with the same name can be signed in to at once (0 for no limit)
+var maxRoomsPerName int
+
+// lowercaseRooms makes room names case insensitive
+var lowercaseRooms bool
+
+// requireRoom rejects sign ins without a room instead of putting them in the default room
+var requireRoom bool
+
+// clientVersionHeader is the request header peers report their version in when signing in
+const clientVersionHeader string = "X-Client-Version"
+
+// Values of the sort parameter
+const (
+	sortByRecent string = "recent"
+	sortByName   string = "name"
+	sortByID     string = "id"
+	sortByQueued string = "queued"
+)
+
+// fifoPairing offers available peers longest waiting first instead of in map order
+var fifoPairing bool
+
+// pairingQueueSeq orders peers by when they became available to pair with
+var pairingQueueSeq uint64
+
+// Sizes of the message buffers of server peers and all other peers
+var serverMessageBufferSize = 100
+var clientMessageBufferSize = 100
+
+// messageBufferSize returns the message buffer size for peers of the given kind
+func messageBufferSize(kind peerKind) int {
+	if kind == server {
+		return serverMessageBufferSize
+	}
+	return clientMessageBufferSize
+}
+
+// Types of notices sent by notifyPeerNotice
+const deliveryFailedNotice string = "delivery-failed"
+const goingAwayNotice string = "going-away"
+const peerLeftNotice string = "peer-left"
+const peerEventNotice string = "peer-event"
+const reconnectNotice string = "reconnect"
+const roomClosedNotice string = "room-closed"
+
+// Peer events (see peerEvent)
+const (
+	eventSignIn  string = "sign-in"
+	eventSignOut string = "sign-out"
+	eventPair    string = "pair"
+	eventReap    string = "reap"
+)
 
-const peerMessageBufferSize int = 100
+// notifyUndelivered tells senders when their message is discarded because the recipient left
+var notifyUndelivered bool
 
+// peers is every signed in peer by id
+//
+//   It's guarded by peerMutex, which also guards the mutable fields of each
+//   peerInfo, so a handler can check and update several peers (and the map)
+//   as one step, e.g. sign in checking the name, picking an id and notifying the others
 var peers = make(map[string]*peerInfo)
 
+// peerIDCount is the last peer id handed out (see newPeerID)
 var peerIDCount uint
+
+// peerMutex guards peers, peerIDCount and the peerInfo fields that change after sign in
 var peerMutex sync.Mutex
 
+// shutdownReconnectHint is how long peers are told to wait before reconnecting when the server shuts down
+var shutdownReconnectHint = 10 * time.Second
+
+// shutdownDrainTimeout is how long shutdown waits for peers to pick up the going away notice
+var shutdownDrainTimeout = 5 * time.Second
+
+// presenceMaxAge is how old queued peer info lines can get before /wait drops them (0 to never drop them)
+var presenceMaxAge time.Duration
+
+// enqueueTimeout is how long a message waits for room in a full recipient buffer before failing (0 fails right away)
+var enqueueTimeout time.Duration
+
+// strictContentEncoding rejects message bodies with any content encoding instead of decoding gzip
+var strictContentEncoding bool
+
+// maxDecodedMessageBytes is the largest a gzip message body can decompress to (0 for no limit)
+var maxDecodedMessageBytes int64 = 1 << 20
+
+// reportAvailability makes the last field of peer info lines 0 for connected peers instead of always 1
+var reportAvailability bool
+
+// discoveryMode controls which peers are advertised to each other (discoverOppositeKind or discoverAllPeers)
+var discoveryMode = discoverOppositeKind
+
+// maxListedPeers caps the number of peers in a sign in or list response (0 for no limit)
+var maxListedPeers int
+
+// maxHeaderBytes limits the size of request headers the server will read
+var maxHeaderBytes = http.DefaultMaxHeaderBytes
+
+// cleanupInterval is how often the cleanup routine checks for stale peers
+var cleanupInterval = 30 * time.Second
+
+// staleTimeout is how long a peer can go without contacting the server before it's removed (0 never removes them)
+var staleTimeout = time.Minute
+
+// clientStaleTimeout replaces staleTimeout for clients (0 uses staleTimeout)
+var clientStaleTimeout time.Duration
+
+// serverStaleTimeout replaces staleTimeout for servers (0 uses staleTimeout)
+var serverStaleTimeout time.Duration
+
+// staleTimeoutFor returns how long a peer of the given kind can go without contacting the server before it's removed (0 never removes them)
+func staleTimeoutFor(kind peerKind) time.Duration {
+	if kind == client && clientStaleTimeout > 0 {
+		return clientStaleTimeout
+	}
+	if kind == server && serverStaleTimeout > 0 {
+		return serverStaleTimeout
+	}
+	return staleTimeout
+}
+
+// maxPeerLifetime is how long a peer can stay signed in, regardless of activity (0 for no limit)
+var maxPeerLifetime time.Duration
+
+// maxFailedSends is the number of consecutive failed deliveries after which
+// a peer is considered unreachable and removed (0 disables removal)
+var maxFailedSends = 50
+
+// corsExcludedRoutes is a comma separated list of routes (e.g. ops endpoints) that don't get CORS headers
+var corsExcludedRoutes = "/health,/stats,/metrics,/peers,/admin/"
+
+// listenAddr is the address to listen on (defaults to every interface on $PORT)
+var listenAddr string
+
+// keepAlive leaves connection management to the Go server instead of closing every connection
+var keepAlive bool
+
+// h2c serves cleartext http/2 (with prior knowledge, e.g. from a load balancer) alongside http/1.1
+var h2c bool
+
+// strictRoutes disables case-insensitive and trailing-slash-tolerant routing
+var strictRoutes bool
+
+// inFlightMessages is the number of messages currently buffered across all peer channels
+var inFlightMessages int64
+
+// lostMessages counts messages taken off a peer's channel that couldn't be written to it or put back
+var lostMessages int64
+
+// outOfRoomMessages counts messages sent to a peer other than the one the sender is connected with
+var outOfRoomMessages int64
+
+// outOfRoomWarningInterval is the minimum time between out of room warnings logged for a sender
+var outOfRoomWarningInterval = 10 * time.Second
+
+// remoteIPChangeWarnings counts requests where a peer id was used from an unexpected network
+var remoteIPChangeWarnings int64
+
+// maxInFlightMessages caps inFlightMessages; messages beyond it are rejected (0 disables the cap)
+var maxInFlightMessages int64 = 10000
+
+// messageQueued records that a message was added to a peer channel
+func messageQueued() {
+	atomic.AddInt64(&inFlightMessages, 1)
+}
+
+// messagesDequeued records that count messages were taken off (or discarded from) peer channels
+func messagesDequeued(count int) {
+	atomic.AddInt64(&inFlightMessages, -int64(count))
+}
+
+// inFlightLimitReached reports whether the global in-flight message cap has been hit
+func inFlightLimitReached() bool {
+	return maxInFlightMessages > 0 && atomic.LoadInt64(&inFlightMessages) >= maxInFlightMessages
+}
+
 func printReqHandler(res http.ResponseWriter, req *http.Request) {
 	reqDump, err := httputil.DumpRequest(req, true)
 	if err != nil {
@@ -59,20 +382,50 @@ func printReqHandler(res http.ResponseWriter, req *http.Request) {
 	fmt.Println(string(reqDump))
 }
 
-func registerHandler(path string, handlerFunc http.Handler) {
+func registerHandler(mux *http.ServeMux, path string, handlerFunc http.Handler) {
 	if path != "" {
 		fmt.Printf("Registering handler for %s", path)
 		fmt.Println()
-		http.Handle(path, handlerFunc)
+		mux.Handle(path, handlerFunc)
 	}
 }
 
-func setConnectionHeader(header http.Header, close bool) {
-	if close {
-		header.Set("Connection", "close")
-	} else {
-		header.Set("Connection", "keep-alive")
+// registerHandlers registers every route the server serves on a mux
+func registerHandlers(mux *http.ServeMux) {
+	registerHandler(mux, "/sign_in", commonHeaderMiddleware(http.HandlerFunc(signinHandler)))
+	registerHandler(mux, "/sign_out", commonHeaderMiddleware(http.HandlerFunc(signoutHandler)))
+	registerHandler(mux, "/list", commonHeaderMiddleware(http.HandlerFunc(listHandler)))
+	registerHandler(mux, "/whoami", commonHeaderMiddleware(http.HandlerFunc(whoamiHandler)))
+	registerHandler(mux, "/rename", commonHeaderMiddleware(http.HandlerFunc(renameHandler)))
+	registerHandler(mux, "/message", commonHeaderMiddleware(http.HandlerFunc(messageHandler)))
+	registerHandler(mux, "/wait", commonHeaderMiddleware(http.HandlerFunc(waitHandler)))
+	registerHandler(mux, "/ws", commonHeaderMiddleware(http.HandlerFunc(websocketHandler)))
+	registerHandler(mux, "/pause", commonHeaderMiddleware(http.HandlerFunc(pauseHandler)))
+	registerHandler(mux, "/busy", commonHeaderMiddleware(http.HandlerFunc(busyHandler)))
+	registerHandler(mux, "/health", commonHeaderMiddleware(http.HandlerFunc(healthHandler)))
+	registerHandler(mux, "/stats", commonHeaderMiddleware(http.HandlerFunc(statsHandler)))
+	registerHandler(mux, "/metrics", commonHeaderMiddleware(http.HandlerFunc(metricsHandler)))
+	registerHandler(mux, "/peers", commonHeaderMiddleware(http.HandlerFunc(peersHandler)))
+	registerHandler(mux, "/admin/cleanup", commonHeaderMiddleware(adminAuthMiddleware(http.HandlerFunc(adminCleanupHandler))))
+	registerHandler(mux, "/admin/graph", commonHeaderMiddleware(adminAuthMiddleware(http.HandlerFunc(adminGraphHandler))))
+	registerHandler(mux, "/admin/trace", commonHeaderMiddleware(adminAuthMiddleware(http.HandlerFunc(adminTraceHandler))))
+	registerHandler(mux, "/admin/close-room", commonHeaderMiddleware(adminAuthMiddleware(http.HandlerFunc(adminCloseRoomHandler))))
+	registerHandler(mux, "/admin/reset-peak", commonHeaderMiddleware(adminAuthMiddleware(http.HandlerFunc(adminResetPeakHandler))))
+	registerHandler(mux, "/admin/metrics/reset", commonHeaderMiddleware(adminAuthMiddleware(http.HandlerFunc(adminMetricsResetHandler))))
+	registerHandler(mux, "/admin/waiters", commonHeaderMiddleware(adminAuthMiddleware(http.HandlerFunc(adminWaitersHandler))))
+	registerHandler(mux, "/test", commonHeaderMiddleware(http.HandlerFunc(testPageHandler)))
+	registerHandler(mux, "/", commonHeaderMiddleware(http.HandlerFunc(printReqHandler)))
+}
+
+// setConnectionHeader asks clients to close the connection after each response
+//
+//   Left to the Go server with keepAlive set, and never set for
+//   http/2 requests where the Connection header isn't allowed
+func setConnectionHeader(header http.Header, req *http.Request) {
+	if keepAlive || req.ProtoMajor >= 2 {
+		return
 	}
+	header.Set("Connection", "close")
 }
 
 func setVersionHeader(header http.Header) {
@@ -83,12 +436,24 @@ func setNoCacheHeader(header http.Header) {
 	header.Set("Cache-Control", "no-cache")
 }
 
-func addCorsHeaders(header http.Header) {
-	header.Set("Access-Control-Allow-Origin", "*")
-	header.Set("Access-Control-Allow-Credentials", "true")
+// addCorsHeaders allows cross origin requests
+//
+//   Requests with credentials (session cookies) can't be allowed with a
+//   * origin, so only origins in sessionOrigins are echoed back (with
+//   credentials allowed), and only when session cookies are enabled
+func addCorsHeaders(header http.Header, origin string) {
+	if credentialedOrigin(origin) {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		header.Set("Access-Control-Allow-Origin", "*")
+	}
+	if sessionOrigins != "" {
+		header.Add("Vary", "Origin")
+	}
 	header.Set("Access-Control-Allow-Methods", strings.Join([]string{"GET", "POST", "OPTIONS"}, ","))
-	header.Set("Access-Control-Allow-Headers", strings.Join([]string{"Content-Type", "Content-Length", "Cache-Control", "Connection"}, ","))
-	header.Set("Access-Control-Expose-Headers", strings.Join([]string{"Content-Length", "X-Peer-Id"}, ","))
+	header.Set("Access-Control-Allow-Headers", strings.Join([]string{"Content-Type", "Content-Length", "Content-Encoding", "Cache-Control", "Connection", clientVersionHeader}, ","))
+	header.Set("Access-Control-Expose-Headers", strings.Join([]string{"Content-Length", "X-Peer-Id", "X-Peers-Truncated", "X-Peers-Next-Offset", "X-Peer-Busy", "X-Replay", reconnectTokenHeader}, ","))
 }
 
 func setPragmaHeader(header http.Header, peerID string) {
@@ -97,25 +462,544 @@ func setPragmaHeader(header http.Header, peerID string) {
 
 // printStats prints out the current peer count and count by type
 func printStats() {
-	var serverCount int
-	var clientCount int
+	totalCount, serverCount, clientCount := countPeers()
+	fmt.Printf("TotalPeers: %d, Servers: %d, Clients: %d\n", totalCount, serverCount, clientCount)
+}
+
+// notifyPeerNotice queues a typed JSON notice from the server on a peer's channel
+//
+//   e.g. {"type":"delivery-failed","to":"3"}
+func notifyPeerNotice(peer *peerInfo, noticeType string, details map[string]string) {
+	notice := map[string]string{"type": noticeType}
+	for k, v := range details {
+		notice[k] = v
+	}
+	noticeJSON, err := json.Marshal(notice)
+	if err != nil {
+		fmt.Printf("ERROR: Could not encode %s notice: %v\n", noticeType, err)
+		return
+	}
+	notifyPeer(peer, string(noticeJSON))
+}
+
+// queueFor returns the queue a message for a peer goes on depending on its priority
+func queueFor(peer *peerInfo, msg *peerMsg) messageQueue {
+	if msg.Priority == highPriority {
+		return peer.PriorityChannel
+	}
+	return peer.Channel
+}
+
+// pendingMessages returns the number of messages queued for a peer
+func pendingMessages(peer *peerInfo) int {
+	return peer.PriorityChannel.Len() + peer.Channel.Len()
+}
+
+// notifyPeer queues a server notification (e.g. peer info) on a peer's channel
+//
+//   Notifications are sent with the recipient's own id as the sender id
+func notifyPeer(peer *peerInfo, message string) {
+	queueNotification(peer, message, false)
+}
+
+// queueNotification queues a server notification, marking peer info lines as presence
+func queueNotification(peer *peerInfo, message string, presence bool) {
+	msg := &peerMsg{FromID: peer.ID, Message: message, Priority: highPriority, Presence: presence, QueuedAt: time.Now()}
+	if pendingMessages(peer) < peer.Channel.Cap() && peer.PriorityChannel.Send(context.Background(), msg, 0) {
+		messageQueued()
+	} else {
+		peer.FailedSends++
+		fmt.Printf("WARNING: Dropped message for peer %s\n", peer)
+		// TODO: Figure out what to do when peeer message buffer fills up
+	}
+}
+
+// notifyPeerInfo sends another peer's info line to a peer
+//
+//   canDiscover already leaves a peer itself out, but a peer is never
+//   told about itself here either, whichever path the notification comes from
+func notifyPeerInfo(peer *peerInfo, about *peerInfo, peerInfoString string) {
+	if peer == about || peer.ID == about.ID {
+		fmt.Printf("WARNING: Not notifying peer %s about itself\n", peer)
+		return
+	}
+	queueNotification(peer, peerInfoString, true)
+}
+
+// stalePresence reports whether a message is a peer info line queued more than presenceMaxAge ago
+//
+//   Relayed messages are never stale
+func stalePresence(msg *peerMsg) bool {
+	return msg != nil && msg.Presence && presenceMaxAge > 0 && time.Since(msg.QueuedAt) > presenceMaxAge
+}
+
+// clientIP returns the ip address of the client that sent the request (or nil if it can't be parsed)
+//
+//   For requests from trusted proxies that's the forwarded client ip (see proxy.go)
+func clientIP(req *http.Request) net.IP {
+	if ip := forwardedClientIP(req); ip != nil {
+		return ip
+	}
+	return remoteIP(req)
+}
+
+// remoteIP returns the ip address the request's connection came from (or nil if it can't be parsed)
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// sameNetwork reports whether two ips are in the same /16 (ipv4) or /48 (ipv6) network
+func sameNetwork(a net.IP, b net.IP) bool {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		return a4.Mask(net.CIDRMask(16, 32)).Equal(b4.Mask(net.CIDRMask(16, 32)))
+	}
+	return a.Mask(net.CIDRMask(48, 128)).Equal(b.Mask(net.CIDRMask(48, 128)))
+}
+
+// checkPeerRemoteIP warns when a peer's requests come from a different network
+// than its previous ones, which may mean someone is using another peer's id
+func checkPeerRemoteIP(peer *peerInfo, ip net.IP) {
+	if ip == nil {
+		return
+	}
+	if peer.RemoteIP != nil && !sameNetwork(peer.RemoteIP, ip) {
+		atomic.AddInt64(&remoteIPChangeWarnings, 1)
+		fmt.Printf("WARNING: Peer %s sent a request from %s but previously used %s (possible spoofed peer id)\n", peer, ip, peer.RemoteIP)
+	}
+	peer.RemoteIP = ip
+}
+
+// peerKindFor determines the kind of a signing in peer
+//
+//   An explicit kind parameter is used if given, otherwise peers whose
+//   names start with serverNamePrefix are servers and the rest clients
+func peerKindFor(name string, kindParam string) (kind peerKind, valid bool) {
+	if kindParam != "" {
+		if len(kindParam) > 32 || strings.IndexFunc(kindParam, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+		}) >= 0 {
+			return "", false
+		}
+		return peerKind(kindParam), true
+	}
+	if strings.HasPrefix(name, serverNamePrefix) {
+		return server, true
+	}
+	return client, true
+}
+
+// acquireSignInSlot counts a sign in as in flight, unless maxConcurrentSignIns are already
+//
+//   Sign ins notify every available peer, so bounding them protects the
+//   notification fan out when lots of peers sign in at once
+//   Returns false if there's no slot, otherwise releaseSignInSlot must be called when done
+func acquireSignInSlot() bool {
+	inFlight := atomic.AddInt64(&signInsInFlight, 1)
+	if maxConcurrentSignIns > 0 && inFlight > maxConcurrentSignIns {
+		atomic.AddInt64(&signInsInFlight, -1)
+		return false
+	}
+	return true
+}
+
+// releaseSignInSlot counts a sign in as done
+func releaseSignInSlot() {
+	atomic.AddInt64(&signInsInFlight, -1)
+}
+
+// tooManyNamesFrom reports whether signing in another peer named name from ip would go over maxNamesPerIP
+//
+//   Peers are counted from the peer map, so the count goes down as soon as peers sign out or are removed
+//   Must be called with peerMutex held
+func tooManyNamesFrom(ip net.IP, name string) bool {
+	if maxNamesPerIP <= 0 || ip == nil {
+		return false
+	}
+	names := make(map[string]bool)
+	for _, v := range peers {
+		if v != nil && v.RemoteIP.Equal(ip) {
+			names[v.Name] = true
+		}
+	}
+	return !names[name] && len(names) >= maxNamesPerIP
+}
+
+// tooManyRoomsFor reports whether signing in another peer named name to room would go over maxRoomsPerName
+//
+//   Like tooManyNamesFrom, rooms are counted from the peer map so signing out frees a room right away
+//   Must be called with peerMutex held
+func tooManyRoomsFor(name string, room string) bool {
+	if maxRoomsPerName <= 0 {
+		return false
+	}
+	rooms := make(map[string]bool)
+	for _, v := range peers {
+		if v != nil && v.Name == name {
+			rooms[v.Room] = true
+		}
+	}
+	return !rooms[room] && len(rooms) >= maxRoomsPerName
+}
+
+// roomFor normalizes and validates the room a peer is signing in to
+//
+//   Room names are trimmed (and lowercased with lowercaseRooms) and may only
+//   contain letters, digits, '_', '-' and '.'. No room param is the default room ""
+func roomFor(roomParam string) (room string, valid bool) {
+	room = strings.TrimSpace(roomParam)
+	if lowercaseRooms {
+		room = strings.ToLower(room)
+	}
+	if len(room) > maxRoomNameLength || strings.IndexFunc(room, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.')
+	}) >= 0 {
+		return "", false
+	}
+	return room, true
+}
+
+// canDiscover reports whether a peer should be told about another peer
+//
+//   Depending on discoveryMode that's every other peer or only peers of a different kind,
+//   and only peers in the same room.
+//   Observers are never advertised but can discover every other (non observer) peer in any room.
+func canDiscover(peer *peerInfo, other *peerInfo) bool {
+	if peer.ID == other.ID || other.Kind == observer {
+		return false
+	}
+	if peer.Kind == observer {
+		return true
+	}
+	return peer.Room == other.Room && (discoveryMode == discoverAllPeers || peer.Kind != other.Kind)
+}
+
+// peerEvent records a sign in, sign out, pairing or removal of a peer
+//
+//   The event is written to the audit log and sent to every observer
+//   Must be called with peerMutex held
+func peerEvent(event string, peer *peerInfo, partnerID string) {
+	audit(event, peer, partnerID)
+
 	for _, v := range peers {
-		if v.Kind == server {
-			serverCount++
+		if v != nil && v.Kind == observer && v.ID != peer.ID {
+			notifyPeerNotice(v, peerEventNotice, map[string]string{
+				"event":      event,
+				"peer_id":    peer.ID,
+				"name":       peer.Name,
+				"kind":       string(peer.Kind),
+				"partner_id": partnerID,
+			})
+		}
+	}
+}
+
+// warnOutOfRoom counts and logs a peer sending a message to a peer other than the one it's connected with
+//
+//   To avoid flooding the log the warning is only logged once per
+//   outOfRoomWarningInterval for each sender, with the number of
+//   warnings suppressed in between
+func warnOutOfRoom(from *peerInfo, to *peerInfo) {
+	countEvent(&outOfRoomMessages, "out_of_room_messages")
+
+	now := time.Now().UTC()
+	if now.Sub(from.OutOfRoomWarnedAt) < outOfRoomWarningInterval {
+		from.OutOfRoomSuppressed++
+		return
+	}
+
+	fmt.Printf("WARNING: event=out_of_room from=%s to=%s connected_with=%s suppressed=%d\n", from.ID, to.ID, from.ConnectedWith, from.OutOfRoomSuppressed)
+	from.OutOfRoomWarnedAt = now
+	from.OutOfRoomSuppressed = 0
+}
+
+// availablePeers returns the peers that are advertised to the given peer
+//
+//   i.e. discoverable peers (see canDiscover) that can take another partner
+//   Must be called with peerMutex held
+func availablePeers(peer *peerInfo) []*peerInfo {
+	var available []*peerInfo
+	for pID, pInfo := range peers {
+		if pInfo == nil {
+			fmt.Printf("ERROR: nil peer found at id %s\n", pID)
+			continue
+		}
+
+		if canDiscover(peer, pInfo) && pInfo.canTakePartner() {
+			available = append(available, pInfo)
+		}
+	}
+	return available
+}
+
+// isValidPeerSortOrder checks the value of a sort parameter
+func isValidPeerSortOrder(sortOrder string) bool {
+	switch sortOrder {
+	case "", sortByRecent, sortByName, sortByID, sortByQueued:
+		return true
+	}
+	return false
+}
+
+// sortPeers sorts a list of peers in place by the given sort order
+//
+//   recent: most recent LastContact first
+//   name: by name
+//   id: by id (numerically where possible)
+//   queued: longest available (unpaired) first
+//   an empty order leaves the list as is
+func sortPeers(list []*peerInfo, sortOrder string) []*peerInfo {
+	var less func(a *peerInfo, b *peerInfo) bool
+	switch sortOrder {
+	case sortByRecent:
+		less = func(a *peerInfo, b *peerInfo) bool { return a.LastContact.After(b.LastContact) }
+	case sortByName:
+		less = func(a *peerInfo, b *peerInfo) bool { return a.Name < b.Name }
+	case sortByID:
+		less = func(a *peerInfo, b *peerInfo) bool { return peerIDLess(a.ID, b.ID) }
+	case sortByQueued:
+		less = func(a *peerInfo, b *peerInfo) bool { return a.QueuedSeq < b.QueuedSeq }
+	default:
+		return list
+	}
+
+	sort.SliceStable(list, func(i int, j int) bool { return less(list[i], list[j]) })
+	return list
+}
+
+// peerIDLess orders peer ids numerically where possible
+func peerIDLess(a string, b string) bool {
+	aID, aErr := strconv.ParseUint(a, 10, 64)
+	bID, bErr := strconv.ParseUint(b, 10, 64)
+	if aErr != nil || bErr != nil {
+		return a < b
+	}
+	return aID < bID
+}
+
+// pagedSortOrder picks a stable sort order when peer lists are paged
+//
+//   Without one the map ordering could change between pages.
+//   With fifoPairing the default is the pairing queue order
+func pagedSortOrder(sortOrder string) string {
+	if sortOrder == "" && fifoPairing {
+		return sortByQueued
+	}
+	if sortOrder == "" && maxListedPeers > 0 {
+		return sortByID
+	}
+	return sortOrder
+}
+
+// pagePeers returns at most maxListedPeers peers from the list starting at offset
+//
+//   nextOffset is the offset of the next page or 0 if there are no more peers
+func pagePeers(list []*peerInfo, offset int) (page []*peerInfo, nextOffset int) {
+	if offset >= len(list) {
+		return nil, 0
+	}
+	page = list[offset:]
+	if maxListedPeers > 0 && len(page) > maxListedPeers {
+		return page[:maxListedPeers], offset + maxListedPeers
+	}
+	return page, 0
+}
+
+// setPageHeaders tells the client that a peer list was truncated and where the next page starts
+func setPageHeaders(header http.Header, nextOffset int) {
+	if nextOffset > 0 {
+		header.Set("X-Peers-Truncated", "true")
+		header.Set("X-Peers-Next-Offset", fmt.Sprintf("%d", nextOffset))
+	}
+}
+
+// newPeerID returns the next unused peer id, skipping ids reserved after their peer was reaped
+//
+//   Ids are increasing numbers (starting over from 1 if the counter runs
+//   out), or random with idBytes set (see ids.go)
+//   Must be called with peerMutex held
+func newPeerID() string {
+	for {
+		var peerID string
+		if idBytes > 0 {
+			peerID = randomPeerID()
 		} else {
-			clientCount++
+			if peerIDCount == math.MaxUint {
+				// Start over rather than wrap to 0, ids still in use are skipped below
+				fmt.Printf("WARNING: Peer ids ran out at %d, starting over from 1\n", peerIDCount)
+				peerIDCount = 0
+			}
+			peerIDCount++
+			peerID = fmt.Sprintf("%d", peerIDCount)
+		}
+		if _, exists := peers[peerID]; !exists && !isReservedPeerID(peerID) {
+			return peerID
+		}
+	}
+}
+
+// notifyAvailablePeers sends a new peer's info to the peers that were available to it
+//
+//   Availability is checked again, as peers may have been paired (or signed
+//   out) since the list of available peers was made
+//   Must be called with peerMutex held
+func notifyAvailablePeers(available []*peerInfo, peer *peerInfo, peerInfoString string) {
+	for _, pInfo := range available {
+		if pInfo.canTakePartner() && peers[pInfo.ID] == pInfo && canDiscover(pInfo, peer) {
+			notifyPeerInfo(pInfo, peer, peerInfoString)
+		}
+	}
+}
+
+// enqueueForPairing puts a peer that has become available at the back of the pairing queue
+func enqueueForPairing(peer *peerInfo) {
+	peer.QueuedSeq = atomic.AddUint64(&pairingQueueSeq, 1)
+}
+
+// removePeer removes a peer from the peer map, disconnecting it from
+// the peers it was connected with and discarding its pending messages
+//
+//   Each peer it was connected with is sent a peer-left notice with the reason
+//   Must be called with peerMutex held
+func removePeer(peer *peerInfo, reason string) {
+	var partners []*peerInfo
+	for _, partnerID := range peer.ConnectedWith.IDs() {
+		connectedPeer, connectionExists := peers[partnerID]
+		if connectionExists && connectedPeer != nil && connectedPeer.Disconnect(peer.ID) {
+			fmt.Printf("Disconnecting peer %s from %s\n", connectedPeer, peer)
+			enqueueForPairing(connectedPeer)
+			partners = append(partners, connectedPeer)
+		}
+	}
+
+	delete(peers, peer.ID)
+	forgetPairLimits(peer.ID)
+	drainPeerMessages(peer)
+
+	for _, partner := range partners {
+		notifyPeerNotice(partner, peerLeftNotice, map[string]string{"peer_id": peer.ID, "reason": reason})
+	}
+}
+
+// drainPeerMessages empties a departing peer's channel
+//
+//   If notifyUndelivered is set the sender of each relayed message
+//   is told that it could not be delivered
+//   Must be called with peerMutex held
+func drainPeerMessages(peer *peerInfo) {
+	for {
+		var msg *peerMsg
+		select {
+		case msg = <-peer.PriorityChannel.Receive():
+		case msg = <-peer.Channel.Receive():
+		default:
+			return
+		}
+		messagesDequeued(1)
+		if msg == nil || msg.FromID == peer.ID || !notifyUndelivered {
+			continue
+		}
+		sender, senderExists := peers[msg.FromID]
+		if senderExists && sender != nil {
+			notifyPeerNotice(sender, deliveryFailedNotice, map[string]string{"to": peer.ID})
 		}
 	}
-	fmt.Printf("TotalPeers: %d, Servers: %d, Clients: %d\n", len(peers), serverCount, clientCount)
+}
+
+// isValidPeerName checks that a name can be safely embedded in a peer info line
+func isValidPeerName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ",\r\n")
+}
+
+// writeBody writes a whole response with its Content-Length taken from the body itself
+//
+//   The length is always that of the exact bytes written (never e.g. of a
+//   body a format string expands a % in a peer name in), and is still sent
+//   when a response is flushed before the handler returns
+func writeBody(res http.ResponseWriter, status int, body string) error {
+	res.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	res.WriteHeader(status)
+	_, err := res.Write([]byte(body))
+	return err
+}
+
+// corsExcluded reports whether a path is one of the corsExcludedRoutes
+//
+//   Routes ending in / match every path beneath them
+func corsExcluded(path string) bool {
+	for _, route := range strings.Split(corsExcludedRoutes, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		if path == route || strings.HasSuffix(route, "/") && strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxQueryParams is the most query parameters a request can have (0 for no limit)
+var maxQueryParams = 32
+
+// maxQueryLength is the longest query string a request can have in bytes (0 for no limit)
+var maxQueryLength = 4096
+
+// queryTooLarge reports whether a raw query string is over maxQueryLength or has more than maxQueryParams parameters
+//
+//   Checked before the query is parsed, so a crafted url is never parsed (or scanned for a name by sign in)
+func queryTooLarge(rawQuery string) bool {
+	if maxQueryLength > 0 && len(rawQuery) > maxQueryLength {
+		return true
+	}
+	return maxQueryParams > 0 && rawQuery != "" && strings.Count(rawQuery, "&")+1 > maxQueryParams
 }
 
 // commonHeaderMiddleware sets the common headers that all responses seem to require
+//
+//   Requests with a malformed (or too large) query string get a 400, rather
+//   than reaching the handler with whatever parameters could be parsed
 func commonHeaderMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		setNoCacheHeader(res.Header())
 		setVersionHeader(res.Header())
-		addCorsHeaders(res.Header())
-		setConnectionHeader(res.Header(), true)
+		setExtraHeaders(res.Header())
+		if !corsExcluded(req.URL.Path) {
+			addCorsHeaders(res.Header(), req.Header.Get("Origin"))
+		}
+		setConnectionHeader(res.Header(), req)
+		if queryTooLarge(req.URL.RawQuery) {
+			http.Error(res, "Query too large", http.StatusBadRequest)
+			return
+		}
+		if _, err := url.ParseQuery(req.URL.RawQuery); err != nil {
+			http.Error(res, "Malformed query", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// routeNormalizingMiddleware lower cases the request path and strips any trailing slash
+//
+//   This lets requests like /Sign_In or /sign_in/ reach the /sign_in handler
+//   instead of falling through to the catch all. Disabled with strictRoutes.
+func routeNormalizingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !strictRoutes {
+			path := strings.ToLower(req.URL.Path)
+			if len(path) > 1 {
+				path = strings.TrimRight(path, "/")
+				if path == "" {
+					path = "/"
+				}
+			}
+			req.URL.Path = path
+			req.URL.RawPath = ""
+		}
 		next.ServeHTTP(res, req)
 	})
 }
@@ -131,6 +1015,13 @@ func signinHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !acquireSignInSlot() {
+		fmt.Printf("WARNING: Rejecting sign in, %d sign ins are already in progress\n", maxConcurrentSignIns)
+		http.Error(res, "Too many sign ins in progress", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseSignInSlot()
+
 	// Parse out peer name
 	var name string
 	for k, v := range req.URL.Query() {
@@ -147,103 +1038,391 @@ func signinHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Create and populate new peer info struct
-	var peerInfo peerInfo
-	peerInfo.Name = name
-	peerInfo.Channel = make(chan *peerMsg, peerMessageBufferSize)
-	peerInfo.LastContact = time.Now().UTC()
+	if !nameAllowed(name) {
+		fmt.Printf("WARNING: Rejecting sign in of %s, name is not allowed\n", name)
+		http.Error(res, "Name not allowed", http.StatusForbidden)
+		return
+	}
 
-	// Determine peer type
-	if strings.Index(name, "renderingserver_") == 0 {
-		peerInfo.Kind = server
+	sortOrder := req.URL.Query().Get(sortParamName)
+	if !isValidPeerSortOrder(sortOrder) {
+		http.Error(res, "Invalid sort", http.StatusBadRequest)
+		return
 	}
 
-	// Generate id
+	kind, validKind := peerKindFor(name, req.URL.Query().Get(kindParamName))
+	if !validKind {
+		http.Error(res, "Invalid kind", http.StatusBadRequest)
+		return
+	}
+
+	room, validRoom := roomFor(req.URL.Query().Get(roomParamName))
+	if !validRoom {
+		http.Error(res, "Invalid room", http.StatusBadRequest)
+		return
+	}
+	if requireRoom && room == "" {
+		http.Error(res, "Missing room", http.StatusBadRequest)
+		return
+	}
+
+	// The peer is looked up (or added) and the peers available to it are
+	// listed under the lock, so concurrent sign ins each see a consistent map
 	peerMutex.Lock()
-	peerIDCount++
-	peerInfo.ID = fmt.Sprintf("%d", peerIDCount)
-	peerMutex.Unlock()
 
-	// Add to peer map
-	// TOOD: Guard this with mutex?
-	peers[peerInfo.ID] = &peerInfo
+	// Resume the peer from a previous sign in if the session cookie is for one
+	var peer *peerInfo
+	if sessionCookies {
+		if sessionID, validSession := sessionPeerID(req); validSession {
+			if resumed, exists := peers[sessionID]; exists && resumed != nil && resumed.Kind == kind {
+				peer = resumed
+				peer.Name = name
+				peer.LastContact = time.Now().UTC()
+				peer.RemoteIP = clientIP(req)
+				peer.ClientVersion = req.Header.Get(clientVersionHeader)
+				peer.Room = room
+				fmt.Printf("sign-in - Resuming peer %s\n", peer)
+				queueReplay(peer)
+			}
+		}
+	}
+
+	// Or keep a peer that signed out and is signing back in within the grace period
+	if peer == nil && signOutGrace > 0 {
+		if returning := returningPeer(req, name, kind, room); returning != nil {
+			peer = returning
+			peer.LastContact = time.Now().UTC()
+			peer.ClientVersion = req.Header.Get(clientVersionHeader)
+		}
+	}
+	if peer != nil {
+		cancelLeaving(peer)
+		peer.MessagesSent = 0
+	}
+
+	if peer == nil && maxPeers > 0 && len(peers) >= maxPeers {
+		fmt.Printf("WARNING: Rejecting sign in of %s, %d peers are already signed in\n", name, len(peers))
+		peerMutex.Unlock()
+		http.Error(res, "Server is full", http.StatusServiceUnavailable)
+		return
+	}
+
+	if peer == nil && tooManyNamesFrom(clientIP(req), name) {
+		peerMutex.Unlock()
+		fmt.Printf("WARNING: Rejecting sign in of %s, too many names signed in from %s\n", name, clientIP(req))
+		http.Error(res, "Too many names signed in from this address", http.StatusTooManyRequests)
+		return
+	}
+
+	if peer == nil && tooManyRoomsFor(name, room) {
+		peerMutex.Unlock()
+		fmt.Printf("WARNING: Rejecting sign in of %s to room %q, signed in to too many rooms\n", name, room)
+		http.Error(res, "Signed in to too many rooms", http.StatusTooManyRequests)
+		return
+	}
+
+	if peer == nil {
+		// Create and populate new peer info struct
+		var peerInfo peerInfo
+		peerInfo.Name = name
+		peerInfo.LastContact = time.Now().UTC()
+		peerInfo.SignedInAt = peerInfo.LastContact
+		peerInfo.RemoteIP = clientIP(req)
+		peerInfo.ClientVersion = req.Header.Get(clientVersionHeader)
+		peerInfo.Room = room
+		enqueueForPairing(&peerInfo)
+
+		// Determine peer type
+		peerInfo.Kind = kind
+		peerInfo.Channel = newMessageQueue(messageBufferSize(kind))
+		peerInfo.PriorityChannel = newMessageQueue(messageBufferSize(kind))
+
+		// Generate id and add to peer map
+		peerInfo.ID = newPeerID()
+		peers[peerInfo.ID] = &peerInfo
+		notePeerCount()
+		peer = &peerInfo
+	}
+
+	// A peer reconnecting with a new id takes over the connection of its previous id
+	if previous := reconnectingPeer(req, peer); previous != nil {
+		takeOverPeer(previous, peer)
+	}
 
 	// Build up response string:
 	//   new peer info string
-	peerInfoString := peerInfo.InfoString()
+	peerInfoString := peer.InfoString()
 	responseString := peerInfoString
 
 	//   current peers (filtered for oppositing type and only peers w/o connections
-	for pID, pInfo := range peers {
-		if pInfo == nil {
-			fmt.Printf("ERROR: nil peer found at id %s\n", pID)
-			continue
+	//   and limited to the first page if there are too many)
+	available := availablePeers(peer)
+	listed, nextOffset := pagePeers(offeredPeers(peer, available, sortOrder), 0)
+	for _, pInfo := range listed {
+		responseString += pInfo.InfoString()
+	}
+	setPageHeaders(res.Header(), nextOffset)
+
+	// Also notify these peers that the new one exists (if they can discover it)
+	notifySignIn(available, peer, peerInfoString)
+
+	fmt.Printf("sign-in - Peer: %s\n", peer)
+	if len(available) == 0 && peer.Kind != observer {
+		fmt.Printf("sign-in - Peer %s found no available peers\n", peer)
+		countEvent(&lonelySignIns, "lonely_sign_ins")
+	}
+	peerEvent(eventSignIn, peer, "")
+	peerID := peer.ID
+	peerMutex.Unlock()
+
+	// Set header to match new peer id
+	setPragmaHeader(res.Header(), peerID)
+	res.Header().Set(reconnectTokenHeader, reconnectToken(peerID))
+	if sessionCookies {
+		setSessionCookie(res, req, peerID)
+	}
+
+	// Write response content
+	if err := writeBody(res, http.StatusOK, responseString); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+	countEvent(&signIns, "sign_ins")
+	printStats()
+}
+
+func signoutHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	var peerID string
+	// Parse out peers id
+	peerIDValues, peerIDExists := req.URL.Query()[peerIDParamName]
+	if peerIDExists {
+		peerID = peerIDValues[0]
+	}
+
+	peerMutex.Lock()
+	peer, exists := peers[peerID]
+	if !exists || peer == nil {
+		peerMutex.Unlock()
+		unknownPeerError(res, peerID)
+		return
+	}
+	if signOutGrace > 0 {
+		leaveAfterGrace(peer)
+	} else {
+		signOutPeer(peer)
+	}
+	peerMutex.Unlock()
+
+	setPragmaHeader(res.Header(), peerID)
+	res.WriteHeader(http.StatusOK)
+	printStats()
+}
+
+// listHandler handles requests from a peer for the peers currently available to it
+//
+//   Responds with the same peer info lines as sign in (without the
+//   requesting peer's own line) and doesn't notify anyone
+func listHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	peerIDValues, peerExists := req.URL.Query()[peerIDParamName]
+	if !peerExists {
+		http.Error(res, "Missing Peer ID", http.StatusBadRequest)
+		return
+	}
+	peerID := peerIDValues[0]
+
+	sortOrder := req.URL.Query().Get(sortParamName)
+	if !isValidPeerSortOrder(sortOrder) {
+		http.Error(res, "Invalid sort", http.StatusBadRequest)
+		return
+	}
+
+	var offset int
+	if offsetValue := req.URL.Query().Get(offsetParamName); offsetValue != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetValue)
+		if err != nil || offset < 0 {
+			http.Error(res, "Invalid offset", http.StatusBadRequest)
+			return
 		}
+	}
+
+	peerMutex.Lock()
+	peer, exists := peers[peerID]
+	if !exists || peer == nil {
+		peerMutex.Unlock()
+		unknownPeerError(res, peerID)
+		return
+	}
+	peer.LastContact = time.Now().UTC()
 
-		if pID != peerInfo.ID && pInfo.Kind != peerInfo.Kind && pInfo.ConnectedWith == "" {
-			responseString += pInfo.InfoString()
+	var responseString string
+	listed, nextOffset := pagePeers(offeredPeers(peer, availablePeers(peer), sortOrder), offset)
+	for _, pInfo := range listed {
+		responseString += pInfo.InfoString()
+	}
+	peerMutex.Unlock()
 
-			// Also notify these peers that the new one exists
-			if len(pInfo.Channel) < cap(pInfo.Channel) {
-				pInfo.Channel <- &peerMsg{pInfo.ID, peerInfoString}
-			} else {
-				fmt.Printf("WARNING: Dropped message for peer %s", pInfo)
-				// TODO: Figure out what to do when peeer message buffer fills up
-			}
-		}
+	setPageHeaders(res.Header(), nextOffset)
+	setPragmaHeader(res.Header(), peerID)
+	if err := writeBody(res, http.StatusOK, responseString); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
 	}
+}
 
-	// Set header to match new peer id
-	setPragmaHeader(res.Header(), peerInfo.ID)
+// whoamiHandler handles requests from a peer for its own peer info (as json)
+func whoamiHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
 
-	res.Header().Set("Content-Length", fmt.Sprintf("%d", len(responseString)))
-	// Set status code
-	res.WriteHeader(http.StatusOK)
+	peerIDValues, peerExists := req.URL.Query()[peerIDParamName]
+	if !peerExists {
+		http.Error(res, "Missing Peer ID", http.StatusBadRequest)
+		return
+	}
+	peerID := peerIDValues[0]
 
-	// Write response content
-	_, err := fmt.Fprintf(res, responseString)
-	if err != nil {
-		fmt.Printf("ERROR: %v\n", err)
+	peerMutex.Lock()
+	peer, exists := peers[peerID]
+	if !exists || peer == nil {
+		peerMutex.Unlock()
+		unknownPeerError(res, peerID)
+		return
 	}
-	fmt.Printf("sign-in - Peer: %s\n", peerInfo)
-	printStats()
+	peer.LastContact = time.Now().UTC()
+	view := peer.View()
+	peerMutex.Unlock()
+
+	setPragmaHeader(res.Header(), peerID)
+	writeJSON(res, http.StatusOK, view)
 }
 
-func signoutHandler(res http.ResponseWriter, req *http.Request) {
+// renameHandler handles requests from a peer to change its name
+//
+//   The peer keeps its id and kind, and peers of the opposite kind
+//   are sent the updated peer info
+func renameHandler(res http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		http.Error(res, "Bad request", http.StatusBadRequest)
 		return
 	}
-	var peerID string
-	// Parse out peers id
-	peerIDValues, peerIDExists := req.URL.Query()[peerIDParamName]
-	if peerIDExists {
-		peerID = peerIDValues[0]
+
+	peerIDValues, peerExists := req.URL.Query()[peerIDParamName]
+	nameValues, nameExists := req.URL.Query()[nameParamName]
+
+	if !peerExists || !nameExists {
+		http.Error(res, "Missing Peer ID or Name", http.StatusBadRequest)
+		return
+	}
+
+	peerID := peerIDValues[0]
+	name := nameValues[0]
+
+	if !isValidPeerName(name) {
+		http.Error(res, "Invalid name", http.StatusBadRequest)
+		return
+	}
+	if !nameAllowed(name) {
+		http.Error(res, "Name not allowed", http.StatusForbidden)
+		return
 	}
 
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
 	peer, exists := peers[peerID]
 	if !exists || peer == nil {
-		http.Error(res, "Unknown peer", http.StatusBadRequest)
+		unknownPeerError(res, peerID)
 		return
 	}
 
-	if peer.ConnectedWith != "" {
-		connectedPeer, connectionExists := peers[peer.ConnectedWith]
-		if connectionExists && connectedPeer != nil {
-			connectedPeer.ConnectedWith = ""
-		}
-	}
+	oldName := peer.Name
+	peer.Name = name
+	peer.LastContact = time.Now().UTC()
+	scheduleRenameNotification(peer)
 
 	setPragmaHeader(res.Header(), peerID)
-	delete(peers, peerID)
 	res.WriteHeader(http.StatusOK)
 
-	fmt.Printf("sign-out - Peer: %s\n", peer)
-	printStats()
+	fmt.Printf("rename - Peer: %s (was %s)\n", peer, oldName)
+}
+
+// messageReadTimeout is how long a /message body can take to read (0 for no limit)
+var messageReadTimeout time.Duration
+
+// errUnsupportedEncoding is returned by decodedBody for bodies it can't (or won't) decode
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// decodedBody returns a reader for the request body with any gzip content encoding removed
+//
+//   Encoded bodies are rejected outright in strictContentEncoding mode, and
+//   reading more than maxDecodedMessageBytes of a decoded body fails with
+//   an *http.MaxBytesError (so a small body can't decompress without bound)
+func decodedBody(req *http.Request) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+	switch {
+	case encoding == "" || encoding == "identity":
+		return req.Body, nil
+	case strictContentEncoding:
+		return nil, errUnsupportedEncoding
+	case encoding == "gzip" || encoding == "x-gzip":
+		unzipper, err := gzip.NewReader(req.Body)
+		if err != nil || maxDecodedMessageBytes <= 0 {
+			return unzipper, err
+		}
+		return http.MaxBytesReader(nil, unzipper, maxDecodedMessageBytes), nil
+	}
+	return nil, errUnsupportedEncoding
+}
+
+// readBodyWithDeadline reads all of a request body, giving up after messageReadTimeout
+//
+//   The deadline is set on the connection, so it only applies when the
+//   response writer supports read deadlines (the http and http2 servers do)
+func readBodyWithDeadline(res http.ResponseWriter, body io.Reader) ([]byte, error) {
+	if messageReadTimeout <= 0 {
+		return ioutil.ReadAll(body)
+	}
+
+	controller := http.NewResponseController(res)
+	if err := controller.SetReadDeadline(time.Now().Add(messageReadTimeout)); err != nil {
+		return ioutil.ReadAll(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err == nil {
+		// Leave an expired deadline in place on errors, so the server doesn't wait on the rest of the body either
+		controller.SetReadDeadline(time.Time{})
+	}
+	return data, err
+}
+
+// isTimeout reports whether an error is from a deadline passing
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
 }
 
 // messageHandler handles requests from a peer to send a message to another peer
 func messageHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		// A common client mistake, so say what the request should have been
+		res.Header().Set("Allow", "POST")
+		writeJSON(res, http.StatusMethodNotAllowed, methodHint{
+			Error:  "/message only accepts POST",
+			Method: "POST",
+			Params: []string{peerIDParamName, toParamName},
+			Hint:   "POST the message as the body to /message?peer_id=<your id>&to=<recipient id>",
+		})
+		return
+	}
 	if req.Method != "POST" {
 		http.Error(res, "Bad request", http.StatusBadRequest)
 		return
@@ -262,48 +1441,143 @@ func messageHandler(res http.ResponseWriter, req *http.Request) {
 	peerID := peerIDValues[0]
 	toID := toIDValues[0]
 
+	if !wellFormedPeerID(peerID) || !wellFormedPeerID(toID) {
+		http.Error(res, "Malformed Peer or To ID", http.StatusBadRequest)
+		return
+	}
+
+	peerMutex.Lock()
 	from, peerInfoExists := peers[peerID]
 	to, toInfoExists := peers[toID]
+	peerMutex.Unlock()
 
 	if !peerInfoExists || !toInfoExists || from == nil || to == nil {
+		if isReservedPeerID(peerID) || isReservedPeerID(toID) {
+			http.Error(res, "Peer was removed", http.StatusGone)
+			return
+		}
 		http.Error(res, "Invalid Peer or To ID", http.StatusBadRequest)
 		return
 	}
-	// Update the last time we heard from peer
-	from.LastContact = time.Now().UTC()
 
-	if from.ConnectedWith == "" {
-		fmt.Printf("Connecting %s with %s\n", from, to)
-		from.ConnectedWith = to.ID
+	if from.Kind == observer || to.Kind == observer {
+		http.Error(res, "Observers can't send or recieve messages", http.StatusForbidden)
+		return
 	}
 
-	if to.ConnectedWith == "" {
-		fmt.Printf("Connecting %s with %s\n", to, from)
-		to.ConnectedWith = from.ID
+	peerMutex.Lock()
+	receiving := !breakerOpen(to)
+	peerMutex.Unlock()
+	if !receiving {
+		http.Error(res, "Peer is not receiving messages", http.StatusServiceUnavailable)
+		return
 	}
 
-	if from.ConnectedWith != to.ID {
-		fmt.Printf("WARNING: Peer sending message to recipient outside room\n")
+	if busyConflict(from, to) {
+		res.Header().Set("X-Peer-Busy", "true")
+		http.Error(res, "Peer is busy, try again later or another peer", http.StatusConflict)
+		return
 	}
 
 	// Must set pragma to peer id of sender
 	setPragmaHeader(res.Header(), peerID)
 
 	// Read message data as a string and send it to the recipients channel
-	requestData, err := ioutil.ReadAll(req.Body)
+	defer req.Body.Close()
+	body, err := decodedBody(req)
+	if err == errUnsupportedEncoding {
+		http.Error(res, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(res, "Bad message body", http.StatusBadRequest)
+		return
+	}
+	requestData, err := readBodyWithDeadline(res, body)
+	if isTimeout(err) {
+		fmt.Printf("WARNING: Timed out reading message body from %s after %s\n", req.RemoteAddr, messageReadTimeout)
+		http.Error(res, "Timed out reading message", http.StatusRequestTimeout)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		fmt.Printf("WARNING: Message from %s decompresses to more than %d bytes\n", req.RemoteAddr, tooLarge.Limit)
+		http.Error(res, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	requestString := string(requestData)
-	defer req.Body.Close()
-	// Look up channel for to id
-	if len(to.Channel) == cap(to.Channel) {
+
+	// Either peer may have signed out while the message was read so look them up
+	// again and hold the lock until the message is queued
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if peers[peerID] != from || peers[toID] != to {
+		http.Error(res, "Peer has signed out", http.StatusGone)
+		return
+	}
+
+	// Update the last time we heard from peer
+	from.LastContact = time.Now().UTC()
+	checkPeerRemoteIP(from, clientIP(req))
+
+	if !allowPairMessage(from.ID, to.ID) {
+		fmt.Printf("WARNING: Peer %s is sending messages to %s too quickly\n", from, to)
+		http.Error(res, "Too many messages", http.StatusTooManyRequests)
+		return
+	}
+	if messageAllowanceUsed(from) {
+		fmt.Printf("WARNING: Peer %s has sent its %d messages\n", from, maxMessagesPerPeer)
+		http.Error(res, "Message limit reached, sign in again to send more", http.StatusTooManyRequests)
+		return
+	}
+
+	// Checked before pairing, so a rejected message doesn't pair the peers
+	if inFlightLimitReached() {
+		fmt.Printf("WARNING: In-flight message limit (%d) reached, rejecting message for peer %s\n", maxInFlightMessages, to)
+		http.Error(res, "Server is backed up", http.StatusServiceUnavailable)
+		return
+	}
+
+	paired, connected := connectPair(from, to)
+	if paired {
+		peerEvent(eventPair, from, to.ID)
+	}
+
+	if !connected {
+		warnOutOfRoom(from, to)
+	}
+
+	// channel gets message + sender id (and the sender's content type to pass on)
+	msg := &peerMsg{FromID: peerID, Message: requestString, ContentType: req.Header.Get("Content-Type"), Priority: normalPriority, QueuedAt: time.Now()}
+	queued := to.Channel.Send(req.Context(), msg, 0)
+	if !queued && enqueueTimeout > 0 {
+		// Give the recipient a moment to drain its buffer (without holding the lock)
+		peerMutex.Unlock()
+		queued = to.Channel.Send(req.Context(), msg, enqueueTimeout)
+		peerMutex.Lock()
+	}
+	if !queued {
+		to.FailedSends++
+		recordBackedUp(to)
 		http.Error(res, "Peer is backed up", http.StatusServiceUnavailable)
 		return
 	}
-	// channel gets message + sender id
-	to.Channel <- &peerMsg{peerID, requestString}
+	messageQueued()
 
+	if peers[toID] != to {
+		// The recipient left while waiting for room, so make sure nothing is left in its buffer
+		drainPeerMessages(to)
+		http.Error(res, "Peer has signed out", http.StatusGone)
+		return
+	}
+
+	countEvent(&relayedMessages, "messages")
+	from.MessagesSent++
+	from.LastSentContentType = msg.ContentType
 	res.WriteHeader(http.StatusOK)
 	fmt.Printf("message: %s -> %s: \n\t%s\n", from, to, requestString)
 }
@@ -328,109 +1602,548 @@ func waitHandler(res http.ResponseWriter, req *http.Request) {
 
 	peerID := peerIDValues[0]
 
+	if !wellFormedPeerID(peerID) {
+		http.Error(res, "Malformed Peer ID", http.StatusBadRequest)
+		return
+	}
+
+	peerMutex.Lock()
 	peerInfo, peerInfoExists := peers[peerID]
 
 	if !peerInfoExists || peerInfo == nil {
-		http.Error(res, "Unknown peer", http.StatusBadRequest)
+		peerMutex.Unlock()
+		unknownPeerError(res, peerID)
 		return
 	}
 
+	ctx, cancelWait := context.WithCancelCause(req.Context())
+	defer cancelWait(nil)
+	takeOverWait(peerInfo)
+	peerInfo.CancelWait = cancelWait
+
 	// Update the last time we heard from peer
 	peerInfo.LastContact = time.Now().UTC()
 	// Also set that peer is waiting (so that peer isn't cleaned up)
 	peerInfo.Waiting = true
+	peerInfo.WaitStartedAt = peerInfo.LastContact
+	resetBreaker(peerInfo)
+
+	waitStartedAt := peerInfo.WaitStartedAt
 
 	fmt.Printf("wait: Peer %s waiting...\n", peerInfo)
+	peerMutex.Unlock()
+
+	// However the wait ends (even in a panic) the peer stops counting as
+	// waiting, or it could never be cleaned up
+	defer doneWaiting(peerInfo, waitStartedAt)
 
 	// Wait for message (from channel) OR client disconnect
-	var peerMsg *peerMsg
-	var cancelled bool
-	select {
-	case peerMsg = <-(peerInfo.Channel):
-	case <-req.Context().Done():
-		cancelled = true
+	peerMsg, cancelled := receiveMessage(peerInfo, ctx.Done())
+
+	if !cancelled {
+		peerMutex.Lock()
+		peerInfo.FailedSends = 0
+		// It may have been some time since the msg came through so update the time
+		peerInfo.LastContact = time.Now().UTC()
+		peerMutex.Unlock()
 	}
-	peerInfo.Waiting = false
 
+	if cancelled && waitTakenOver(ctx) {
+		http.Error(res, "Wait taken over by a newer wait", http.StatusConflict)
+		return
+	}
 	if cancelled {
-		fmt.Printf("Peer (%s) cancelled/closed connection. Terminating wait call.\n", peerInfo)
+		fmt.Printf("Peer (%s) cancelled/closed connection. Terminating wait call.\n", peerID)
 		return
 	}
+	messagesDequeued(1)
 	if peerMsg == nil {
 		fmt.Printf("Error: nil peerMsg in channel")
 		http.Error(res, "Bad message", http.StatusInternalServerError)
 		return
 	}
-	// It may have been some time since the msg came through so update the time
-	peerInfo.LastContact = time.Now().UTC()
 
-	res.Header().Set("Content-Length", fmt.Sprintf("%d", len(peerMsg.Message)))
+	if peerMsg.ContentType != "" {
+		res.Header().Set("Content-Type", peerMsg.ContentType)
+	}
+	if peerMsg.Replay {
+		res.Header().Set(replayHeader, "true")
+	}
 	// Pragma must be set to the message *sender's* id
 	setPragmaHeader(res.Header(), peerMsg.FromID)
 
 	// set status and write out message contant to response
-	res.WriteHeader(http.StatusOK)
-	_, err := fmt.Fprint(res, peerMsg.Message)
+	err := writeBody(res, http.StatusOK, peerMsg.Message)
+	if err == nil {
+		// Small messages sit in the server's buffer until the handler returns, so
+		// flush to find out now whether the client is still there to receive it
+		if err = http.NewResponseController(res).Flush(); errors.Is(err, http.ErrNotSupported) {
+			err = nil
+		}
+	}
 	if err != nil {
 		fmt.Printf("ERROR: %v\n", err)
+		peerMutex.Lock()
+		requeueUndelivered(peerInfo, peerMsg)
+		peerMutex.Unlock()
+		return
+	}
+	peerMutex.Lock()
+	if peerMsg.FromID != peerInfo.ID {
+		peerInfo.LastReceivedContentType = peerMsg.ContentType
+		if replayLastMessage {
+			peerInfo.LastDelivered = peerMsg
+		}
 	}
-
 	fmt.Printf("wait: Peer %s recieved message from ID %s\n\t%s\n\n", peerInfo, peerMsg.FromID, peerMsg.Message)
+	peerMutex.Unlock()
 }
 
-// peerCleanupRoutine periodically cleans up stale peers
+// receiveMessage waits for the next message for a peer, or for done to be closed
 //
-//   Currently hardcoded to check every 30 seconds for peers
-//   that haven't contacted the server in a minute or more
-func peerCleanupRoutine() {
-	tickerChan := time.NewTicker(time.Second * 30).C
-
+//   High priority messages are always taken first, stale peer info lines
+//   are skipped and queued messages are held on to while the peer is
+//   paused (including if it's paused mid wait)
+func receiveMessage(peer *peerInfo, done <-chan struct{}) (msg *peerMsg, cancelled bool) {
 	for {
-		<-tickerChan
-		fmt.Printf("Checking for stale peers\n")
-		printStats()
-		for k, v := range peers {
-			if v == nil {
-				fmt.Println("ERROR: nil peer in peers!")
+		unpaused, paused := pauseChannels(peer)
+		if unpaused != nil {
+			select {
+			case <-unpaused:
+			case <-done:
+				return nil, true
+			}
+			continue
+		}
+
+		select {
+		case msg = <-peer.PriorityChannel.Receive():
+		default:
+			select {
+			case msg = <-peer.PriorityChannel.Receive():
+			case msg = <-peer.Channel.Receive():
+			case <-paused:
 				continue
+			case <-done:
+				return nil, true
 			}
-			if !v.Waiting && (time.Now().UTC().Sub(v.LastContact) > time.Minute*1) {
-				fmt.Printf("Removing stale peer %s\n", v)
-				connectedWithPeer := peers[v.ConnectedWith]
-				if connectedWithPeer != nil {
-					fmt.Printf("Disconnecting peer %s with id %s\n", v, connectedWithPeer)
-					connectedWithPeer.ConnectedWith = ""
-				}
-				delete(peers, k)
+		}
+		if !stalePresence(msg) {
+			return msg, false
+		}
+		fmt.Printf("wait: Dropping stale peer info for peer %s\n\t%s", peer.ID, msg.Message)
+		messagesDequeued(1)
+	}
+}
+
+// doneWaiting stops a peer counting as waiting once the wait that started at startedAt is over
+//
+//   Unless it's already waiting again, as a response can reach the client
+//   (and it can start its next wait) before the handler returns
+func doneWaiting(peer *peerInfo, startedAt time.Time) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if peer.WaitStartedAt.Equal(startedAt) {
+		peer.Waiting = false
+		peer.CancelWait = nil
+	}
+}
+
+// requeueUndelivered puts a message that couldn't be written to a waiting peer back on its channel
+//
+//   The message goes back in front of anything queued since, so offers and
+//   candidates are still delivered in order, and is counted as lost if
+//   there's no room left for it. A sender waiting for room (see
+//   enqueueTimeout) can take a place while the queue is drained, so the
+//   messages put back after it can be lost too
+//   Must be called with peerMutex held
+func requeueUndelivered(peer *peerInfo, msg *peerMsg) {
+	queue := queueFor(peer, msg)
+	var queued []*peerMsg
+	if queue.Len() < queue.Cap() {
+		for drained := false; !drained; {
+			select {
+			case next := <-queue.Receive():
+				queued = append(queued, next)
+			default:
+				drained = true
 			}
 		}
 	}
+	if queue.Send(context.Background(), msg, 0) {
+		messageQueued()
+		fmt.Printf("wait: Re-queued undelivered message from ID %s for peer %s\n", msg.FromID, peer)
+	} else {
+		countEvent(&lostMessages, "lost_messages")
+		fmt.Printf("WARNING: Lost undelivered message from ID %s for peer %s, no room to re-queue it\n", msg.FromID, peer)
+	}
+	for _, next := range queued {
+		if !queue.Send(context.Background(), next, 0) {
+			messagesDequeued(1)
+			countEvent(&lostMessages, "lost_messages")
+			fmt.Printf("WARNING: Lost message from ID %s for peer %s, no room to put it back after re-queueing\n", next.FromID, peer)
+		}
+	}
+}
+
+// peerCleanupRoutine periodically cleans up stale peers until stop is closed
+//
+//   Checks every cleanupInterval for peers that haven't contacted
+//   the server in the stale timeout for their kind or more
+func peerCleanupRoutine(stop chan struct{}) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		fmt.Printf("Checking for stale peers\n")
+		printStats()
+		runCleanup()
+	}
+}
+
+// runCleanup does a single cleanup pass, removing stale, expired and unreachable peers
+// (and forgetting expired id reservations and closed room notices)
+//
+//   Returns the number of peers removed
+func runCleanup() int {
+	expireReservedPeerIDs()
+	expireClosedRooms()
+	warnInactivePeers()
+	return removeStalePeers() + removeExpiredPeers() + compactUnreachablePeers()
+}
+
+// removeExpiredPeers removes peers that signed in more than maxPeerLifetime ago,
+// however recently they were heard from (a maxPeerLifetime of 0 disables this)
+//
+//   The peers each is connected with are sent a peer-left notice
+//   Returns the number of peers removed
+func removeExpiredPeers() int {
+	if maxPeerLifetime <= 0 {
+		return 0
+	}
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	var removed int
+	for _, v := range peers {
+		if v != nil && time.Now().UTC().Sub(v.SignedInAt) > maxPeerLifetime {
+			fmt.Printf("Removing peer %s signed in since %s\n", v, v.SignedInAt.Format(time.RFC3339))
+			reapPeer(v, "lifetime")
+			removed++
+		}
+	}
+	return removed
+}
+
+// removeStalePeers removes peers that aren't waiting and haven't contacted
+// the server in the stale timeout for their kind (a timeout of 0 disables this)
+//
+//   Returns the number of peers removed
+func removeStalePeers() int {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	var removed int
+	for _, v := range peers {
+		if v == nil {
+			fmt.Println("ERROR: nil peer in peers!")
+			continue
+		}
+		timeout := staleTimeoutFor(v.Kind)
+		if timeout > 0 && !v.Waiting && (time.Now().UTC().Sub(v.LastContact) > timeout) {
+			fmt.Printf("Removing stale peer %s\n", v)
+			reapPeer(v, "stale")
+			removed++
+		}
+	}
+	return removed
+}
+
+// compactUnreachablePeers removes peers that messages could not be delivered to
+// maxFailedSends times in a row, or whose circuit breaker has been open for
+// breakerWindow, regardless of how recently they were heard from
+//
+//   Returns the number of peers removed
+func compactUnreachablePeers() int {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	var removed int
+	for _, v := range peers {
+		if v != nil && (maxFailedSends > 0 && v.FailedSends >= maxFailedSends || breakerExpired(v)) {
+			fmt.Printf("Removing unreachable peer %s after %d failed sends\n", v, v.FailedSends)
+			reapPeer(v, "unreachable")
+			removed++
+		}
+	}
+	return removed
+}
+
+// listenAddress works out the address to listen on from the -addr flag and the port
+//
+//   addr can be empty (every interface), a host:port (ipv6 literals in
+//   brackets, e.g. [::1]:8087) or just an ip, in which case port is used
+func listenAddress(addr string, port string) (string, error) {
+	if addr == "" {
+		return net.JoinHostPort("", port), nil
+	}
+	if ip := net.ParseIP(strings.Trim(addr, "[]")); ip != nil {
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+
+	host, addrPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %s (expected host:port, with ipv6 addresses in brackets like [::1]:8087): %v", addr, err)
+	}
+	if number, err := strconv.Atoi(addrPort); err != nil || number < 0 || number > 65535 {
+		return "", fmt.Errorf("invalid port in listen address %s", addr)
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid ipv6 address in listen address %s", addr)
+	}
+	return addr, nil
+}
+
+// newHTTPServer creates the http server for the given address and handler
+//
+//   Requests with headers larger than maxHeaderBytes are rejected
+//   by the server with a 431 (Request Header Fields Too Large).
+//   Request contexts derive from ctx so cancelling it ends any hanging waits.
+//   With h2c the server also takes cleartext http/2 connections
+func newHTTPServer(ctx context.Context, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		MaxHeaderBytes: maxHeaderBytes,
+		BaseContext:    func(net.Listener) context.Context { return ctx },
+	}
+	if h2c {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return srv
+}
+
+// broadcastShutdownNotice tells every peer the server is going away
+//
+//   Returns the number of peers notified
+func broadcastShutdownNotice() int {
+	reconnectIn := fmt.Sprintf("%d", int(shutdownReconnectHint.Seconds()))
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	var notified int
+	for _, v := range peers {
+		if v != nil {
+			notifyPeerNotice(v, goingAwayNotice, map[string]string{"reconnect_in": reconnectIn})
+			notified++
+		}
+	}
+	return notified
+}
+
+// pendingWaiterMessages reports whether any waiting peer still has messages to pick up
+func pendingWaiterMessages() bool {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	for _, v := range peers {
+		if v != nil && v.Waiting && pendingMessages(v) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdownServer gracefully shuts down the server
+//
+//   Peers are sent a going away notice and waiting peers are given up
+//   to shutdownDrainTimeout to receive it before remaining waits are
+//   cancelled (with cancelRequests) and the server is shut down
+func shutdownServer(srv *http.Server, cancelRequests context.CancelFunc) error {
+	fmt.Printf("Shutting down, notified %d peers\n", broadcastShutdownNotice())
+
+	deadline := time.Now().Add(shutdownDrainTimeout)
+	for pendingWaiterMessages() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancelRequests()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownDrainTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
 }
 
-func main() {
+// Main runs the gosigsrv command, configured from the command line flags
+//
+//   It serves until interrupted and exits the process when done
+func Main() {
+
+	flag.Int64Var(&maxInFlightMessages, "max-in-flight", maxInFlightMessages, "Maximum number of messages buffered across all peers (0 for no limit)")
+	flag.BoolVar(&strictRoutes, "strict-routes", strictRoutes, "Only route requests whose path exactly matches a handler (no case or trailing slash tolerance)")
+	flag.StringVar(&auditFilePath, "audit-file", auditFilePath, "File to append a JSON line to for every sign-in, sign-out and pairing event (reopened on SIGHUP)")
+	flag.BoolVar(&auditFsync, "audit-fsync", auditFsync, "Sync the audit file to disk after every record")
+	flag.Float64Var(&pairMessageRate, "pair-rate", pairMessageRate, "Messages per second a peer may send to one other peer (0 for no limit)")
+	flag.IntVar(&pairMessageBurst, "pair-burst", pairMessageBurst, "Messages a peer may send to one other peer in a burst when -pair-rate is set")
+	flag.BoolVar(&notifyUndelivered, "notify-undelivered", notifyUndelivered, "Send a delivery-failed notice to senders whose messages were still queued when the recipient left")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", maxHeaderBytes, "Maximum size of request headers in bytes (larger requests get a 431)")
+	flag.IntVar(&maxFailedSends, "max-failed-sends", maxFailedSends, "Consecutive failed deliveries to a peer before it is removed as unreachable (0 to never remove)")
+	flag.DurationVar(&shutdownReconnectHint, "shutdown-reconnect-hint", shutdownReconnectHint, "How long peers are told to wait before reconnecting when the server shuts down")
+	flag.DurationVar(&shutdownDrainTimeout, "shutdown-drain-timeout", shutdownDrainTimeout, "How long shutdown waits for peers to receive the going away notice")
+	flag.IntVar(&maxListedPeers, "max-listed-peers", maxListedPeers, "Maximum number of peers returned by sign in or list, the rest can be paged through with /list?offset= (0 for no limit)")
+	flag.StringVar(&discoveryMode, "discovery", discoveryMode, "Which peers are advertised to each other: "+discoverOppositeKind+" or "+discoverAllPeers+" (mesh)")
+	flag.StringVar(&tlsCertFile, "tls-cert", tlsCertFile, "Certificate file to serve https with (requires -tls-key)")
+	flag.StringVar(&tlsKeyFile, "tls-key", tlsKeyFile, "Private key file to serve https with (requires -tls-cert)")
+	flag.StringVar(&httpRedirectPort, "http-redirect-port", httpRedirectPort, "When serving https, also listen for plain http on this port and redirect it to https")
+	flag.DurationVar(&cleanupInterval, "cleanup-interval", cleanupInterval, "How often to check for stale peers")
+	flag.DurationVar(&staleTimeout, "stale-timeout", staleTimeout, "How long a peer can go without contacting the server before it is removed (0 to never remove idle peers)")
+	flag.BoolVar(&reportAvailability, "report-availability", reportAvailability, "Report connected peers with a 0 in the last field of peer info lines (some clients treat 0 as signed out)")
+	flag.DurationVar(&maxPeerLifetime, "max-peer-lifetime", maxPeerLifetime, "How long a peer can stay signed in, however active it is (0 for no limit)")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "Bearer token required for /admin endpoints (admin endpoints are disabled without one)")
+	flag.IntVar(&serverMessageBufferSize, "server-msg-buffer", serverMessageBufferSize, "Number of messages buffered for each server peer")
+	flag.IntVar(&clientMessageBufferSize, "client-msg-buffer", clientMessageBufferSize, "Number of messages buffered for each client (or other non-server) peer")
+	flag.BoolVar(&strictContentEncoding, "strict-content-encoding", strictContentEncoding, "Reject messages with a Content-Encoding with a 415 instead of decoding gzip")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", breakerThreshold, "Backed up deliveries to a peer within -breaker-window before messages to it are refused (0 to disable)")
+	flag.DurationVar(&breakerWindow, "breaker-window", breakerWindow, "Window for -breaker-threshold, and how long messages are refused before the peer is removed unless it polls again")
+	flag.DurationVar(&enqueueTimeout, "enqueue-timeout", enqueueTimeout, "How long a message waits for room in a full recipient buffer before /message returns a 503")
+	flag.StringVar(&corsExcludedRoutes, "cors-exclude", corsExcludedRoutes, "Comma separated routes that don't get CORS headers (routes ending in / include everything beneath them)")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", tlsMinVersion, "Minimum TLS version accepted (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&tlsCipherSuites, "tls-ciphers", tlsCipherSuites, "Comma separated TLS 1.2 cipher suites to allow (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), defaults to Go's secure suites")
+	flag.BoolVar(&sessionCookies, "session-cookies", sessionCookies, "Set a session cookie on sign in that resumes the same peer when it signs in again")
+	flag.StringVar(&sessionSecret, "session-secret", sessionSecret, "Key to sign session cookies with (random by default, so sessions don't survive restarts)")
+	flag.StringVar(&stateFilePath, "state-file", stateFilePath, "File peers are saved to on shutdown and restored from on start")
+	flag.BoolVar(&stateCompress, "state-compress", stateCompress, "Gzip the state file (also done when -state-file ends in .gz)")
+	flag.BoolVar(&lowercaseRooms, "lowercase-rooms", lowercaseRooms, "Lowercase room names so rooms are case insensitive")
+	flag.BoolVar(&requireRoom, "require-room", requireRoom, "Reject sign ins without a room with a 400 instead of putting them in the default room")
+	flag.BoolVar(&fifoPairing, "fifo-pairing", fifoPairing, "List available peers longest waiting first so every peer gets its turn to be paired")
+	flag.StringVar(&trustedProxies, "trusted-proxies", trustedProxies, "Comma separated ips or cidrs of proxies whose forwarding headers are trusted (empty trusts none, required by -require-https-proto)")
+	flag.BoolVar(&requireHTTPSProto, "require-https-proto", requireHTTPSProto, "Reject requests without an X-Forwarded-Proto: https header from a trusted proxy with a 403")
+	flag.IntVar(&maxNamesPerIP, "max-names-per-ip", maxNamesPerIP, "Maximum number of distinct peer names signed in from one client ip at once (0 for no limit)")
+	flag.StringVar(&accessLogFormat, "access-log-format", accessLogFormat, "Log every request in "+accessLogCombined+" or "+accessLogJSON+" format (no access log by default)")
+	flag.IntVar(&accessLogBufferSize, "access-log-buffer", accessLogBufferSize, "Number of access log lines buffered and written in the background (0 writes each line right away)")
+	flag.DurationVar(&accessLogFlushInterval, "access-log-flush-interval", accessLogFlushInterval, "How often buffered access log lines are flushed")
+	flag.StringVar(&accessLogOverflow, "access-log-overflow", accessLogOverflow, "What happens to requests when the access log buffer is full: "+accessLogBlock+" until there's room or "+accessLogDrop+" their lines")
+	flag.DurationVar(&reservedIDTTL, "reserved-id-ttl", reservedIDTTL, "How long the id of a reaped peer is kept from new peers, requests using it get a 410 (0 to not reserve ids)")
+	flag.DurationVar(&messageReadTimeout, "message-read-timeout", messageReadTimeout, "How long reading a /message body may take before the request gets a 408 (0 for no limit)")
+	flag.Func("name-allowlist", "Regex peer names must match to sign in (can be given more than once, names matching any are allowed)", func(pattern string) error {
+		nameAllowlistPatterns = append(nameAllowlistPatterns, pattern)
+		return nil
+	})
+	flag.IntVar(&maxPeers, "max-peers", maxPeers, "Maximum number of peers signed in at once, further sign ins get a 503 (0 for no limit)")
+	flag.StringVar(&profileName, "profile", profileName, "Preset of limits ("+profileNames()+"), individual flags override it")
+	flag.BoolVar(&keepAlive, "keepalive", keepAlive, "Let clients keep connections open instead of sending Connection: close with every response")
+	flag.StringVar(&statsdAddr, "statsd-addr", statsdAddr, "host:port of a statsd server to send metrics to over udp")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", statsdPrefix, "Prefix of statsd metric names")
+	flag.DurationVar(&statsdInterval, "statsd-interval", statsdInterval, "How often metrics are sent to statsd")
+	flag.StringVar(&extraHeaderList, "extra-headers", extraHeaderList, "Comma separated name:value headers to add to every response (e.g. X-Env:prod)")
+	flag.BoolVar(&serveTestPage, "serve-testpage", serveTestPage, "Serve a minimal test client page on /test")
+	flag.StringVar(&listenAddr, "addr", listenAddr, "Address to listen on, host:port or just an ip to use $PORT (ipv6 addresses in brackets, e.g. [::1]:8087)")
+	flag.DurationVar(&slowWaiterInterval, "slow-waiter-interval", slowWaiterInterval, "How often to log the peers that have been waiting the longest (0 to never log them)")
+	flag.DurationVar(&slowWaiterThreshold, "slow-waiter-threshold", slowWaiterThreshold, "How long a peer has to have been waiting to be logged as a slow waiter")
+	flag.IntVar(&slowWaiterCount, "slow-waiter-count", slowWaiterCount, "How many of the slowest waiters to log")
+	flag.IntVar(&maxPartners, "max-partners", maxPartners, "Maximum number of peers a peer can be connected with at once (0 for no limit)")
+	flag.BoolVar(&rejectBusy, "reject-busy", rejectBusy, "Refuse messages to busy peers from peers they aren't connected with with a 409")
+	flag.IntVar(&maxRoomsPerName, "max-rooms-per-name", maxRoomsPerName, "Maximum number of rooms peers with the same name can be signed in to at once (0 for no limit)")
+	flag.DurationVar(&presenceMaxAge, "presence-max-age", presenceMaxAge, "How old queued peer info lines can get before /wait drops them instead of delivering them (0 to never drop them)")
+	flag.IntVar(&idBytes, "id-bytes", idBytes, "Number of random bytes in peer ids, at least 8 (0 for increasing numbers)")
+	flag.StringVar(&idEncoding, "id-encoding", idEncoding, "How random peer ids are encoded, "+idEncodingHex+" or "+idEncodingBase64URL)
+	flag.BoolVar(&replayLastMessage, "replay-last-message", replayLastMessage, "Deliver the last message relayed to a peer again (with X-Replay: true) when it resumes or reconnects")
+	flag.BoolVar(&strictPeerIDs, "strict-peer-ids", strictPeerIDs, "Reject peer ids that aren't in the format the server hands out with a 400 before looking them up")
+	flag.Int64Var(&maxConcurrentSignIns, "max-concurrent-signins", maxConcurrentSignIns, "Maximum number of sign ins handled at once, further sign ins get a 503 (0 for no limit)")
+	flag.Int64Var(&maxDecodedMessageBytes, "max-decoded-message-bytes", maxDecodedMessageBytes, "Largest a gzip message body can decompress to, larger messages get a 413 (0 for no limit)")
+	flag.StringVar(&sessionOrigins, "session-origins", sessionOrigins, "Comma separated origins allowed to make cross origin requests with the session cookie (with -session-cookies)")
+	flag.BoolVar(&gzipResponses, "gzip-responses", gzipResponses, "Gzip responses for clients that accept it")
+	flag.IntVar(&gzipMinBytes, "gzip-min-bytes", gzipMinBytes, "Smallest response that is gzipped (with -gzip-responses), smaller ones are sent uncompressed")
+	flag.BoolVar(&healthChecks, "health-checks", healthChecks, "Check that the state file can be written and the statsd address resolves on /health, and report a degraded 503 when one fails")
+	flag.DurationVar(&renameDebounce, "rename-debounce", renameDebounce, "How long to wait for more renames before telling other peers about a peer's new name (0 to tell them right away)")
+	flag.StringVar(&matcherName, "matcher", matcherName, "How available peers are offered to peers that don't ask for a sort order: "+matchDefault+", "+matchRoundRobin+", "+matchLeastLoaded+", "+matchRandom+" or one registered with RegisterMatcher")
+	flag.DurationVar(&signOutGrace, "sign-out-grace", signOutGrace, "How long a signed out peer stays listed and connected with its partners in case it signs back in from the same address (0 removes it right away)")
+	flag.IntVar(&maxQueryParams, "max-query-params", maxQueryParams, "Maximum number of query parameters a request can have, requests with more get a 400 (0 for no limit)")
+	flag.IntVar(&maxQueryLength, "max-query-length", maxQueryLength, "Maximum length of a request's query string in bytes, longer ones get a 400 (0 for no limit)")
+	flag.IntVar(&maxSignInNotifications, "max-signin-notifications", maxSignInNotifications, "How many of the most recently active available peers are told about a new peer right away, the rest are told in batches of this size (0 for no limit)")
+	flag.DurationVar(&signInNotificationDelay, "signin-notification-delay", signInNotificationDelay, "How long apart the batches of deferred new peer notifications are sent (with -max-signin-notifications)")
+	flag.IntVar(&maxMessagesPerPeer, "max-messages-per-peer", maxMessagesPerPeer, "Maximum number of messages a peer may send before signing in again, further messages get a 429 (0 for no limit)")
+	flag.DurationVar(&inactivityWarning, "inactivity-warning", inactivityWarning, "How long before an idle peer would be removed as stale that it is sent an inactivity-warning notice, should be longer than -cleanup-interval (0 to never warn)")
+	flag.BoolVar(&h2c, "h2c", h2c, "Also serve cleartext http/2 (with prior knowledge, e.g. from a load balancer that speaks h2c)")
+	flag.BoolVar(&websocketEnabled, "websocket", websocketEnabled, "Serve /ws, which delivers a peer's messages over a websocket instead of /wait")
+	flag.DurationVar(&clientStaleTimeout, "client-stale-timeout", clientStaleTimeout, "How long a client can go without contacting the server before it is removed (0 to use -stale-timeout)")
+	flag.DurationVar(&serverStaleTimeout, "server-stale-timeout", serverStaleTimeout, "How long a server can go without contacting the server before it is removed (0 to use -stale-timeout)")
+	flag.BoolVar(&waitTakeover, "wait-takeover", waitTakeover, "A new /wait for a peer that is already waiting cancels the old one (which gets a 409) and takes over its messages")
+	flag.Parse()
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if err := applyProfile(profileName, setFlags); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := validateSettings(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if accessLogOverflow != accessLogBlock && accessLogOverflow != accessLogDrop {
+		fmt.Printf("Error: unknown access log overflow policy %s\n", accessLogOverflow)
+		os.Exit(1)
+	}
+	if accessLogBufferSize > 0 && accessLogFlushInterval <= 0 {
+		fmt.Printf("Error: access log flush interval must be positive, got %s\n", accessLogFlushInterval)
+		os.Exit(1)
+	}
 
+	startTime = time.Now().UTC()
 	fmt.Println("gosigsrv starting")
 	fmt.Println()
 
+	if auditFilePath != "" {
+		if err := openAuditLog(); err != nil {
+			fmt.Printf("Error: could not open audit file: %v\n", err)
+			os.Exit(1)
+		}
+		go reopenAuditLogOnHangup()
+	}
+
+	if stateFilePath != "" {
+		if err := loadState(stateFilePath); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Error: could not restore state: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8087"
 	}
+	addr, err := listenAddress(listenAddr, port)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 
-	fmt.Printf("Will listen on port %s\n\n", port)
-
-	// Register handlers
-	registerHandler("/sign_in", commonHeaderMiddleware(http.HandlerFunc(signinHandler)))
-	registerHandler("/sign_out", commonHeaderMiddleware(http.HandlerFunc(signoutHandler)))
-	registerHandler("/message", commonHeaderMiddleware(http.HandlerFunc(messageHandler)))
-	registerHandler("/wait", commonHeaderMiddleware(http.HandlerFunc(waitHandler)))
-	registerHandler("/", commonHeaderMiddleware(http.HandlerFunc(printReqHandler)))
-
-	// Start peer cleenup timer routine
-	go peerCleanupRoutine()
+	fmt.Printf("Will listen on %s\n\n", addr)
 
-	// Start listening
-	err := http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
+	// Shut down gracefully on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if accessLogFormat != "" && accessLogBufferSize > 0 {
+		accessLogBuffer = newAsyncLog(accessLogOutput, accessLogBufferSize, accessLogFlushInterval, accessLogOverflow == accessLogDrop)
+	}
+	server, err := NewServer(Config{Addr: addr})
+	if err == nil {
+		err = server.Run(ctx)
+	}
+	stop()
+	if accessLogBuffer != nil {
+		if dropped := accessLogBuffer.Close(); dropped > 0 {
+			fmt.Printf("WARNING: Dropped %d access log lines\n", dropped)
+		}
+	}
+	if ctx.Err() != nil && stateFilePath != "" {
+		if stateErr := saveState(stateFilePath); stateErr != nil {
+			fmt.Printf("ERROR: Could not save state: %v\n", stateErr)
+		}
+	}
 	if err != nil {
 		fmt.Println("Error:")
 		fmt.Println(err)
@@ -1,13 +1,27 @@
-package main
+package gosigsrv
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // TestCommonMiddleware tests that the middleware adds the right headers
@@ -19,10 +33,10 @@ func TestCommonMiddleware(t *testing.T) {
 
 	expectedHeaders := make(map[string]string)
 	expectedHeaders["Access-Control-Allow-Origin"] = "*"
-	expectedHeaders["Access-Control-Allow-Credentials"] = "true"
+	expectedHeaders["Access-Control-Allow-Credentials"] = ""
 	expectedHeaders["Access-Control-Allow-Methods"] = strings.Join([]string{"GET", "POST", "OPTIONS"}, ",")
-	expectedHeaders["Access-Control-Allow-Headers"] = strings.Join([]string{"Content-Type", "Content-Length", "Cache-Control", "Connection"}, ",")
-	expectedHeaders["Access-Control-Expose-Headers"] = strings.Join([]string{"Content-Length", "X-Peer-Id"}, ",")
+	expectedHeaders["Access-Control-Allow-Headers"] = strings.Join([]string{"Content-Type", "Content-Length", "Content-Encoding", "Cache-Control", "Connection", "X-Client-Version"}, ",")
+	expectedHeaders["Access-Control-Expose-Headers"] = strings.Join([]string{"Content-Length", "X-Peer-Id", "X-Peers-Truncated", "X-Peers-Next-Offset", "X-Peer-Busy", "X-Replay", reconnectTokenHeader}, ",")
 	expectedHeaders["Connection"] = "close"
 	expectedHeaders["Cache-Control"] = "no-cache"
 
@@ -43,6 +57,57 @@ func TestCommonMiddleware(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 }
 
+func TestMalformedQueryRejected(t *testing.T) {
+	req, err := http.NewRequest("GET", "/message?peer_id=1&to=%zz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := commonHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Request with a malformed query should not reach the handler")
+	}))
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestQueryLimitsRejectLargeQueries(t *testing.T) {
+	handler := commonHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Request with too large a query should not reach the handler")
+	}))
+
+	for _, query := range []string{
+		"client_manyparams" + strings.Repeat("&a=b", 10000),
+		"client_" + strings.Repeat("x", 10000),
+	} {
+		req, err := http.NewRequest("GET", "/sign_in?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestNoConnectionHeaderForHTTP2(t *testing.T) {
+	req, err := http.NewRequest("GET", "/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+
+	rr := httptest.NewRecorder()
+	commonHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+	if connection := rr.Header().Get("Connection"); connection != "" {
+		t.Errorf("Connection header was set on an http/2 response: %s", connection)
+	}
+}
+
 func TestSignInOk(t *testing.T) {
 	const expectedPeerName string = "peername"
 	queryParams := make(url.Values)
@@ -69,6 +134,7 @@ func TestSignInOk(t *testing.T) {
 	if len(pragmaValues) > 0 {
 		pragma = pragmaValues[0]
 	}
+	defer signOut(t, pragma)
 
 	responseBodyString := string(rr.Body.Bytes())
 	if commaCount := strings.Count(responseBodyString, ","); commaCount != 2 {
@@ -180,11 +246,13 @@ func TestSendMessage(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer signOut(t, peerA)
 
 	peerB, err = signIn(t, peerBname)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer signOut(t, peerB)
 
 	queryParams := make(url.Values)
 	queryParams.Add("peer_id", peerA)
@@ -230,11 +298,13 @@ func TestReceieveMessage(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer signOut(t, peerA)
 
 	peerB, err = signIn(t, peerBname)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer signOut(t, peerB)
 
 	queryParams := make(url.Values)
 	queryParams.Add("peer_id", peerA)
@@ -316,3 +386,1993 @@ func TestSignInFailsWithoutPerrname(t *testing.T) {
 		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
 	}
 }
+
+func sendMessage(t *testing.T, from string, to string, message string) *httptest.ResponseRecorder {
+	queryParams := make(url.Values)
+	queryParams.Add("peer_id", from)
+	queryParams.Add("to", to)
+
+	req, err := http.NewRequest("POST", "/message?"+queryParams.Encode(), strings.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	messageHandler := http.HandlerFunc(messageHandler)
+	messageHandler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestGetMessageNotAllowed(t *testing.T) {
+	req, err := http.NewRequest("GET", "/message?peer_id=1&to=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(messageHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusMethodNotAllowed, rr.Code)
+	}
+	if allow := rr.Header().Get("Allow"); allow != "POST" {
+		t.Errorf("Expected Allow: POST, got %q", allow)
+	}
+	var hint methodHint
+	if err = json.Unmarshal(rr.Body.Bytes(), &hint); err != nil {
+		t.Fatalf("Hint is not valid json (%v): %s", err, rr.Body.String())
+	}
+	if hint.Method != "POST" || len(hint.Params) != 2 {
+		t.Errorf("Wrong hint: %s", rr.Body.String())
+	}
+}
+
+func TestWaitReturnsSenderContentType(t *testing.T) {
+	clientID, err := signIn(t, "client_contenttype")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_contenttype")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+
+	req, err := http.NewRequest("POST", "/message?peer_id="+clientID+"&to="+serverID, strings.NewReader("v=0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(messageHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	rr = waitForMessage(t, serverID)
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/sdp" {
+		t.Errorf("Wait returned the wrong content type, expected application/sdp got '%s'", contentType)
+	}
+}
+
+func TestPeersReportLastContentTypes(t *testing.T) {
+	clientID, err := signIn(t, "client_lastcontenttype")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_lastcontenttype")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+
+	req, err := http.NewRequest("POST", "/message?peer_id="+clientID+"&to="+serverID, strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(messageHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+	waitForMessage(t, serverID)
+
+	req, err = http.NewRequest("GET", "/peers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(peersHandler).ServeHTTP(rr, req)
+	var views []peerView
+	if err = json.Unmarshal(rr.Body.Bytes(), &views); err != nil {
+		t.Fatal(err)
+	}
+	for _, view := range views {
+		switch view.ID {
+		case clientID:
+			if view.LastSentContentType != "application/json" {
+				t.Errorf("Sender's last sent content type is %q", view.LastSentContentType)
+			}
+		case serverID:
+			if view.LastReceivedContentType != "application/json" {
+				t.Errorf("Recipient's last received content type is %q", view.LastReceivedContentType)
+			}
+		}
+	}
+}
+
+// failingWriter is a response writer whose writes always fail (e.g. a client that went away)
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestWaitRequeuesMessageOnWriteFailure(t *testing.T) {
+	clientID, err := signIn(t, "client_requeue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_requeue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+
+	if rr := sendMessage(t, clientID, serverID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	req, err := http.NewRequest("GET", "/wait?peer_id="+serverID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.HandlerFunc(waitHandler).ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+
+	if queued := peers[serverID].Channel.Len(); queued != 1 {
+		t.Fatalf("Expected the undelivered message to be re-queued, %d messages queued", queued)
+	}
+	if body := waitForMessage(t, serverID).Body.String(); body != "offer" {
+		t.Errorf("Wrong message delivered after re-queue: %s", body)
+	}
+}
+
+// flushFailingWriter is a response writer that buffers writes fine but can't flush them
+type flushFailingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w flushFailingWriter) FlushError() error {
+	return errors.New("connection reset")
+}
+
+func TestWaitRequeuesUnflushedMessageInOrder(t *testing.T) {
+	clientID, err := signIn(t, "client_requeueorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_requeueorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(serverID)
+
+	for _, message := range []string{"offer", "candidate"} {
+		if rr := sendMessage(t, clientID, serverID, message); rr.Code != http.StatusOK {
+			t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/wait?peer_id="+serverID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.HandlerFunc(waitHandler).ServeHTTP(flushFailingWriter{httptest.NewRecorder()}, req)
+
+	for _, expected := range []string{"offer", "candidate"} {
+		if body := waitForMessage(t, serverID).Body.String(); body != expected {
+			t.Errorf("Wrong message delivered after re-queue expected %s, got %s", expected, body)
+		}
+	}
+}
+
+func TestCancelledWaitsDoNotLeakGoroutines(t *testing.T) {
+	const waiters = 50
+
+	srv := httptest.NewServer(http.HandlerFunc(waitHandler))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	var peerIDs []string
+	for i := 0; i < waiters; i++ {
+		peerID, err := signIn(t, fmt.Sprintf("client_leak%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer signOut(t, peerID)
+		discardMessages(peerID)
+		peerIDs = append(peerIDs, peerID)
+	}
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, waiters)
+	for _, peerID := range peerIDs {
+		req, err := http.NewRequest("GET", srv.URL+"/wait?peer_id="+peerID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(req *http.Request) {
+			if res, err := client.Do(req.WithContext(ctx)); err == nil {
+				res.Body.Close()
+			}
+			done <- struct{}{}
+		}(req)
+	}
+
+	// Only cancel once every peer is actually waiting
+	deadline := time.Now().Add(5 * time.Second)
+	for _, peerID := range peerIDs {
+		for !peerWaiting(peerID) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cancel()
+	for i := 0; i < waiters; i++ {
+		<-done
+	}
+
+	// Give the server side a moment to notice the closed connections
+	var goroutines int
+	for deadline = time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if goroutines = runtime.NumGoroutine(); goroutines <= baseline {
+			break
+		}
+	}
+	if goroutines > baseline {
+		t.Errorf("%d goroutines still running after cancelling waits, expected at most %d", goroutines, baseline)
+	}
+	for _, peerID := range peerIDs {
+		if peerWaiting(peerID) {
+			t.Errorf("Peer %s is still marked waiting after its wait was cancelled", peerID)
+		}
+	}
+}
+
+func TestHighPriorityMessageDeliveredFirst(t *testing.T) {
+	clientID, err := signIn(t, "client_priority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_priority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(clientID)
+
+	if rr := sendMessage(t, serverID, clientID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	notifyPeer(peers[clientID], "presence")
+
+	if body := waitForMessage(t, clientID).Body.String(); body != "presence" {
+		t.Errorf("Expected the high priority message first, got %s", body)
+	}
+	if body := waitForMessage(t, clientID).Body.String(); body != "offer" {
+		t.Errorf("Expected the normal priority message second, got %s", body)
+	}
+}
+
+func TestStalePresenceSkipped(t *testing.T) {
+	defer func(previous time.Duration) { presenceMaxAge = previous }(presenceMaxAge)
+	presenceMaxAge = 20 * time.Millisecond
+
+	clientID, err := signIn(t, "client_stalepresence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_stalepresence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(clientID)
+
+	notifyPeerInfo(peers[clientID], peers[serverID], "stale,1,1\n")
+	time.Sleep(2 * presenceMaxAge)
+	if rr := sendMessage(t, serverID, clientID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	notifyPeerInfo(peers[clientID], peers[serverID], "fresh,1,1\n")
+
+	if body := waitForMessage(t, clientID).Body.String(); body != "fresh,1,1\n" {
+		t.Errorf("Expected the stale peer info to be skipped for the fresh one, got %s", body)
+	}
+	if body := waitForMessage(t, clientID).Body.String(); body != "offer" {
+		t.Errorf("Relayed messages should never be dropped as stale, got %s", body)
+	}
+	if pending := pendingMessages(peers[clientID]); pending != 0 {
+		t.Errorf("Expected no more queued messages, got %d", pending)
+	}
+}
+
+func TestStalledMessageBodyTimesOut(t *testing.T) {
+	defer func(previous time.Duration) { messageReadTimeout = previous }(messageReadTimeout)
+	messageReadTimeout = 50 * time.Millisecond
+
+	clientID, err := signIn(t, "client_stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+
+	srv := httptest.NewServer(http.HandlerFunc(messageHandler))
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Promise a body and then stall after the first few bytes of it
+	fmt.Fprintf(conn, "POST /message?peer_id=%s&to=%s HTTP/1.1\r\nHost: test\r\nContent-Length: 100\r\n\r\noffer", clientID, serverID)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusRequestTimeout, res.StatusCode)
+	}
+}
+
+func TestSendMessageFailsWhenInFlightLimitReached(t *testing.T) {
+	peerA, err := signIn(t, "client_inflightA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_inflightB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+
+	// Leave room for exactly one more message across the whole server
+	defer func(previous int64) { maxInFlightMessages = previous }(maxInFlightMessages)
+	maxInFlightMessages = atomic.LoadInt64(&inFlightMessages) + 1
+
+	if status := sendMessage(t, peerA, peerB, "first").Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	if status := sendMessage(t, peerA, peerB, "second").Code; status != http.StatusServiceUnavailable {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusServiceUnavailable, status)
+	}
+}
+
+func TestInFlightLimitDoesNotPair(t *testing.T) {
+	clientID, err := signIn(t, "client_inflight_nopair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_inflight_nopair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	otherID, err := signIn(t, "client_inflight_other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, otherID)
+
+	// Fill the server up with a message between other peers
+	if status := sendMessage(t, otherID, serverID, "offer").Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+	defer func(previous int64) { maxInFlightMessages = previous }(maxInFlightMessages)
+	maxInFlightMessages = atomic.LoadInt64(&inFlightMessages)
+
+	if status := sendMessage(t, clientID, serverID, "offer").Code; status != http.StatusServiceUnavailable {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusServiceUnavailable, status)
+	}
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if len(peers[clientID].ConnectedWith) != 0 || peers[serverID].ConnectedWith.Has(clientID) {
+		t.Errorf("Rejected message paired the peers: %s and %s", peers[clientID], peers[serverID])
+	}
+}
+
+// waitForMessage runs a wait request for the peer and returns the response
+func waitForMessage(t *testing.T, peerID string) *httptest.ResponseRecorder {
+	queryParams := make(url.Values)
+	queryParams.Add("peer_id", peerID)
+
+	req, err := http.NewRequest("GET", "/wait?"+queryParams.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	waitHandler := http.HandlerFunc(waitHandler)
+	waitHandler.ServeHTTP(rr, req)
+	return rr
+}
+
+// discardMessages empties a peer's channel (e.g. of sign in notifications)
+func discardMessages(peerID string) {
+	for {
+		select {
+		case <-peers[peerID].PriorityChannel.Receive():
+			messagesDequeued(1)
+		case <-peers[peerID].Channel.Receive():
+			messagesDequeued(1)
+		default:
+			return
+		}
+	}
+}
+
+// queuedMessages takes every message queued for a peer off its channels
+func queuedMessages(peer *peerInfo) []string {
+	var messages []string
+	for {
+		select {
+		case msg := <-peer.PriorityChannel.Receive():
+			messages = append(messages, msg.Message)
+		case msg := <-peer.Channel.Receive():
+			messages = append(messages, msg.Message)
+		default:
+			return messages
+		}
+		messagesDequeued(1)
+	}
+}
+
+func peerWaiting(peerID string) bool {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	peer, exists := peers[peerID]
+	return exists && peer != nil && peer.Waiting
+}
+
+func TestRenameNotifiesOppositePeers(t *testing.T) {
+	const newName string = "renderingserver_renamed"
+	serverID, err := signIn(t, "renderingserver_rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	clientID, err := signIn(t, "client_rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	// Drop the notification the server got about the client signing in
+	discardMessages(serverID)
+
+	queryParams := make(url.Values)
+	queryParams.Add("peer_id", serverID)
+	queryParams.Add("name", newName)
+
+	req, err := http.NewRequest("GET", "/rename?"+queryParams.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	renameHandler := http.HandlerFunc(renameHandler)
+	renameHandler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+	peerMutex.Lock()
+	pending := pendingMessages(peers[clientID])
+	peerMutex.Unlock()
+	if pending != 1 {
+		t.Fatalf("Rename notification should be sent right away, %d messages pending", pending)
+	}
+
+	rr = waitForMessage(t, clientID)
+	expectedMessage := newName + "," + serverID + ",1\n"
+	if message := rr.Body.String(); message != expectedMessage {
+		t.Errorf("Rename notification was (%s) expected (%s)", message, expectedMessage)
+	}
+}
+
+func TestRenameFailsWithInvalidName(t *testing.T) {
+	peerID, err := signIn(t, "client_badrename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+
+	queryParams := make(url.Values)
+	queryParams.Add("peer_id", peerID)
+	queryParams.Add("name", "bad,name")
+
+	req, err := http.NewRequest("GET", "/rename?"+queryParams.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	renameHandler := http.HandlerFunc(renameHandler)
+	renameHandler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusBadRequest, status)
+	}
+}
+
+func TestLenientRoutesReachSignIn(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/sign_in", http.HandlerFunc(signinHandler))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	router := routeNormalizingMiddleware(mux)
+
+	for _, path := range []string{"/sign_in/", "/Sign_In", "/SIGN_IN/"} {
+		req, err := http.NewRequest("GET", path+"?client_lenient", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("Recieved wrong status code for %s expected %v, got %v", path, http.StatusOK, status)
+		}
+		if rr.Header().Get("Pragma") == "" {
+			t.Errorf("Request to %s was not handled by sign in", path)
+		}
+		signOut(t, rr.Header().Get("Pragma"))
+	}
+}
+
+func TestStrictRoutesDoNotNormalize(t *testing.T) {
+	defer func(previous bool) { strictRoutes = previous }(strictRoutes)
+	strictRoutes = true
+
+	mux := http.NewServeMux()
+	mux.Handle("/sign_in", http.HandlerFunc(signinHandler))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	router := routeNormalizingMiddleware(mux)
+
+	req, err := http.NewRequest("GET", "/Sign_In?client_strict", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusNotFound, status)
+	}
+}
+
+func signOut(t *testing.T, peerID string) *httptest.ResponseRecorder {
+	queryParams := make(url.Values)
+	queryParams.Add("peer_id", peerID)
+
+	req, err := http.NewRequest("GET", "/sign_out?"+queryParams.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	signoutHandler := http.HandlerFunc(signoutHandler)
+	signoutHandler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestSignOutNotifiesSendersOfUndeliveredMessages(t *testing.T) {
+	defer func(previous bool) { notifyUndelivered = previous }(notifyUndelivered)
+	notifyUndelivered = true
+
+	peerA, err := signIn(t, "client_undeliveredA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_undeliveredB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+
+	if status := sendMessage(t, peerA, peerB, "offer").Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+	discardMessages(peerA)
+	if status := signOut(t, peerB).Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	rr := waitForMessage(t, peerA)
+	var notice map[string]string
+	if err = json.Unmarshal(rr.Body.Bytes(), &notice); err != nil {
+		t.Fatalf("Notice is not valid json (%v): %s", err, rr.Body.String())
+	}
+	if notice["type"] != deliveryFailedNotice || notice["to"] != peerB {
+		t.Errorf("Wrong notice recieved: %s", rr.Body.String())
+	}
+	if pragma := rr.Header().Get("Pragma"); pragma != peerA {
+		t.Errorf("Notice Pragma (%s) should be the recipient's id (%s)", pragma, peerA)
+	}
+}
+
+func TestOversizedHeadersRejected(t *testing.T) {
+	defer func(previous int) { maxHeaderBytes = previous }(maxHeaderBytes)
+	maxHeaderBytes = 1024
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newHTTPServer(context.Background(), "", http.HandlerFunc(signinHandler))
+	ts.Start()
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/sign_in?client_bigheaders", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server allows some slack past MaxHeaderBytes so go well beyond it
+	req.Header.Set("X-Padding", strings.Repeat("a", 16*1024))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	}
+}
+
+func TestCompactionRemovesUnreachablePeers(t *testing.T) {
+	reachableID, err := signIn(t, "client_reachable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, reachableID)
+	unreachableID, err := signIn(t, "client_unreachable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, unreachableID)
+
+	peers[unreachableID].FailedSends = maxFailedSends
+
+	if removed := compactUnreachablePeers(); removed != 1 {
+		t.Errorf("Expected 1 peer to be removed, got %d", removed)
+	}
+	if _, exists := peers[unreachableID]; exists {
+		t.Errorf("Unreachable peer was not removed")
+	}
+	if _, exists := peers[reachableID]; !exists {
+		t.Errorf("Reachable peer was removed")
+	}
+}
+
+func TestFailedSendsResetByWait(t *testing.T) {
+	peerA, err := signIn(t, "client_failedsendsA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_failedsendsB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+
+	peers[peerB].FailedSends = 3
+	sendMessage(t, peerA, peerB, "offer")
+	waitForMessage(t, peerB)
+
+	if failedSends := peers[peerB].FailedSends; failedSends != 0 {
+		t.Errorf("Failed sends was not reset by wait, got %d", failedSends)
+	}
+}
+
+func TestListSortedByRecentContact(t *testing.T) {
+	var serverIDs []string
+	for _, name := range []string{"renderingserver_sortA", "renderingserver_sortB", "renderingserver_sortC"} {
+		serverID, err := signIn(t, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer signOut(t, serverID)
+		serverIDs = append(serverIDs, serverID)
+	}
+	clientID, err := signIn(t, "client_sorter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+
+	// Isolate the listing from other tests' peers
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	listedPeers := make(map[string]*peerInfo)
+	now := time.Now().UTC()
+	for i, serverID := range serverIDs {
+		listedPeers[serverID] = peers[serverID]
+		// Make the last signed in server the least recently active
+		listedPeers[serverID].LastContact = now.Add(time.Duration(i) * -time.Minute)
+	}
+	listedPeers[serverIDs[1]].LastContact = now.Add(time.Minute)
+	listedPeers[clientID] = peers[clientID]
+	peers = listedPeers
+
+	queryParams := make(url.Values)
+	queryParams.Add("peer_id", clientID)
+	queryParams.Add("sort", "recent")
+
+	req, err := http.NewRequest("GET", "/list?"+queryParams.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	listHandler := http.HandlerFunc(listHandler)
+	listHandler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	var listedIDs []string
+	for _, line := range strings.Split(strings.TrimSpace(rr.Body.String()), "\n") {
+		listedIDs = append(listedIDs, strings.Split(line, ",")[1])
+	}
+	expectedIDs := []string{serverIDs[1], serverIDs[0], serverIDs[2]}
+	if strings.Join(listedIDs, " ") != strings.Join(expectedIDs, " ") {
+		t.Errorf("Peers listed in wrong order expected %v, got %v", expectedIDs, listedIDs)
+	}
+}
+
+func TestFifoPairingOffersLongestWaitingFirst(t *testing.T) {
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+	defer func(previous bool) { fifoPairing = previous }(fifoPairing)
+	fifoPairing = true
+
+	var clientIDs []string
+	for _, name := range []string{"client_fifoC", "client_fifoA", "client_fifoB"} {
+		clientID, err := signIn(t, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientIDs = append(clientIDs, clientID)
+	}
+
+	req, err := http.NewRequest("GET", "/sign_in?renderingserver_fifo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected the server and 3 clients, got: %s", rr.Body.String())
+	}
+	for i, clientID := range clientIDs {
+		if fields := strings.Split(lines[i+1], ","); fields[1] != clientID {
+			t.Errorf("Expected client %s at position %d, got %s", clientID, i, lines[i+1])
+		}
+	}
+}
+
+func TestPeerPairedMidSignInNotNotified(t *testing.T) {
+	clientID, err := signIn(t, "client_midsignin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	otherClientID, err := signIn(t, "client_midsigninOther")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, otherClientID)
+	serverID, err := signIn(t, "renderingserver_midsignin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(clientID)
+	discardMessages(otherClientID)
+
+	// A new server signs in while both clients are available, but one of them gets paired before it is notified
+	newServer := &peerInfo{Name: "renderingserver_midsigninNew", ID: "midsignin", Kind: server}
+	available := availablePeers(newServer)
+	peers[clientID].Connect(serverID)
+	peers[serverID].Connect(clientID)
+
+	notifyAvailablePeers(available, newServer, newServer.InfoString())
+	if pending := pendingMessages(peers[clientID]); pending != 0 {
+		t.Errorf("Peer paired during sign in was notified of the new peer")
+	}
+	if pending := pendingMessages(peers[otherClientID]); pending != 1 {
+		t.Errorf("Available peer was not notified of the new peer")
+	}
+}
+
+func TestSignInFailsWithInvalidSort(t *testing.T) {
+	req, err := http.NewRequest("GET", "/sign_in?client_badsort&sort=sideways", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	signInHandler := http.HandlerFunc(signinHandler)
+	signInHandler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusBadRequest, status)
+	}
+}
+
+func TestShutdownNotifiesWaitingPeers(t *testing.T) {
+	defer func(previous time.Duration) { shutdownReconnectHint = previous }(shutdownReconnectHint)
+	shutdownReconnectHint = 30 * time.Second
+
+	peerID, err := signIn(t, "client_shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+	discardMessages(peerID)
+
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newHTTPServer(requestCtx, "", http.HandlerFunc(waitHandler))
+	ts.Start()
+	defer ts.Close()
+
+	type waitResult struct {
+		body string
+		err  error
+	}
+	waitDone := make(chan waitResult, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/wait?peer_id=" + peerID)
+		if err != nil {
+			waitDone <- waitResult{"", err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		waitDone <- waitResult{string(body), err}
+	}()
+
+	// Wait for the peer to start waiting
+	for !peerWaiting(peerID) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err = shutdownServer(ts.Config, cancelRequests); err != nil {
+		t.Errorf("Error shutting down %v", err)
+	}
+
+	result := <-waitDone
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	var notice map[string]string
+	if err = json.Unmarshal([]byte(result.body), &notice); err != nil {
+		t.Fatalf("Notice is not valid json (%v): %s", err, result.body)
+	}
+	if notice["type"] != goingAwayNotice || notice["reconnect_in"] != "30" {
+		t.Errorf("Wrong notice recieved: %s", result.body)
+	}
+}
+
+func TestMessageFromDifferentNetworkWarns(t *testing.T) {
+	peerA, err := signIn(t, "client_spoofedA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_spoofedB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+
+	send := func(remoteAddr string) {
+		req, err := http.NewRequest("POST", "/message?peer_id="+peerA+"&to="+peerB, strings.NewReader("offer"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+
+		rr := httptest.NewRecorder()
+		messageHandler := http.HandlerFunc(messageHandler)
+		messageHandler.ServeHTTP(rr, req)
+	}
+
+	warnings := atomic.LoadInt64(&remoteIPChangeWarnings)
+	send("10.1.2.3:4000")
+	send("10.1.200.4:4001")
+	if atomic.LoadInt64(&remoteIPChangeWarnings) != warnings {
+		t.Errorf("Messages from the same network were warned about")
+	}
+
+	send("192.168.7.7:4002")
+	if atomic.LoadInt64(&remoteIPChangeWarnings) != warnings+1 {
+		t.Errorf("Message from a different network was not warned about")
+	}
+}
+
+func TestSignInResponseTruncated(t *testing.T) {
+	defer func(previous int) { maxListedPeers = previous }(maxListedPeers)
+	maxListedPeers = 2
+
+	// Isolate the listing from other tests' peers
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+
+	for _, name := range []string{"renderingserver_capA", "renderingserver_capB", "renderingserver_capC"} {
+		if _, err := signIn(t, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/sign_in?client_capped", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	signInHandler := http.HandlerFunc(signinHandler)
+	signInHandler.ServeHTTP(rr, req)
+
+	// Own peer info and the first page of servers
+	if lines := strings.Count(rr.Body.String(), "\n"); lines != 1+maxListedPeers {
+		t.Errorf("Expected %d peer lines, got %d: %s", 1+maxListedPeers, lines, rr.Body.String())
+	}
+	if truncated := rr.Header().Get("X-Peers-Truncated"); truncated != "true" {
+		t.Errorf("Truncated header was (%s) expected true", truncated)
+	}
+	nextOffset := rr.Header().Get("X-Peers-Next-Offset")
+	if nextOffset != "2" {
+		t.Fatalf("Next offset header was (%s) expected 2", nextOffset)
+	}
+
+	req, err = http.NewRequest("GET", "/list?peer_id="+rr.Header().Get("Pragma")+"&offset="+nextOffset, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	listHandler := http.HandlerFunc(listHandler)
+	listHandler.ServeHTTP(rr, req)
+
+	if lines := strings.Count(rr.Body.String(), "\n"); lines != 1 {
+		t.Errorf("Expected 1 peer line on the last page, got %d: %s", lines, rr.Body.String())
+	}
+	if truncated := rr.Header().Get("X-Peers-Truncated"); truncated != "" {
+		t.Errorf("Last page should not be truncated")
+	}
+}
+
+func TestMeshDiscoveryIncludesSameKind(t *testing.T) {
+	defer func(previous string) { discoveryMode = previous }(discoveryMode)
+	discoveryMode = discoverAllPeers
+
+	peerA, err := signIn(t, "client_meshA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	discardMessages(peerA)
+
+	req, err := http.NewRequest("GET", "/sign_in?client_meshB", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	signInHandler := http.HandlerFunc(signinHandler)
+	signInHandler.ServeHTTP(rr, req)
+	defer signOut(t, rr.Header().Get("Pragma"))
+
+	if !strings.Contains(rr.Body.String(), "client_meshA,"+peerA+",1\n") {
+		t.Errorf("Same kind peer was not listed in mesh mode: %s", rr.Body.String())
+	}
+
+	rr = waitForMessage(t, peerA)
+	if !strings.HasPrefix(rr.Body.String(), "client_meshB,") {
+		t.Errorf("Same kind peer was not notified in mesh mode: %s", rr.Body.String())
+	}
+}
+
+func TestSignInWithExplicitKind(t *testing.T) {
+	req, err := http.NewRequest("GET", "/sign_in?renderingserver_relay&kind=relay", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	signInHandler := http.HandlerFunc(signinHandler)
+	signInHandler.ServeHTTP(rr, req)
+
+	defer signOut(t, rr.Header().Get("Pragma"))
+	peer := peers[rr.Header().Get("Pragma")]
+	if peer == nil || peer.Kind != peerKind("relay") {
+		t.Errorf("Peer did not get the requested kind: %v", peer)
+	}
+
+	req, err = http.NewRequest("GET", "/sign_in?client_badkind&kind=bad,kind", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	signInHandler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusBadRequest, status)
+	}
+}
+
+func TestSignInRoomValidated(t *testing.T) {
+	signInHandler := http.HandlerFunc(signinHandler)
+
+	req, err := http.NewRequest("GET", "/sign_in?client_badroom&room="+url.QueryEscape("bad room\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	signInHandler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusBadRequest, status)
+	}
+
+	defer func(previous bool) { lowercaseRooms = previous }(lowercaseRooms)
+	lowercaseRooms = true
+	req, err = http.NewRequest("GET", "/sign_in?client_goodroom&room="+url.QueryEscape(" Lobby-1 "), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	signInHandler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+	peerID := rr.Header().Get("Pragma")
+	defer signOut(t, peerID)
+	if room := peers[peerID].Room; room != "lobby-1" {
+		t.Errorf("Room was not normalized, got '%s'", room)
+	}
+}
+
+func TestSignInRoomRequired(t *testing.T) {
+	defer func(previous bool) { requireRoom = previous }(requireRoom)
+	requireRoom = true
+
+	req, err := http.NewRequest("GET", "/sign_in?client_noroom", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusBadRequest, rr.Code)
+	}
+
+	req, err = http.NewRequest("GET", "/sign_in?client_withroom&room=lobby", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	defer signOut(t, rr.Header().Get("Pragma"))
+}
+
+// checkSignInLimit signs in with three different values (names, rooms, ...) with a limit of 2 on them
+//
+//   The third value is refused until the peers with the first one sign out
+func checkSignInLimit(t *testing.T, limit *int, signInWith func(value string) *httptest.ResponseRecorder, values [3]string) {
+	defer func(previous int) { *limit = previous }(*limit)
+	*limit = 2
+
+	first := signInWith(values[0])
+	second := signInWith(values[1])
+	if first.Code != http.StatusOK || second.Code != http.StatusOK {
+		t.Fatalf("Expected the first two to sign in, got %v and %v", first.Code, second.Code)
+	}
+	defer signOut(t, second.Header().Get("Pragma"))
+
+	if rr := signInWith(values[2]); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusTooManyRequests, rr.Code)
+	}
+	same := signInWith(values[0])
+	if same.Code != http.StatusOK {
+		t.Errorf("Expected an already signed in value to sign in again, got %v", same.Code)
+	}
+
+	signOut(t, first.Header().Get("Pragma"))
+	signOut(t, same.Header().Get("Pragma"))
+	third := signInWith(values[2])
+	if third.Code != http.StatusOK {
+		t.Errorf("Expected a sign in after another signed out, got %v", third.Code)
+	}
+	defer signOut(t, third.Header().Get("Pragma"))
+}
+
+func TestSignInLimitsNamesPerIP(t *testing.T) {
+	checkSignInLimit(t, &maxNamesPerIP, func(name string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/sign_in?"+name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "203.0.113.7:5000"
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+		return rr
+	}, [3]string{"client_ipnameA", "client_ipnameB", "client_ipnameC"})
+}
+
+func TestSignInRejectedWhenTooManyInFlight(t *testing.T) {
+	defer func(previous int64) { maxConcurrentSignIns = previous }(maxConcurrentSignIns)
+	maxConcurrentSignIns = 1
+
+	// Hold the only slot as if another sign in was in progress
+	if !acquireSignInSlot() {
+		t.Fatal("Expected a free sign in slot")
+	}
+	req, err := http.NewRequest("GET", "/sign_in?client_herd", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusServiceUnavailable, rr.Code)
+	}
+	releaseSignInSlot()
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected a sign in once the slot was released, got %v", rr.Code)
+	}
+	defer signOut(t, rr.Header().Get("Pragma"))
+	if inFlight := atomic.LoadInt64(&signInsInFlight); inFlight != 0 {
+		t.Errorf("Expected no sign ins in flight, got %d", inFlight)
+	}
+}
+
+func TestSignInLimitsRoomsPerName(t *testing.T) {
+	checkSignInLimit(t, &maxRoomsPerName, func(room string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/sign_in?client_squatter&room="+room, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+		return rr
+	}, [3]string{"lobby1", "lobby2", "lobby3"})
+}
+
+func TestWhoamiReportsKind(t *testing.T) {
+	peerID, err := signIn(t, "renderingserver_whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+	peers[peerID].LastContact = time.Time{}
+
+	req, err := http.NewRequest("GET", "/whoami?peer_id="+peerID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	whoamiHandler := http.HandlerFunc(whoamiHandler)
+	whoamiHandler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	var view peerView
+	if err = json.Unmarshal(rr.Body.Bytes(), &view); err != nil {
+		t.Fatalf("Response is not valid json (%v): %s", err, rr.Body.String())
+	}
+	if view.ID != peerID || view.Name != "renderingserver_whoami" || view.Kind != server {
+		t.Errorf("Wrong peer info returned: %s", rr.Body.String())
+	}
+	if peers[peerID].LastContact.IsZero() {
+		t.Errorf("Last contact was not refreshed")
+	}
+}
+
+// Run with -race to check message and sign out don't race on the recipient
+func TestConcurrentMessageAndSignOut(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		peerA, err := signIn(t, "client_concurrentA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerB, err := signIn(t, "renderingserver_concurrentB")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		messageStatus := make(chan int)
+		go func() {
+			messageStatus <- sendMessage(t, peerA, peerB, "offer").Code
+		}()
+		signOut(t, peerB)
+
+		// Depending on timing the message is delivered (and then discarded by
+		// the sign out) or the recipient is already unknown or gone
+		switch status := <-messageStatus; status {
+		case http.StatusOK, http.StatusBadRequest, http.StatusGone:
+		default:
+			t.Errorf("Recieved wrong status code %v", status)
+		}
+		signOut(t, peerA)
+	}
+}
+
+func TestMessageToPeerThatSignedOutWhileReading(t *testing.T) {
+	peerA, err := signIn(t, "client_goneA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_goneB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+
+	// Sign the recipient out once the message body starts being read
+	body := &signOutOnReadBody{t: t, peerID: peerB}
+	req, err := http.NewRequest("POST", "/message?peer_id="+peerA+"&to="+peerB, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	messageHandler := http.HandlerFunc(messageHandler)
+	messageHandler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusGone {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusGone, status)
+	}
+}
+
+// signOutOnReadBody is a request body that signs a peer out when it's first read
+type signOutOnReadBody struct {
+	t         *testing.T
+	peerID    string
+	signedOut bool
+}
+
+func (b *signOutOnReadBody) Read(p []byte) (int, error) {
+	if !b.signedOut {
+		b.signedOut = true
+		signOut(b.t, b.peerID)
+	}
+	return 0, io.EOF
+}
+
+func TestConcurrentSignInsAndSignOuts(t *testing.T) {
+	const peerCount = 50
+
+	done := make(chan struct{})
+	cleanupDone := make(chan struct{})
+	go func() {
+		defer close(cleanupDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				runCleanup()
+				printStats()
+				req, err := http.NewRequest("GET", "/peers", nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				peersHandler(httptest.NewRecorder(), req)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	peerIDs := make(chan string, peerCount)
+	for i := 0; i < peerCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("client_concurrent%d", i)
+			if i%2 == 0 {
+				name = fmt.Sprintf("renderingserver_concurrent%d", i)
+			}
+			peerID, err := signIn(t, name)
+			if err != nil || peerID == "" {
+				t.Errorf("Sign in of %s failed: %v", name, err)
+				return
+			}
+			peerIDs <- peerID
+
+			req, err := http.NewRequest("GET", "/list?peer_id="+peerID, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			listHandler(httptest.NewRecorder(), req)
+			if rr := signOut(t, peerID); rr.Code != http.StatusOK {
+				t.Errorf("Sign out of %s failed with %d", name, rr.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	<-cleanupDone
+	close(peerIDs)
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	for peerID := range peerIDs {
+		if _, exists := peers[peerID]; exists {
+			t.Errorf("Peer %s is still signed in", peerID)
+		}
+	}
+}
+
+func TestStalePeersRemoved(t *testing.T) {
+	peerID, err := signIn(t, "client_stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers[peerID].LastContact = time.Now().UTC().Add(-2 * staleTimeout)
+
+	removeStalePeers()
+
+	if _, exists := peers[peerID]; exists {
+		t.Errorf("Stale peer was not removed")
+	}
+}
+
+func TestClientStaleTimeoutShorterThanServer(t *testing.T) {
+	defer func(previous time.Duration) { clientStaleTimeout = previous }(clientStaleTimeout)
+	clientStaleTimeout = time.Minute
+	defer func(previous time.Duration) { serverStaleTimeout = previous }(serverStaleTimeout)
+	serverStaleTimeout = time.Hour
+
+	clientID, err := signIn(t, "client_kindstale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverID, err := signIn(t, "renderingserver_kindstale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+
+	idleSince := time.Now().UTC().Add(-10 * time.Minute)
+	peerMutex.Lock()
+	peers[clientID].LastContact = idleSince
+	peers[serverID].LastContact = idleSince
+	peerMutex.Unlock()
+
+	removeStalePeers()
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if _, exists := peers[clientID]; exists {
+		t.Errorf("Client idle for longer than the client stale timeout was not removed")
+	}
+	if _, exists := peers[serverID]; !exists {
+		t.Errorf("Server idle for as long was removed before the server stale timeout")
+	}
+}
+
+func TestStalePeersKeptWhenCleanupDisabled(t *testing.T) {
+	defer func(previous time.Duration) { staleTimeout = previous }(staleTimeout)
+	staleTimeout = 0
+
+	peerID, err := signIn(t, "client_idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+	peers[peerID].LastContact = time.Now().UTC().Add(-24 * time.Hour)
+
+	if removed := removeStalePeers(); removed != 0 {
+		t.Errorf("Expected no peers to be removed, got %d", removed)
+	}
+	if _, exists := peers[peerID]; !exists {
+		t.Errorf("Idle peer was removed with cleanup disabled")
+	}
+}
+
+type panickingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w panickingWriter) WriteHeader(status int) {
+	panic("write failed")
+}
+
+func TestPanickingWaitClearsWaiting(t *testing.T) {
+	clientID, err := signIn(t, "client_panicwait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_panicwait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := sendMessage(t, clientID, serverID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	req, err := http.NewRequest("GET", "/wait?peer_id="+serverID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Wait did not panic")
+			}
+		}()
+		waitHandler(panickingWriter{httptest.NewRecorder()}, req)
+	}()
+
+	if peerWaiting(serverID) {
+		t.Fatalf("Peer was left waiting after its wait panicked")
+	}
+	peerMutex.Lock()
+	peers[serverID].LastContact = time.Now().UTC().Add(-2 * staleTimeout)
+	peerMutex.Unlock()
+	removeStalePeers()
+	peerMutex.Lock()
+	_, exists := peers[serverID]
+	peerMutex.Unlock()
+	if exists {
+		t.Errorf("Peer whose wait panicked could not be reaped")
+	}
+}
+
+func TestServerFirstIsNotifiedOfClient(t *testing.T) {
+	// Isolate from other tests' peers so the server is the only peer
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+
+	req, err := http.NewRequest("GET", "/sign_in?renderingserver_first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	signInHandler := http.HandlerFunc(signinHandler)
+	signInHandler.ServeHTTP(rr, req)
+
+	serverID := rr.Header().Get("Pragma")
+	if expected := "renderingserver_first," + serverID + ",1\n"; rr.Body.String() != expected {
+		t.Errorf("First server should only get its own info, got %s", rr.Body.String())
+	}
+
+	waitDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		waitDone <- waitForMessage(t, serverID)
+	}()
+
+	clientID, err := signIn(t, "client_second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case rr = <-waitDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server was not notified of the client signing in")
+	}
+
+	if expected := "client_second," + clientID + ",1\n"; rr.Body.String() != expected {
+		t.Errorf("Server recieved (%s) expected the client's info (%s)", rr.Body.String(), expected)
+	}
+	if pragma := rr.Header().Get("Pragma"); pragma != serverID {
+		t.Errorf("Notification Pragma (%s) should be the server's own id (%s)", pragma, serverID)
+	}
+}
+
+func TestInfoStringReportsAvailability(t *testing.T) {
+	peer := peerInfo{Name: "client_busy", ID: "42", ConnectedWith: partnerSet{"43": true}}
+	if info := peer.InfoString(); info != "client_busy,42,1\n" {
+		t.Errorf("Peer info should default to available, got %s", info)
+	}
+
+	defer func(previous bool) { reportAvailability = previous }(reportAvailability)
+	reportAvailability = true
+
+	if info := peer.InfoString(); info != "client_busy,42,0\n" {
+		t.Errorf("Connected peer should be reported busy, got %s", info)
+	}
+	peer.Disconnect("43")
+	if info := peer.InfoString(); info != "client_busy,42,1\n" {
+		t.Errorf("Unconnected peer should be reported available, got %s", info)
+	}
+}
+
+// captureOutput returns what was printed to stdout while running f
+func captureOutput(t *testing.T, f func()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := make(chan string)
+	go func() {
+		captured, _ := ioutil.ReadAll(reader)
+		output <- string(captured)
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	writer.Close()
+	return <-output
+}
+
+func TestOutOfRoomWarningsRateLimited(t *testing.T) {
+	peerA, err := signIn(t, "client_outofroomA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_outofroomB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+	peerC, err := signIn(t, "renderingserver_outofroomC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerC)
+	// Connect A with B
+	sendMessage(t, peerA, peerB, "offer")
+
+	const sends int = 10
+	messages := atomic.LoadInt64(&outOfRoomMessages)
+	output := captureOutput(t, func() {
+		for i := 0; i < sends; i++ {
+			sendMessage(t, peerA, peerC, "offer")
+		}
+	})
+
+	if warnings := strings.Count(output, "event=out_of_room"); warnings != 1 {
+		t.Errorf("Expected 1 out of room warning, got %d:\n%s", warnings, output)
+	}
+	if counted := atomic.LoadInt64(&outOfRoomMessages) - messages; counted != int64(sends) {
+		t.Errorf("Expected %d out of room messages counted, got %d", sends, counted)
+	}
+}
+
+func TestActivePeerRemovedAfterLifetime(t *testing.T) {
+	defer func(previous time.Duration) { maxPeerLifetime = previous }(maxPeerLifetime)
+	maxPeerLifetime = time.Hour
+
+	peerA, err := signIn(t, "client_lifetimeA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_lifetimeB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+	sendMessage(t, peerA, peerB, "offer")
+	discardMessages(peerA)
+
+	if removed := removeExpiredPeers(); removed != 0 {
+		t.Fatalf("Expected no peers to be removed, got %d", removed)
+	}
+
+	// Signed in long ago but still active
+	peers[peerB].SignedInAt = time.Now().UTC().Add(-2 * maxPeerLifetime)
+	peers[peerB].LastContact = time.Now().UTC()
+
+	if removed := removeExpiredPeers(); removed != 1 {
+		t.Errorf("Expected 1 peer to be removed, got %d", removed)
+	}
+	if _, exists := peers[peerB]; exists {
+		t.Errorf("Expired peer was not removed")
+	}
+
+	rr := waitForMessage(t, peerA)
+	var notice map[string]string
+	if err = json.Unmarshal(rr.Body.Bytes(), &notice); err != nil {
+		t.Fatalf("Notice is not valid json (%v): %s", err, rr.Body.String())
+	}
+	if notice["type"] != peerLeftNotice || notice["peer_id"] != peerB {
+		t.Errorf("Wrong notice recieved: %s", rr.Body.String())
+	}
+}
+
+func TestMessageBufferSizePerKind(t *testing.T) {
+	defer func(previousServer int, previousClient int) {
+		serverMessageBufferSize = previousServer
+		clientMessageBufferSize = previousClient
+	}(serverMessageBufferSize, clientMessageBufferSize)
+	serverMessageBufferSize = 250
+	clientMessageBufferSize = 25
+
+	serverID, err := signIn(t, "renderingserver_bigbuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	clientID, err := signIn(t, "client_smallbuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+
+	if size := peers[serverID].Channel.Cap(); size != serverMessageBufferSize {
+		t.Errorf("Server buffer size is %d expected %d", size, serverMessageBufferSize)
+	}
+	if size := peers[clientID].Channel.Cap(); size != clientMessageBufferSize {
+		t.Errorf("Client buffer size is %d expected %d", size, clientMessageBufferSize)
+	}
+}
+
+func sendGzippedMessage(t *testing.T, from string, to string, message string) *httptest.ResponseRecorder {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/message?peer_id="+from+"&to="+to, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+
+	rr := httptest.NewRecorder()
+	messageHandler := http.HandlerFunc(messageHandler)
+	messageHandler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestGzippedMessageDecompressed(t *testing.T) {
+	const expectedMessageContent = "{\"sdp\": \"v=0\"}"
+	peerA, err := signIn(t, "client_gzipA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_gzipB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+	discardMessages(peerB)
+
+	if status := sendGzippedMessage(t, peerA, peerB, expectedMessageContent).Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	rr := waitForMessage(t, peerB)
+	if message := rr.Body.String(); message != expectedMessageContent {
+		t.Errorf("Message recieved (%s) is different than what was sent (%s)", message, expectedMessageContent)
+	}
+}
+
+func TestGzippedMessageRejectedWhenStrict(t *testing.T) {
+	defer func(previous bool) { strictContentEncoding = previous }(strictContentEncoding)
+	strictContentEncoding = true
+
+	peerA, err := signIn(t, "client_strictgzipA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_strictgzipB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+
+	if status := sendGzippedMessage(t, peerA, peerB, "offer").Code; status != http.StatusUnsupportedMediaType {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusUnsupportedMediaType, status)
+	}
+}
+
+func TestGzippedMessageRejectedWhenTooLarge(t *testing.T) {
+	defer func(previous int64) { maxDecodedMessageBytes = previous }(maxDecodedMessageBytes)
+	maxDecodedMessageBytes = 1024
+
+	peerA, err := signIn(t, "client_gzipbombA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_gzipbombB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+	discardMessages(peerB)
+
+	if status := sendGzippedMessage(t, peerA, peerB, strings.Repeat("a", 1<<20)).Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusRequestEntityTooLarge, status)
+	}
+	if pending := pendingMessages(peers[peerB]); pending != 0 {
+		t.Errorf("Expected the oversized message not to be queued, %d messages queued", pending)
+	}
+}
+
+func TestObserverNotifiedOfAllSignIns(t *testing.T) {
+	req, err := http.NewRequest("GET", "/sign_in?dashboard&kind=observer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	signInHandler := http.HandlerFunc(signinHandler)
+	signInHandler.ServeHTTP(rr, req)
+	observerID := rr.Header().Get("Pragma")
+	defer signOut(t, observerID)
+	discardMessages(observerID)
+
+	serverID, err := signIn(t, "renderingserver_observed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	clientID, err := signIn(t, "client_observed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+
+	for _, expectedID := range []string{serverID, clientID} {
+		rr = waitForMessage(t, observerID)
+		var notice map[string]string
+		if err = json.Unmarshal(rr.Body.Bytes(), &notice); err != nil {
+			t.Fatalf("Notice is not valid json (%v): %s", err, rr.Body.String())
+		}
+		if notice["type"] != peerEventNotice || notice["event"] != eventSignIn || notice["peer_id"] != expectedID {
+			t.Errorf("Wrong notice recieved expected sign in of %s: %s", expectedID, rr.Body.String())
+		}
+	}
+
+	// The observer shouldn't have been advertised to the client
+	rr = waitForMessage(t, serverID)
+	if strings.Contains(rr.Body.String(), "dashboard") {
+		t.Errorf("Observer was advertised to a peer: %s", rr.Body.String())
+	}
+	if status := sendMessage(t, clientID, observerID, "offer").Code; status != http.StatusForbidden {
+		t.Errorf("Recieved wrong status code messaging an observer expected %v, got %v", http.StatusForbidden, status)
+	}
+}
+
+func TestMessageWaitsForRoomInFullBuffer(t *testing.T) {
+	defer func(previous time.Duration) { enqueueTimeout = previous }(enqueueTimeout)
+	enqueueTimeout = 5 * time.Second
+
+	peerA, err := signIn(t, "client_fullA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_fullB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+	discardMessages(peerB)
+	recipient := peers[peerB]
+	for recipient.Channel.Len() < recipient.Channel.Cap() {
+		recipient.Channel.Send(context.Background(), &peerMsg{FromID: peerA, Message: "filler", Priority: normalPriority}, 0)
+		messageQueued()
+	}
+
+	messageStatus := make(chan int)
+	go func() {
+		messageStatus <- sendMessage(t, peerA, peerB, "last").Code
+	}()
+
+	// Drain one message while the sender is waiting for room
+	time.Sleep(50 * time.Millisecond)
+	<-recipient.Channel.Receive()
+	messagesDequeued(1)
+
+	if status := <-messageStatus; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	var last *peerMsg
+	for recipient.Channel.Len() > 0 {
+		last = <-recipient.Channel.Receive()
+		messagesDequeued(1)
+	}
+	if last == nil || last.Message != "last" {
+		t.Errorf("Message was not delivered after room was made")
+	}
+}
+
+func TestCorsHeadersOnlyOnPeerRoutes(t *testing.T) {
+	handler := commonHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	expectations := map[string]bool{
+		"/sign_in":       true,
+		"/wait":          true,
+		"/metrics":       false,
+		"/health":        false,
+		"/admin/cleanup": false,
+	}
+	for path, expectCors := range expectations {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if hasCors := rr.Header().Get("Access-Control-Allow-Origin") != ""; hasCors != expectCors {
+			t.Errorf("CORS headers on %s were %v expected %v", path, hasCors, expectCors)
+		}
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+		valid    bool
+	}{
+		{"", ":8087", true},
+		{"[::1]:9000", "[::1]:9000", true},
+		{"::1", "[::1]:8087", true},
+		{"[::1]", "[::1]:8087", true},
+		{"127.0.0.1:9000", "127.0.0.1:9000", true},
+		{"localhost:9000", "localhost:9000", true},
+		{"::1:9000:", "", false},
+		{"[::1]:port", "", false},
+		{"[::1]:70000", "", false},
+		{"[::zz]:9000", "", false},
+	}
+	for _, test := range tests {
+		addr, err := listenAddress(test.addr, "8087")
+		if test.valid && (err != nil || addr != test.expected) {
+			t.Errorf("Listen address for '%s' expected %s, got %s (%v)", test.addr, test.expected, addr, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected listen address '%s' to be rejected, got %s", test.addr, addr)
+		}
+	}
+}
+
+func TestListenOnIPv6Loopback(t *testing.T) {
+	addr, err := listenAddress("[::1]:0", "8087")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	defer listener.Close()
+
+	srv := newHTTPServer(context.Background(), addr, http.HandlerFunc(healthHandler))
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	res, err := http.Get("http://" + listener.Addr().String() + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusOK, res.StatusCode)
+	}
+}
+
+func TestContentLengthMatchesBody(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(t, Config{}).Handler())
+	defer ts.Close()
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ContentLength != int64(len(body)) {
+			t.Errorf("%s sent a Content-Length of %d with a %d byte body: %q", path, resp.ContentLength, len(body), body)
+		}
+		return resp, string(body)
+	}
+
+	// A % in a name must not be treated as formatting
+	resp, body := get("/sign_in?" + url.QueryEscape("client_ünïcødé_100%d"))
+	clientID := resp.Header.Get("Pragma")
+	defer signOut(t, clientID)
+	if !strings.HasPrefix(body, "client_ünïcødé_100%d,"+clientID+",1\n") {
+		t.Errorf("Sign in response was %q", body)
+	}
+	serverID, err := signIn(t, "renderingserver_ünïcødé")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	get("/list?peer_id=" + clientID)
+
+	discardMessages(clientID)
+	if rr := sendMessage(t, serverID, clientID, "ünïcødé 100% ✓"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if _, body = get("/wait?peer_id=" + clientID); body != "ünïcødé 100% ✓" {
+		t.Errorf("Wait response was %q", body)
+	}
+	get("/stats")
+}
+
+func TestValidateSettingsRejectsNonPositiveCleanupInterval(t *testing.T) {
+	defer func(previous time.Duration) { cleanupInterval = previous }(cleanupInterval)
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		cleanupInterval = interval
+		if err := validateSettings(); err == nil {
+			t.Errorf("A cleanup interval of %s should be rejected", interval)
+		}
+	}
+	cleanupInterval = time.Second
+	if err := validateSettings(); err != nil {
+		t.Errorf("A cleanup interval of 1s should be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// extraHeaderList is a comma separated list of name:value headers added to every response
+var extraHeaderList string
+var extraHeaders = make(http.Header)
+
+// parseExtraHeaders parses extraHeaderList into extraHeaders
+func parseExtraHeaders() error {
+	extraHeaders = make(http.Header)
+	for _, entry := range strings.Split(extraHeaderList, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		separator := strings.Index(entry, ":")
+		if separator < 0 {
+			return fmt.Errorf("extra header %s is not name:value", entry)
+		}
+		name, value := strings.TrimSpace(entry[:separator]), strings.TrimSpace(entry[separator+1:])
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid extra header name %s", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for extra header %s", name)
+		}
+		extraHeaders.Add(name, value)
+	}
+	return nil
+}
+
+// validHeaderName reports whether a header name is a valid http token
+func validHeaderName(name string) bool {
+	return name != "" && strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r))
+	}) < 0
+}
+
+func setExtraHeaders(header http.Header) {
+	for name, values := range extraHeaders {
+		header[name] = values
+	}
+}
@@ -0,0 +1,44 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtraHeadersOnSignIn(t *testing.T) {
+	defer func(previous string) {
+		extraHeaderList = previous
+		parseExtraHeaders()
+	}(extraHeaderList)
+	extraHeaderList = "X-Env: prod, X-Region:eu"
+	if err := parseExtraHeaders(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/sign_in?client_extraheaders", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	commonHeaderMiddleware(http.HandlerFunc(signinHandler)).ServeHTTP(rr, req)
+	defer signOut(t, rr.Header().Get("Pragma"))
+
+	if env := rr.Header().Get("X-Env"); env != "prod" {
+		t.Errorf("Extra header X-Env is wrong, expected 'prod' got '%s'", env)
+	}
+	if region := rr.Header().Get("X-Region"); region != "eu" {
+		t.Errorf("Extra header X-Region is wrong, expected 'eu' got '%s'", region)
+	}
+}
+
+func TestExtraHeadersInvalidName(t *testing.T) {
+	defer func(previous string) {
+		extraHeaderList = previous
+		parseExtraHeaders()
+	}(extraHeaderList)
+	extraHeaderList = "X Env:prod"
+	if err := parseExtraHeaders(); err == nil {
+		t.Errorf("Expected an invalid header name to be rejected")
+	}
+}
@@ -0,0 +1,64 @@
+package gosigsrv
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// healthChecks makes /health check the server's dependencies (the state file and statsd)
+var healthChecks bool
+
+// dependencyStatus is the result of checking a single dependency
+type dependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkStateFile makes sure the state file can be saved, by creating a file next to it
+func checkStateFile(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".health-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkStatsd makes sure the statsd address still resolves
+//
+//   Metrics go over udp, so there is no way to tell if anything is listening
+func checkStatsd(addr string) error {
+	_, err := net.ResolveUDPAddr("udp", addr)
+	return err
+}
+
+// checkDependencies checks every configured dependency
+//
+//   Returns nil if healthChecks is off or there is nothing configured to check
+func checkDependencies() map[string]dependencyStatus {
+	if !healthChecks {
+		return nil
+	}
+
+	checks := make(map[string]func() error)
+	if stateFilePath != "" {
+		checks["state_file"] = func() error { return checkStateFile(stateFilePath) }
+	}
+	if statsdAddr != "" {
+		checks["statsd"] = func() error { return checkStatsd(statsdAddr) }
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+
+	dependencies := make(map[string]dependencyStatus)
+	for name, check := range checks {
+		if err := check(); err != nil {
+			dependencies[name] = dependencyStatus{Status: "failing", Error: err.Error()}
+		} else {
+			dependencies[name] = dependencyStatus{Status: "ok"}
+		}
+	}
+	return dependencies
+}
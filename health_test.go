@@ -0,0 +1,55 @@
+package gosigsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthDegradedWhenStateFileUnwritable(t *testing.T) {
+	defer func(previous bool) { healthChecks = previous }(healthChecks)
+	healthChecks = true
+	defer func(previous string) { stateFilePath = previous }(stateFilePath)
+
+	// A file standing in for the state file's directory can't be written into, even as root
+	file, err := ioutil.TempFile("", "gosigsrv-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	getHealth := func() (int, healthResponse) {
+		req, err := http.NewRequest("GET", "/health", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		healthHandler(rr, req)
+
+		var health healthResponse
+		if err = json.Unmarshal(rr.Body.Bytes(), &health); err != nil {
+			t.Fatalf("Response is not valid json (%v): %s", err, rr.Body.String())
+		}
+		return rr.Code, health
+	}
+
+	stateFilePath = filepath.Join(file.Name(), "state.json")
+	status, health := getHealth()
+	if status != http.StatusServiceUnavailable || health.Status != "degraded" {
+		t.Errorf("Unwritable state file was reported as %d %s", status, health.Status)
+	}
+	if dependency := health.Dependencies["state_file"]; dependency.Status != "failing" || dependency.Error == "" {
+		t.Errorf("State file dependency was reported as %+v", dependency)
+	}
+
+	stateFilePath = file.Name() + ".state"
+	status, health = getHealth()
+	if status != http.StatusOK || health.Status != "ok" || health.Dependencies["state_file"].Status != "ok" {
+		t.Errorf("Writable state file was reported as %d %+v", status, health)
+	}
+}
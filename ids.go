@@ -0,0 +1,84 @@
+package gosigsrv
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Encodings of random peer ids
+const (
+	idEncodingHex       string = "hex"
+	idEncodingBase64URL string = "base64url"
+)
+
+// minIDBytes keeps random ids hard enough to guess (64 bits)
+const minIDBytes int = 8
+
+// idBytes is the number of random bytes in a peer id (0 for the default increasing numbers)
+var idBytes int
+
+// strictPeerIDs rejects peer ids that aren't in the format the server hands out before looking them up
+var strictPeerIDs bool
+
+// maxNumericIDLength is the longest an increasing number id can be (the digits of a uint64)
+const maxNumericIDLength int = 20
+
+// idEncoding is how random peer ids are encoded, hex or base64url (unpadded)
+var idEncoding = idEncodingHex
+
+// validateIDFormat checks the random id settings
+func validateIDFormat() error {
+	if idEncoding != idEncodingHex && idEncoding != idEncodingBase64URL {
+		return fmt.Errorf("unknown id encoding %s", idEncoding)
+	}
+	if idBytes != 0 && idBytes < minIDBytes {
+		return fmt.Errorf("random ids need at least %d bytes, got %d", minIDBytes, idBytes)
+	}
+	return nil
+}
+
+// randomPeerID returns idBytes random bytes encoded with idEncoding
+func randomPeerID() string {
+	b := make([]byte, idBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("could not read random id: %v", err))
+	}
+	if idEncoding == idEncodingBase64URL {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	return hex.EncodeToString(b)
+}
+
+// wellFormedPeerID reports whether an id is in the format the server hands out
+//
+//   Always true unless strictPeerIDs is set, so scanners probing random
+//   ids can be turned away with a 400 before they are looked up
+func wellFormedPeerID(peerID string) bool {
+	if !strictPeerIDs {
+		return true
+	}
+
+	var length int
+	var charset string
+	switch {
+	case idBytes == 0:
+		length, charset = -1, "0123456789"
+	case idEncoding == idEncodingBase64URL:
+		length, charset = base64.RawURLEncoding.EncodedLen(idBytes), "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	default:
+		length, charset = hex.EncodedLen(idBytes), "0123456789abcdef"
+	}
+
+	if peerID == "" || length >= 0 && len(peerID) != length || length < 0 && len(peerID) > maxNumericIDLength {
+		return false
+	}
+	for _, r := range peerID {
+		if !strings.ContainsRune(charset, r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package gosigsrv
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRandomPeerIDFormat(t *testing.T) {
+	defer func(previousBytes int, previousEncoding string) {
+		idBytes = previousBytes
+		idEncoding = previousEncoding
+	}(idBytes, idEncoding)
+
+	tests := []struct {
+		bytes    int
+		encoding string
+		format   *regexp.Regexp
+	}{
+		{16, idEncodingHex, regexp.MustCompile(`^[0-9a-f]{32}$`)},
+		{8, idEncodingHex, regexp.MustCompile(`^[0-9a-f]{16}$`)},
+		{12, idEncodingBase64URL, regexp.MustCompile(`^[A-Za-z0-9_-]{16}$`)},
+		{10, idEncodingBase64URL, regexp.MustCompile(`^[A-Za-z0-9_-]{14}$`)},
+	}
+	for _, test := range tests {
+		idBytes, idEncoding = test.bytes, test.encoding
+		if err := validateIDFormat(); err != nil {
+			t.Errorf("%d %s ids should be valid: %v", test.bytes, test.encoding, err)
+		}
+		peerMutex.Lock()
+		peerID := newPeerID()
+		peerMutex.Unlock()
+		if !test.format.MatchString(peerID) {
+			t.Errorf("%d %s id %s doesn't match %s", test.bytes, test.encoding, peerID, test.format)
+		}
+	}
+}
+
+func TestRandomPeerIDFormatValidated(t *testing.T) {
+	defer func(previousBytes int, previousEncoding string) {
+		idBytes = previousBytes
+		idEncoding = previousEncoding
+	}(idBytes, idEncoding)
+
+	idBytes, idEncoding = 4, idEncodingHex
+	if err := validateIDFormat(); err == nil {
+		t.Errorf("Ids with less than %d random bytes should be rejected", minIDBytes)
+	}
+	idBytes, idEncoding = 16, "base32"
+	if err := validateIDFormat(); err == nil {
+		t.Errorf("Unknown id encodings should be rejected")
+	}
+	idBytes, idEncoding = 0, idEncodingHex
+	if err := validateIDFormat(); err != nil {
+		t.Errorf("Increasing number ids should be valid: %v", err)
+	}
+}
+
+func TestStrictPeerIDsRejectMalformedIDs(t *testing.T) {
+	defer func(previousStrict bool, previousBytes int, previousEncoding string) {
+		strictPeerIDs = previousStrict
+		idBytes = previousBytes
+		idEncoding = previousEncoding
+	}(strictPeerIDs, idBytes, idEncoding)
+
+	peerID, err := signIn(t, "client_strictid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+
+	malformed := "../../etc/passwd"
+	if rr := sendMessage(t, peerID, malformed, "offer"); strings.Contains(rr.Body.String(), "Malformed") {
+		t.Errorf("Without strict ids a malformed id should just be unknown, got %v %s", rr.Code, rr.Body.String())
+	}
+
+	strictPeerIDs = true
+	if rr := sendMessage(t, peerID, malformed, "offer"); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Malformed") {
+		t.Errorf("Recieved wrong response expected %v Malformed, got %v %s", http.StatusBadRequest, rr.Code, rr.Body.String())
+	}
+	if rr := waitForMessage(t, malformed); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Malformed") {
+		t.Errorf("Recieved wrong response expected %v Malformed, got %v %s", http.StatusBadRequest, rr.Code, rr.Body.String())
+	}
+
+	for _, test := range []struct {
+		bytes    int
+		encoding string
+		valid    []string
+		invalid  []string
+	}{
+		{0, idEncodingHex, []string{"1", "12345"}, []string{"", "-1", "1a", "123456789012345678901"}},
+		{8, idEncodingHex, []string{"0123456789abcdef"}, []string{"0123456789ABCDEF", "0123456789abcde", "0123456789abcdefa"}},
+		{8, idEncodingBase64URL, []string{"AZaz09-_AZa"}, []string{"AZaz09+/AZa", "AZaz09-_AZaz"}},
+	} {
+		idBytes, idEncoding = test.bytes, test.encoding
+		for _, id := range test.valid {
+			if !wellFormedPeerID(id) {
+				t.Errorf("%q should be a well formed %d byte %s id", id, test.bytes, test.encoding)
+			}
+		}
+		for _, id := range test.invalid {
+			if wellFormedPeerID(id) {
+				t.Errorf("%q should not be a well formed %d byte %s id", id, test.bytes, test.encoding)
+			}
+		}
+	}
+}
+
+func TestPeerIDCounterStartsOverInsteadOfWrapping(t *testing.T) {
+	defer func(previous int) { idBytes = previous }(idBytes)
+	idBytes = 0
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	defer func(previous uint) { peerIDCount = previous }(peerIDCount)
+	peerIDCount = math.MaxUint - 1
+	// Id 1 is taken, so starting over has to skip it
+	peers["1"] = &peerInfo{ID: "1", Name: "client_idoverflow"}
+	defer delete(peers, "1")
+
+	if peerID := newPeerID(); peerID != strconv.FormatUint(uint64(math.MaxUint), 10) {
+		t.Errorf("Expected the last id before running out, got %s", peerID)
+	}
+	peerID := newPeerID()
+	if peerID == "0" || peerID == "1" {
+		t.Errorf("Got id %s after the counter ran out", peerID)
+	}
+	if peerIDCount == 0 || peerIDCount > math.MaxUint/2 {
+		t.Errorf("Counter did not start over, it's at %d", peerIDCount)
+	}
+}
@@ -0,0 +1,45 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"time"
+)
+
+// inactivityWarning is how long before it would be removed as stale that an idle peer is warned (0 never warns)
+//
+//   Peers are only checked every cleanupInterval, so it should be longer than that
+var inactivityWarning time.Duration
+
+// inactivityWarningNotice is sent to a peer about to be removed for inactivity
+const inactivityWarningNotice string = "inactivity-warning"
+
+// warnInactivePeers sends an inactivity-warning notice to peers that will be removed as stale within inactivityWarning
+//
+//   Each peer is warned once per idle stretch, any request that updates its
+//   last contact (e.g. /list or /whoami as a heartbeat) starts a new one
+//   Returns the number of peers warned
+func warnInactivePeers() int {
+	if inactivityWarning <= 0 {
+		return 0
+	}
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	var warned int
+	now := time.Now().UTC()
+	for _, v := range peers {
+		if v == nil || v.Waiting || v.InactivityWarnedFor.Equal(v.LastContact) {
+			continue
+		}
+		timeout := staleTimeoutFor(v.Kind)
+		left := timeout - now.Sub(v.LastContact)
+		if timeout <= 0 || left > inactivityWarning || left < 0 {
+			continue
+		}
+		fmt.Printf("Warning peer %s it will be removed for inactivity in %s\n", v, left.Round(time.Second))
+		notifyPeerNotice(v, inactivityWarningNotice, map[string]string{"seconds_left": fmt.Sprintf("%d", int(left.Seconds()))})
+		v.InactivityWarnedFor = v.LastContact
+		warned++
+	}
+	return warned
+}
@@ -0,0 +1,68 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdlePeerWarnedBeforeRemoval(t *testing.T) {
+	defer func(previous time.Duration) { inactivityWarning = previous }(inactivityWarning)
+	inactivityWarning = staleTimeout / 2
+
+	peerID, err := signIn(t, "client_inactive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+	discardMessages(peerID)
+
+	peerMutex.Lock()
+	peers[peerID].LastContact = time.Now().UTC().Add(-staleTimeout + inactivityWarning/2)
+	peerMutex.Unlock()
+
+	runCleanup()
+	// Once per idle stretch
+	runCleanup()
+
+	peerMutex.Lock()
+	peer, exists := peers[peerID]
+	var messages []string
+	if exists {
+		messages = queuedMessages(peer)
+	}
+	peerMutex.Unlock()
+	if !exists {
+		t.Fatalf("Peer was removed before it became stale")
+	}
+	if len(messages) != 1 || !strings.Contains(messages[0], `"type":"inactivity-warning"`) {
+		t.Fatalf("Expected one inactivity warning, got %q", messages)
+	}
+
+	// A heartbeat keeps the peer from becoming stale
+	req, err := http.NewRequest("GET", "/whoami?peer_id="+peerID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	whoamiHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Heartbeat failed with %d", rr.Code)
+	}
+	peerMutex.Lock()
+	lastContact := peers[peerID].LastContact
+	peerMutex.Unlock()
+	if time.Since(lastContact) > time.Second {
+		t.Fatalf("Heartbeat did not update the peer's last contact")
+	}
+
+	runCleanup()
+	peerMutex.Lock()
+	_, exists = peers[peerID]
+	peerMutex.Unlock()
+	if !exists {
+		t.Errorf("Peer that sent a heartbeat was removed")
+	}
+}
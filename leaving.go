@@ -0,0 +1,70 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// signOutGrace is how long a signed out peer stays listed (and connected with its partners) in case it signs right back in (0 removes it right away)
+var signOutGrace time.Duration
+
+// signOutPeer removes a peer that signed out, telling its partners and observers
+//
+//   Must be called with peerMutex held
+func signOutPeer(peer *peerInfo) {
+	partnerIDs := peer.ConnectedWith.String()
+	removePeer(peer, "sign-out")
+	fmt.Printf("sign-out - Peer: %s\n", peer)
+	peerEvent(eventSignOut, peer, partnerIDs)
+}
+
+// leaveAfterGrace marks a signed out peer as leaving, and signs it out for good once signOutGrace has passed
+//
+//   Must be called with peerMutex held
+func leaveAfterGrace(peer *peerInfo) {
+	if peer.Leaving != nil {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(signOutGrace, func() {
+		peerMutex.Lock()
+		// Signed back in (or removed some other way) since
+		if peer.Leaving != timer || peers[peer.ID] != peer {
+			peerMutex.Unlock()
+			return
+		}
+		peer.Leaving = nil
+		signOutPeer(peer)
+		peerMutex.Unlock()
+		printStats()
+	})
+	peer.Leaving = timer
+	fmt.Printf("sign-out - Peer %s leaving in %s\n", peer, signOutGrace)
+}
+
+// cancelLeaving keeps a leaving peer that signed back in
+//
+//   Must be called with peerMutex held
+func cancelLeaving(peer *peerInfo) {
+	if peer.Leaving != nil {
+		peer.Leaving.Stop()
+		peer.Leaving = nil
+		fmt.Printf("sign-in - Peer %s signed back in before leaving\n", peer)
+	}
+}
+
+// returningPeer finds the leaving peer a sign in is from, if any
+//
+//   That's a peer with the same name, kind and room that signed in from the same client ip
+//   Must be called with peerMutex held
+func returningPeer(req *http.Request, name string, kind peerKind, room string) *peerInfo {
+	ip := clientIP(req)
+	for _, v := range peers {
+		if v != nil && v.Leaving != nil && v.Name == name && v.Kind == kind && v.Room == room && v.RemoteIP.Equal(ip) {
+			return v
+		}
+	}
+	return nil
+}
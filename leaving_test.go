@@ -0,0 +1,59 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignInWithinGraceKeepsPartner(t *testing.T) {
+	clientID, err := signIn(t, "client_grace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_grace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	defer func(previous time.Duration) { signOutGrace = previous }(signOutGrace)
+	signOutGrace = 500 * time.Millisecond
+
+	if rr := sendMessage(t, clientID, serverID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	discardMessages(clientID)
+
+	if rr := signOut(t, serverID); rr.Code != http.StatusOK {
+		t.Fatalf("Sign out failed with %d", rr.Code)
+	}
+	peerMutex.Lock()
+	leaving := peers[serverID] != nil && peers[serverID].View().Leaving
+	peerMutex.Unlock()
+	if !leaving {
+		t.Fatalf("Signed out peer was not kept as leaving")
+	}
+
+	returnedID, err := signIn(t, "renderingserver_grace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if returnedID != serverID {
+		t.Fatalf("Peer signing back in got id %s instead of %s", returnedID, serverID)
+	}
+
+	time.Sleep(signOutGrace + 100*time.Millisecond)
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	server, exists := peers[serverID]
+	if !exists || server.Leaving != nil || !server.ConnectedWith.Has(clientID) {
+		t.Fatalf("Peer that signed back in was not kept connected: %+v", server)
+	}
+	for _, message := range queuedMessages(peers[clientID]) {
+		if strings.Contains(message, peerLeftNotice) {
+			t.Errorf("Partner was told the peer left: %s", message)
+		}
+	}
+}
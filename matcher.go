@@ -0,0 +1,150 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Built in matchers
+const (
+	matchDefault     = "default"
+	matchRoundRobin  = "round-robin"
+	matchLeastLoaded = "least-loaded"
+	matchRandom      = "random"
+)
+
+// matcherName is the matcher that orders the peers offered to peers that don't ask for a sort order
+var matcherName = matchDefault
+
+// MatchCandidate is what a Matcher is told about a peer
+type MatchCandidate struct {
+	ID          string
+	Name        string
+	Kind        string
+	Room        string
+	Partners    int
+	LastContact time.Time
+}
+
+// Matcher decides which available peers are offered to a peer, and in what order
+//
+//   Match is given the peer signing in (or listing peers) and the peers
+//   available to it, and returns the ones to offer it first to last.
+//   It's called with the peer lock held, so it must not call back into the server
+type Matcher interface {
+	Match(peer MatchCandidate, available []MatchCandidate) []MatchCandidate
+}
+
+// MatcherFunc lets an ordinary function be used as a Matcher
+type MatcherFunc func(peer MatchCandidate, available []MatchCandidate) []MatchCandidate
+
+// Match calls f(peer, available)
+func (f MatcherFunc) Match(peer MatchCandidate, available []MatchCandidate) []MatchCandidate {
+	return f(peer, available)
+}
+
+var matchersMutex sync.Mutex
+var matchers = map[string]Matcher{
+	matchRoundRobin:  &roundRobinMatcher{},
+	matchLeastLoaded: MatcherFunc(leastLoadedMatch),
+	matchRandom:      MatcherFunc(randomMatch),
+}
+
+// RegisterMatcher makes a matcher selectable by name with -matcher
+//
+//   Call it before Main (or before setting up a Server). Registering a name again replaces its matcher
+func RegisterMatcher(name string, matcher Matcher) {
+	matchersMutex.Lock()
+	defer matchersMutex.Unlock()
+	matchers[name] = matcher
+}
+
+// validateMatcher checks that -matcher names a registered matcher
+func validateMatcher() error {
+	if matcherName == matchDefault {
+		return nil
+	}
+	matchersMutex.Lock()
+	defer matchersMutex.Unlock()
+	if matchers[matcherName] == nil {
+		return fmt.Errorf("unknown matcher %s", matcherName)
+	}
+	return nil
+}
+
+// matchCandidate describes a peer to a matcher
+func matchCandidate(peer *peerInfo) MatchCandidate {
+	return MatchCandidate{
+		ID:          peer.ID,
+		Name:        peer.Name,
+		Kind:        string(peer.Kind),
+		Room:        peer.Room,
+		Partners:    len(peer.ConnectedWith),
+		LastContact: peer.LastContact,
+	}
+}
+
+// offeredPeers returns the available peers to offer to a peer
+//
+//   A sort order the peer asked for wins, otherwise the matcher picks
+//   the peers to offer. The default matcher keeps the pagedSortOrder
+//   Must be called with peerMutex held
+func offeredPeers(peer *peerInfo, available []*peerInfo, sortOrder string) []*peerInfo {
+	matchersMutex.Lock()
+	matcher := matchers[matcherName]
+	matchersMutex.Unlock()
+	if sortOrder != "" || matcherName == matchDefault || matcher == nil {
+		return sortPeers(available, pagedSortOrder(sortOrder))
+	}
+
+	byID := make(map[string]*peerInfo, len(available))
+	candidates := make([]MatchCandidate, 0, len(available))
+	for _, pInfo := range sortPeers(available, sortByID) {
+		byID[pInfo.ID] = pInfo
+		candidates = append(candidates, matchCandidate(pInfo))
+	}
+
+	// Only offer peers that were available, and each of them once
+	var offered []*peerInfo
+	for _, candidate := range matcher.Match(matchCandidate(peer), candidates) {
+		if pInfo, exists := byID[candidate.ID]; exists {
+			offered = append(offered, pInfo)
+			delete(byID, candidate.ID)
+		}
+	}
+	return offered
+}
+
+// roundRobinMatcher offers the available peers (in id order) starting one further along each time
+type roundRobinMatcher struct {
+	mutex sync.Mutex
+	next  int
+}
+
+func (m *roundRobinMatcher) Match(peer MatchCandidate, available []MatchCandidate) []MatchCandidate {
+	if len(available) == 0 {
+		return available
+	}
+	m.mutex.Lock()
+	start := m.next % len(available)
+	m.next++
+	m.mutex.Unlock()
+	rotated := make([]MatchCandidate, 0, len(available))
+	rotated = append(rotated, available[start:]...)
+	return append(rotated, available[:start]...)
+}
+
+// leastLoadedMatch offers the peers with the fewest partners first
+func leastLoadedMatch(peer MatchCandidate, available []MatchCandidate) []MatchCandidate {
+	sort.SliceStable(available, func(i int, j int) bool { return available[i].Partners < available[j].Partners })
+	return available
+}
+
+// randomMatch offers the available peers in a random order
+func randomMatch(peer MatchCandidate, available []MatchCandidate) []MatchCandidate {
+	rand.Shuffle(len(available), func(i int, j int) { available[i], available[j] = available[j], available[i] })
+	return available
+}
@@ -0,0 +1,66 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRoundRobinMatcherRotatesServers(t *testing.T) {
+	defer func(previous string) { matcherName = previous }(matcherName)
+	matcherName = matchRoundRobin
+	defer RegisterMatcher(matchRoundRobin, matchers[matchRoundRobin])
+	RegisterMatcher(matchRoundRobin, &roundRobinMatcher{})
+
+	signInToRoom := func(name string) string {
+		req, err := http.NewRequest("GET", "/sign_in?"+name+"&room=roundrobin", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		signinHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Sign in of %s failed with %d", name, rr.Code)
+		}
+		return rr.Header().Get("Pragma")
+	}
+
+	serverIDs := []string{
+		signInToRoom("renderingserver_roundrobin1"),
+		signInToRoom("renderingserver_roundrobin2"),
+		signInToRoom("renderingserver_roundrobin3"),
+	}
+	clientID := signInToRoom("client_roundrobin")
+	for _, peerID := range append(serverIDs, clientID) {
+		defer signOut(t, peerID)
+	}
+
+	queryParams := make(url.Values)
+	queryParams.Add("peer_id", clientID)
+	var firstOffered []string
+	for i := 0; i < 4; i++ {
+		req, err := http.NewRequest("GET", "/list?"+queryParams.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		listHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+		}
+
+		lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+		if len(lines) != len(serverIDs) {
+			t.Fatalf("Expected all %d servers to be offered, got %q", len(serverIDs), lines)
+		}
+		firstOffered = append(firstOffered, strings.Split(lines[0], ",")[1])
+	}
+
+	// The client's own sign in took the first turn
+	expected := []string{serverIDs[1], serverIDs[2], serverIDs[0], serverIDs[1]}
+	if strings.Join(firstOffered, " ") != strings.Join(expected, " ") {
+		t.Errorf("Servers were offered first in the order %v, expected %v", firstOffered, expected)
+	}
+}
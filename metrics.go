@@ -0,0 +1,126 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// signIns counts successful sign ins
+var signIns int64
+
+// lonelySignIns counts sign ins that found no available peers
+var lonelySignIns int64
+
+// peakPeers is the most peers signed in at once since the server started
+var peakPeers int64
+
+// peakPeersSinceReset is the most peers signed in at once since the last /admin/reset-peak
+var peakPeersSinceReset int64
+
+// relayedMessages counts messages queued for their recipient
+var relayedMessages int64
+
+// resettableCounters count the same things as some of the counters above, but since the last /admin/metrics/reset
+//
+//   The counters above are never reset, since prometheus expects its totals to only go up
+var resettableCounters = map[string]*int64{
+	"sign_ins":             new(int64),
+	"lonely_sign_ins":      new(int64),
+	"messages":             new(int64),
+	"lost_messages":        new(int64),
+	"out_of_room_messages": new(int64),
+}
+
+// countEvent adds one to a cumulative counter and to the resettable counter of the same name
+func countEvent(counter *int64, name string) {
+	atomic.AddInt64(counter, 1)
+	atomic.AddInt64(resettableCounters[name], 1)
+}
+
+// resetCounters zeroes the resettable counters, returning their values from before the reset
+func resetCounters() map[string]int64 {
+	previous := make(map[string]int64, len(resettableCounters))
+	for name, counter := range resettableCounters {
+		previous[name] = atomic.SwapInt64(counter, 0)
+	}
+	return previous
+}
+
+// notePeerCount raises the peak peer counts to the current number of peers
+//
+//   Called (with peerMutex held) whenever a peer is added
+func notePeerCount() {
+	count := int64(len(peers))
+	raiseTo(&peakPeers, count)
+	raiseTo(&peakPeersSinceReset, count)
+}
+
+// raiseTo sets a value to count if count is higher
+func raiseTo(value *int64, count int64) {
+	for {
+		current := atomic.LoadInt64(value)
+		if count <= current || atomic.CompareAndSwapInt64(value, current, count) {
+			return
+		}
+	}
+}
+
+// resetPeakPeers starts the peak since reset over from the current number of peers
+func resetPeakPeers() {
+	atomic.StoreInt64(&peakPeersSinceReset, int64(len(peers)))
+}
+
+// metricKind is how a metric's value behaves
+type metricKind string
+
+const (
+	// Counters only go up
+	counterMetric metricKind = "counter"
+	// Gauges are a current value
+	gaugeMetric metricKind = "gauge"
+)
+
+// metric is a single named value exported by /metrics and to statsd
+type metric struct {
+	Name  string
+	Kind  metricKind
+	Help  string
+	Value int64
+}
+
+// currentMetrics returns the current value of every exported metric
+func currentMetrics() []metric {
+	total, servers, clients := countPeers()
+	return []metric{
+		{"sign_ins", counterMetric, "Successful sign ins", atomic.LoadInt64(&signIns)},
+		{"lonely_sign_ins", counterMetric, "Sign ins that found no available peers", atomic.LoadInt64(&lonelySignIns)},
+		{"messages", counterMetric, "Messages relayed to a peer", atomic.LoadInt64(&relayedMessages)},
+		{"lost_messages", counterMetric, "Messages that could not be written to or re-queued for their recipient", atomic.LoadInt64(&lostMessages)},
+		{"out_of_room_messages", counterMetric, "Messages sent to a peer other than the sender's partner", atomic.LoadInt64(&outOfRoomMessages)},
+		{"peers", gaugeMetric, "Signed in peers", int64(total)},
+		{"servers", gaugeMetric, "Signed in server peers", int64(servers)},
+		{"clients", gaugeMetric, "Signed in client peers", int64(clients)},
+		{"peak_peers", gaugeMetric, "Most peers signed in at once since the server started", atomic.LoadInt64(&peakPeers)},
+		{"peak_peers_since_reset", gaugeMetric, "Most peers signed in at once since the peak was last reset", atomic.LoadInt64(&peakPeersSinceReset)},
+		{"in_flight_messages", gaugeMetric, "Messages queued across all peers", atomic.LoadInt64(&inFlightMessages)},
+	}
+}
+
+// metricsHandler exports the metrics in the prometheus text format
+func metricsHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	res.WriteHeader(http.StatusOK)
+	for _, m := range currentMetrics() {
+		name := "gosigsrv_" + m.Name
+		if m.Kind == counterMetric {
+			name += "_total"
+		}
+		fmt.Fprintf(res, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, m.Help, name, m.Kind, name, m.Value)
+	}
+}
@@ -0,0 +1,134 @@
+package gosigsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMetricsPrometheusFormat(t *testing.T) {
+	peerID, err := signIn(t, "client_metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(metricsHandler).ServeHTTP(rr, req)
+
+	body := rr.Body.String()
+	for _, expected := range []string{"# TYPE gosigsrv_sign_ins_total counter\n", "# TYPE gosigsrv_peers gauge\n", "\ngosigsrv_messages_total "} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Metrics are missing %q:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "gosigsrv_sign_ins_total 0\n") {
+		t.Errorf("Sign in was not counted:\n%s", body)
+	}
+}
+
+func TestLonelySignInsCounted(t *testing.T) {
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+
+	before := atomic.LoadInt64(&lonelySignIns)
+	clientID, err := signIn(t, "client_lonely")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	if lonely := atomic.LoadInt64(&lonelySignIns); lonely != before+1 {
+		t.Errorf("First sign in should be counted as lonely, count went from %d to %d", before, lonely)
+	}
+
+	serverID, err := signIn(t, "renderingserver_lonely")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	if lonely := atomic.LoadInt64(&lonelySignIns); lonely != before+1 {
+		t.Errorf("Sign in with a peer available should not be counted as lonely, count went from %d to %d", before, lonely)
+	}
+}
+
+func TestPeakPeersTracked(t *testing.T) {
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+	defer func(previousPeak int64, previousReset int64) {
+		atomic.StoreInt64(&peakPeers, previousPeak)
+		atomic.StoreInt64(&peakPeersSinceReset, previousReset)
+	}(atomic.LoadInt64(&peakPeers), atomic.LoadInt64(&peakPeersSinceReset))
+	atomic.StoreInt64(&peakPeers, 0)
+	atomic.StoreInt64(&peakPeersSinceReset, 0)
+
+	var peerIDs []string
+	for _, name := range []string{"client_peakA", "client_peakB", "renderingserver_peakC"} {
+		peerID, err := signIn(t, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerIDs = append(peerIDs, peerID)
+	}
+	signOut(t, peerIDs[0])
+	signOut(t, peerIDs[1])
+
+	var stats statsResponse
+	getJSON(t, statsHandler, "/stats", &stats)
+	if stats.Peers != 1 || stats.PeakPeers != 3 || stats.PeakPeersReset != 3 {
+		t.Errorf("Expected a peak of 3 with 1 peer left, got %+v", stats)
+	}
+
+	if rr := adminRequest(t, adminResetPeakHandler, "POST", "/admin/reset-peak"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	peerID, err := signIn(t, "client_peakD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signOut(t, peerID)
+	signOut(t, peerIDs[2])
+
+	getJSON(t, statsHandler, "/stats", &stats)
+	if stats.PeakPeers != 3 || stats.PeakPeersReset != 2 {
+		t.Errorf("Expected a peak of 3 overall and 2 since the reset, got %+v", stats)
+	}
+}
+
+func TestAdminMetricsResetReturnsPriorValues(t *testing.T) {
+	resetCounters()
+	cumulative := atomic.LoadInt64(&signIns)
+	peerID, err := signIn(t, "client_metrics_reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+
+	rr := adminRequest(t, adminMetricsResetHandler, "POST", "/admin/metrics/reset")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	var reset adminMetricsResetResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &reset); err != nil {
+		t.Fatal(err)
+	}
+	if reset.Previous["sign_ins"] != 1 {
+		t.Errorf("Expected the reset to return 1 sign in, got %v", reset.Previous)
+	}
+	if now := atomic.LoadInt64(resettableCounters["sign_ins"]); now != 0 {
+		t.Errorf("Expected the sign ins to be zero after the reset, got %d", now)
+	}
+	if total := atomic.LoadInt64(&signIns); total != cumulative+1 {
+		t.Errorf("Expected the cumulative sign ins to be kept at %d, got %d", cumulative+1, total)
+	}
+
+	if rr := adminRequest(t, adminMetricsResetHandler, "GET", "/admin/metrics/reset"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusBadRequest, rr.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxPartners is how many peers a peer can be connected with at once (0 for no limit)
+//
+//   The default of 1 is the original behaviour of a peer only
+//   being paired with the first peer it exchanges messages with
+var maxPartners = 1
+
+// partnerSet is the set of ids of the peers a peer is connected with
+type partnerSet map[string]bool
+
+// Has reports whether a peer id is in the set
+func (s partnerSet) Has(peerID string) bool {
+	return s[peerID]
+}
+
+// IDs returns the ids in the set in id order
+func (s partnerSet) IDs() []string {
+	ids := make([]string, 0, len(s))
+	for peerID := range s {
+		ids = append(ids, peerID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return peerIDLess(ids[i], ids[j]) })
+	return ids
+}
+
+// String returns the ids in the set comma separated
+//
+//   With a single partner this is just its id, as connected_with always was
+func (s partnerSet) String() string {
+	return strings.Join(s.IDs(), ",")
+}
+
+// parsePartnerSet parses a comma separated list of peer ids
+func parsePartnerSet(value string) partnerSet {
+	set := make(partnerSet)
+	for _, peerID := range strings.Split(value, ",") {
+		if peerID = strings.TrimSpace(peerID); peerID != "" {
+			set[peerID] = true
+		}
+	}
+	return set
+}
+
+// canTakePartner reports whether the peer can be connected with another peer
+func (m peerInfo) canTakePartner() bool {
+	return maxPartners <= 0 || len(m.ConnectedWith) < maxPartners
+}
+
+// Connect records that the peer is connected with another
+//
+//   Returns false if it already was or it has no room for another partner
+func (m *peerInfo) Connect(partnerID string) bool {
+	if m.ConnectedWith.Has(partnerID) || !m.canTakePartner() {
+		return false
+	}
+	if m.ConnectedWith == nil {
+		m.ConnectedWith = make(partnerSet)
+	}
+	m.ConnectedWith[partnerID] = true
+	return true
+}
+
+// Disconnect forgets that the peer is connected with another
+//
+//   Returns false if it wasn't connected with it
+func (m *peerInfo) Disconnect(partnerID string) bool {
+	if !m.ConnectedWith.Has(partnerID) {
+		return false
+	}
+	delete(m.ConnectedWith, partnerID)
+	return true
+}
+
+// connectPair connects the sender and recipient of a message with each other (where they have room)
+//
+//   The caller must hold peerMutex, so when two peers send each other their
+//   first message at the same time only one of them pairs them
+//   Returns whether this call paired them, and whether the sender is now
+//   connected with the recipient
+func connectPair(from *peerInfo, to *peerInfo) (paired bool, connected bool) {
+	if from.Connect(to.ID) {
+		fmt.Printf("Connecting %s with %s\n", from, to)
+		paired = true
+	}
+	if to.Connect(from.ID) {
+		fmt.Printf("Connecting %s with %s\n", to, from)
+		paired = true
+	}
+	return paired, from.ConnectedWith.Has(to.ID)
+}
@@ -0,0 +1,155 @@
+package gosigsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPartnerSetString(t *testing.T) {
+	set := parsePartnerSet("10, 2,,3")
+	if value := set.String(); value != "2,3,10" {
+		t.Errorf("Partners should be listed in id order, got %s", value)
+	}
+	if value := parsePartnerSet("7").String(); value != "7" {
+		t.Errorf("A single partner should be just its id, got %s", value)
+	}
+	if value := partnerSet(nil).String(); value != "" {
+		t.Errorf("No partners should be empty, got %s", value)
+	}
+}
+
+func TestConnectLimitedByMaxPartners(t *testing.T) {
+	var peer peerInfo
+	if !peer.Connect("1") {
+		t.Fatal("Peer without partners should connect")
+	}
+	if peer.Connect("2") {
+		t.Error("Peer should only take one partner by default")
+	}
+
+	defer func(previous int) { maxPartners = previous }(maxPartners)
+	maxPartners = 0
+	if !peer.Connect("2") {
+		t.Error("Peer should take any number of partners without a limit")
+	}
+	if peer.Connect("2") {
+		t.Error("Connecting twice with the same peer should do nothing")
+	}
+	if !peer.Disconnect("1") || peer.Disconnect("1") {
+		t.Error("Disconnect should only succeed for a connected peer")
+	}
+	if value := peer.ConnectedWith.String(); value != "2" {
+		t.Errorf("Peer should be left connected with 2, got %s", value)
+	}
+}
+
+func TestAllPartnersNotifiedWhenPeerLeaves(t *testing.T) {
+	defer func(previous int) { maxPartners = previous }(maxPartners)
+	maxPartners = 2
+
+	serverID, err := signIn(t, "renderingserver_multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientA, err := signIn(t, "client_multiA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientA)
+	clientB, err := signIn(t, "client_multiB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientB)
+
+	for _, clientID := range []string{clientA, clientB} {
+		if rr := sendMessage(t, clientID, serverID, "offer"); rr.Code != http.StatusOK {
+			t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+		}
+		if rr := sendMessage(t, serverID, clientID, "answer"); rr.Code != http.StatusOK {
+			t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+		}
+		discardMessages(clientID)
+	}
+	if partners := peers[serverID].ConnectedWith; !partners.Has(clientA) || !partners.Has(clientB) {
+		t.Fatalf("Server should be connected with both clients, got %s", partners)
+	}
+	if view := peers[serverID].View(); view.ConnectedWith != peers[serverID].ConnectedWith.String() {
+		t.Errorf("Connected with should be comma separated, got %s", view.ConnectedWith)
+	}
+
+	if rr := signOut(t, serverID); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	for _, clientID := range []string{clientA, clientB} {
+		var notice map[string]string
+		if err = json.Unmarshal(waitForMessage(t, clientID).Body.Bytes(), &notice); err != nil {
+			t.Fatal(err)
+		}
+		if notice["type"] != peerLeftNotice || notice["peer_id"] != serverID || notice["reason"] != "sign-out" {
+			t.Errorf("Client %s got the wrong notice: %v", clientID, notice)
+		}
+		if len(peers[clientID].ConnectedWith) != 0 {
+			t.Errorf("Client %s is still connected with %s", clientID, peers[clientID].ConnectedWith)
+		}
+	}
+}
+
+func TestSimultaneousFirstMessagesPairOnce(t *testing.T) {
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+
+	observerReq, err := http.NewRequest("GET", "/sign_in?pairwatcher&kind=observer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, observerReq)
+	observerID := rr.Header().Get("Pragma")
+
+	clientID, err := signIn(t, "client_simultaneous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverID, err := signIn(t, "renderingserver_simultaneous")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, ids := range [][2]string{{clientID, serverID}, {serverID, clientID}} {
+		wg.Add(1)
+		go func(from string, to string) {
+			defer wg.Done()
+			<-start
+			req, err := http.NewRequest("POST", "/message?peer_id="+from+"&to="+to, strings.NewReader("offer"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			http.HandlerFunc(messageHandler).ServeHTTP(httptest.NewRecorder(), req)
+		}(ids[0], ids[1])
+	}
+	close(start)
+	wg.Wait()
+
+	var pairings int
+	for _, message := range queuedMessages(peers[observerID]) {
+		var notice map[string]string
+		if err = json.Unmarshal([]byte(message), &notice); err == nil && notice["event"] == eventPair {
+			pairings++
+		}
+	}
+	if pairings != 1 {
+		t.Errorf("Expected a single pairing event, got %d", pairings)
+	}
+	if !peers[clientID].ConnectedWith.Has(serverID) || !peers[serverID].ConnectedWith.Has(clientID) {
+		t.Errorf("Peers should be connected with each other, got %s and %s", peers[clientID].ConnectedWith, peers[serverID].ConnectedWith)
+	}
+}
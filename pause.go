@@ -0,0 +1,84 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const pausedParamName string = "paused"
+
+// setPaused pauses or resumes delivery of queued messages to a peer
+//
+//   While a peer is paused its Unpaused channel is set, and it's
+//   closed (waking any held /wait) when the peer is resumed. Pausing
+//   closes the Paused channel, so a /wait already waiting for a
+//   message holds on to it instead
+//   Must be called with peerMutex held
+func setPaused(peer *peerInfo, paused bool) {
+	if paused && peer.Unpaused == nil {
+		peer.Unpaused = make(chan struct{})
+		if peer.Paused != nil {
+			close(peer.Paused)
+			peer.Paused = nil
+		}
+	} else if !paused && peer.Unpaused != nil {
+		close(peer.Unpaused)
+		peer.Unpaused = nil
+	}
+}
+
+// pauseChannels returns the channel closed when the peer is resumed if it's paused,
+// otherwise the channel closed when it's paused
+func pauseChannels(peer *peerInfo) (unpaused chan struct{}, paused chan struct{}) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	if peer.Unpaused != nil {
+		return peer.Unpaused, nil
+	}
+	if peer.Paused == nil {
+		peer.Paused = make(chan struct{})
+	}
+	return nil, peer.Paused
+}
+
+// pauseHandler handles requests from a peer to pause or resume delivery of its messages
+//
+//   Messages to a paused peer are still queued as normal, but /wait
+//   holds on to them until the peer is resumed
+func pauseHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	peerIDValues, peerExists := req.URL.Query()[peerIDParamName]
+	if !peerExists {
+		http.Error(res, "Missing Peer ID", http.StatusBadRequest)
+		return
+	}
+	peerID := peerIDValues[0]
+
+	paused, err := strconv.ParseBool(req.URL.Query().Get(pausedParamName))
+	if err != nil {
+		http.Error(res, "Invalid paused", http.StatusBadRequest)
+		return
+	}
+
+	peerMutex.Lock()
+	peer, exists := peers[peerID]
+	if !exists || peer == nil {
+		peerMutex.Unlock()
+		unknownPeerError(res, peerID)
+		return
+	}
+	peer.LastContact = time.Now().UTC()
+	setPaused(peer, paused)
+	fmt.Printf("pause: Peer %s paused=%t\n", peer, paused)
+	peerMutex.Unlock()
+
+	setPragmaHeader(res.Header(), peerID)
+	res.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,123 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// setPausedRequest pauses or resumes a peer through /pause
+func setPausedRequest(t *testing.T, peerID string, paused string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/pause?peer_id="+peerID+"&paused="+paused, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(pauseHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestPausedPeerReceivesAfterUnpause(t *testing.T) {
+	clientID, err := signIn(t, "client_pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(clientID)
+
+	if rr := setPausedRequest(t, clientID, "true"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if rr := sendMessage(t, serverID, clientID, "paused message"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	delivered := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		delivered <- waitForMessage(t, clientID)
+	}()
+
+	select {
+	case <-delivered:
+		t.Fatalf("Message was delivered to a paused peer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if rr := setPausedRequest(t, clientID, "false"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	select {
+	case rr := <-delivered:
+		if body := rr.Body.String(); body != "paused message" {
+			t.Errorf("Wrong message delivered after unpause: %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Message was not delivered after unpause")
+	}
+}
+
+func TestPauseHoldsMessagesForWaitInProgress(t *testing.T) {
+	clientID, err := signIn(t, "client_pausemidwait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_pausemidwait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(clientID)
+
+	delivered := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		delivered <- waitForMessage(t, clientID)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !peerWaiting(clientID) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if rr := setPausedRequest(t, clientID, "true"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if rr := sendMessage(t, serverID, clientID, "paused message"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	select {
+	case <-delivered:
+		t.Fatalf("Message was delivered to a peer paused while waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if rr := setPausedRequest(t, clientID, "false"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	select {
+	case rr := <-delivered:
+		if body := rr.Body.String(); body != "paused message" {
+			t.Errorf("Wrong message delivered after unpause: %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Message was not delivered after unpause")
+	}
+}
+
+func TestPauseFailsWithInvalidValue(t *testing.T) {
+	peerID, err := signIn(t, "client_pauseinvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerID)
+
+	if rr := setPausedRequest(t, peerID, "maybe"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusBadRequest, rr.Code)
+	}
+}
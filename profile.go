@@ -0,0 +1,72 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// limitsProfile is a preset of limits sized for a deployment
+type limitsProfile struct {
+	MaxPeers            int
+	ServerBufferSize    int
+	ClientBufferSize    int
+	MaxInFlightMessages int64
+	StaleTimeout        time.Duration
+	EnqueueTimeout      time.Duration
+}
+
+// profiles are the presets selectable with -profile
+var profiles = map[string]limitsProfile{
+	"small":  {MaxPeers: 100, ServerBufferSize: 20, ClientBufferSize: 20, MaxInFlightMessages: 1000, StaleTimeout: 30 * time.Second, EnqueueTimeout: 0},
+	"medium": {MaxPeers: 1000, ServerBufferSize: 100, ClientBufferSize: 100, MaxInFlightMessages: 10000, StaleTimeout: time.Minute, EnqueueTimeout: 100 * time.Millisecond},
+	"large":  {MaxPeers: 10000, ServerBufferSize: 500, ClientBufferSize: 200, MaxInFlightMessages: 100000, StaleTimeout: 2 * time.Minute, EnqueueTimeout: 250 * time.Millisecond},
+}
+
+// profileName is the limits preset to use (empty keeps the individual defaults)
+var profileName string
+
+// profileNames lists the available profiles
+func profileNames() string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// applyProfile sets the limits of a profile
+//
+//   Limits whose flag was given explicitly (in setFlags) are left alone,
+//   so individual flags always override the profile
+func applyProfile(name string, setFlags map[string]bool) error {
+	if name == "" {
+		return nil
+	}
+	profile, exists := profiles[name]
+	if !exists {
+		return fmt.Errorf("unknown profile %s (expected %s)", name, profileNames())
+	}
+
+	if !setFlags["max-peers"] {
+		maxPeers = profile.MaxPeers
+	}
+	if !setFlags["server-msg-buffer"] {
+		serverMessageBufferSize = profile.ServerBufferSize
+	}
+	if !setFlags["client-msg-buffer"] {
+		clientMessageBufferSize = profile.ClientBufferSize
+	}
+	if !setFlags["max-in-flight"] {
+		maxInFlightMessages = profile.MaxInFlightMessages
+	}
+	if !setFlags["stale-timeout"] {
+		staleTimeout = profile.StaleTimeout
+	}
+	if !setFlags["enqueue-timeout"] {
+		enqueueTimeout = profile.EnqueueTimeout
+	}
+	return nil
+}
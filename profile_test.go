@@ -0,0 +1,35 @@
+package gosigsrv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSmallProfileLimits(t *testing.T) {
+	defer func(previous int) { maxPeers = previous }(maxPeers)
+	defer func(previous int) { serverMessageBufferSize = previous }(serverMessageBufferSize)
+	defer func(previous int) { clientMessageBufferSize = previous }(clientMessageBufferSize)
+	defer func(previous int64) { maxInFlightMessages = previous }(maxInFlightMessages)
+	defer func(previous time.Duration) { staleTimeout = previous }(staleTimeout)
+	defer func(previous time.Duration) { enqueueTimeout = previous }(enqueueTimeout)
+
+	// As if -client-msg-buffer=7 was given along with -profile=small
+	clientMessageBufferSize = 7
+	if err := applyProfile("small", map[string]bool{"client-msg-buffer": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if maxPeers != 100 || serverMessageBufferSize != 20 || maxInFlightMessages != 1000 || staleTimeout != 30*time.Second || enqueueTimeout != 0 {
+		t.Errorf("Small profile limits are wrong: max peers %d, server buffer %d, in flight %d, stale timeout %s, enqueue timeout %s",
+			maxPeers, serverMessageBufferSize, maxInFlightMessages, staleTimeout, enqueueTimeout)
+	}
+	if clientMessageBufferSize != 7 {
+		t.Errorf("Explicit client buffer size was overridden by the profile, got %d", clientMessageBufferSize)
+	}
+}
+
+func TestUnknownProfile(t *testing.T) {
+	if err := applyProfile("huge", nil); err == nil {
+		t.Errorf("Expected an unknown profile to fail")
+	}
+}
@@ -0,0 +1,102 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is a comma separated list of ips or cidrs of the proxies in front of the server
+//
+//   Forwarding headers are only trusted from these (so from nowhere if it's empty)
+var trustedProxies string
+var trustedProxyNets []*net.IPNet
+
+// requireHTTPSProto rejects requests that a proxy didn't receive over https
+var requireHTTPSProto bool
+
+// parseTrustedProxies parses trustedProxies into trustedProxyNets
+func parseTrustedProxies() error {
+	trustedProxyNets = nil
+	for _, proxy := range strings.Split(trustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, proxyNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s: %v", proxy, err)
+		}
+		trustedProxyNets = append(trustedProxyNets, proxyNet)
+	}
+	if requireHTTPSProto && len(trustedProxyNets) == 0 {
+		return fmt.Errorf("-require-https-proto needs -trusted-proxies, or any client could claim to have used https")
+	}
+	return nil
+}
+
+// fromTrustedProxy reports whether a request came directly from a trusted proxy
+//
+//   Like forwardedClientIP, nothing is trusted when there are no trusted proxies
+func fromTrustedProxy(req *http.Request) bool {
+	return isTrustedProxy(remoteIP(req))
+}
+
+// isTrustedProxy reports whether an ip is one of the configured trusted proxies
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, proxyNet := range trustedProxyNets {
+		if proxyNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP returns the client ip a trusted proxy forwarded the request for
+//
+//   X-Forwarded-For is read from the right, skipping trusted proxies, as anything
+//   to the left of the last untrusted address could have been made up by the client.
+//   Only used when trusted proxies are configured, returns nil if there's no forwarded ip
+func forwardedClientIP(req *http.Request) net.IP {
+	if !fromTrustedProxy(req) {
+		return nil
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			return nil
+		}
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// httpsProtoMiddleware rejects requests without "X-Forwarded-Proto: https" from a trusted proxy
+//
+//   /health is let through so load balancers can check the server directly
+func httpsProtoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if requireHTTPSProto && req.URL.Path != "/health" {
+			if !fromTrustedProxy(req) || !strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") {
+				fmt.Printf("WARNING: Rejecting request for %s from %s that didn't arrive over https\n", req.URL.Path, req.RemoteAddr)
+				http.Error(res, "HTTPS required", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(res, req)
+	})
+}
@@ -0,0 +1,103 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireHTTPSProto(t *testing.T) {
+	defer func(previous bool) { requireHTTPSProto = previous }(requireHTTPSProto)
+	requireHTTPSProto = true
+	defer func(previous string) { trustedProxies = previous }(trustedProxies)
+	trustedProxies = "10.0.0.0/8"
+	if err := parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	defer parseTrustedProxies()
+
+	handler := httpsProtoMiddleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	tests := []struct {
+		remoteAddr string
+		proto      string
+		expected   int
+	}{
+		{"10.1.2.3:1234", "https", http.StatusOK},
+		{"10.1.2.3:1234", "", http.StatusForbidden},
+		{"10.1.2.3:1234", "http", http.StatusForbidden},
+		{"192.168.1.1:1234", "https", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/sign_in?client_proto", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		if test.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != test.expected {
+			t.Errorf("Request from %s with proto '%s': expected %v, got %v", test.remoteAddr, test.proto, test.expected, rr.Code)
+		}
+	}
+}
+
+func TestRequireHTTPSProtoNeedsTrustedProxies(t *testing.T) {
+	defer func(previous bool) { requireHTTPSProto = previous }(requireHTTPSProto)
+	requireHTTPSProto = true
+	defer func(previous string) { trustedProxies = previous }(trustedProxies)
+	trustedProxies = ""
+	defer parseTrustedProxies()
+
+	if err := parseTrustedProxies(); err == nil {
+		t.Errorf("Expected an error requiring https proto without trusted proxies")
+	}
+
+	requireHTTPSProto = false
+	if err := parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "/sign_in?client_proto", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.1.2.3:1234"
+	if fromTrustedProxy(req) {
+		t.Errorf("Request was trusted with no trusted proxies configured")
+	}
+}
+
+func TestClientIPFromTrustedProxy(t *testing.T) {
+	defer func(previous string) { trustedProxies = previous }(trustedProxies)
+	trustedProxies = "10.0.0.1,10.0.0.2"
+	if err := parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	defer parseTrustedProxies()
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"10.0.0.1:1234", "1.2.3.4, 5.6.7.8, 10.0.0.2", "5.6.7.8"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"192.168.1.1:1234", "5.6.7.8", "192.168.1.1"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/sign_in?client_forwarded", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := clientIP(req); ip.String() != test.expected {
+			t.Errorf("Request from %s forwarded for '%s': expected %s, got %s", test.remoteAddr, test.forwarded, test.expected, ip)
+		}
+	}
+}
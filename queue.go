@@ -0,0 +1,61 @@
+package gosigsrv
+
+import (
+	"context"
+	"time"
+)
+
+// messageQueue is a bounded queue of messages waiting for a peer to pick them up
+//
+//   Peers use a chanQueue, tests can swap in other implementations
+//   (e.g. one that never drains) to drive the backpressure paths
+type messageQueue interface {
+	// Send queues a message, waiting up to timeout for room if the queue is full.
+	//   Returns false if the queue stayed full or ctx was cancelled
+	Send(ctx context.Context, msg *peerMsg, timeout time.Duration) bool
+	// Receive returns the channel queued messages are taken from
+	Receive() <-chan *peerMsg
+	// Len is the number of queued messages
+	Len() int
+	// Cap is the number of messages the queue can hold
+	Cap() int
+}
+
+// chanQueue is a messageQueue backed by a buffered channel
+type chanQueue chan *peerMsg
+
+// newMessageQueue creates a queue for up to size messages
+func newMessageQueue(size int) messageQueue {
+	return make(chanQueue, size)
+}
+
+func (q chanQueue) Send(ctx context.Context, msg *peerMsg, timeout time.Duration) bool {
+	select {
+	case q <- msg:
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+
+	select {
+	case q <- msg:
+		return true
+	case <-time.After(timeout):
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (q chanQueue) Receive() <-chan *peerMsg {
+	return q
+}
+
+func (q chanQueue) Len() int {
+	return len(q)
+}
+
+func (q chanQueue) Cap() int {
+	return cap(q)
+}
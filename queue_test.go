@@ -0,0 +1,113 @@
+package gosigsrv
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stalledQueue is a messageQueue for a peer that never picks up its messages
+//
+//   It's always full, so every send to it fails (after waiting out any timeout)
+type stalledQueue struct {
+	size int
+}
+
+func (q stalledQueue) Send(ctx context.Context, msg *peerMsg, timeout time.Duration) bool {
+	if timeout > 0 {
+		select {
+		case <-time.After(timeout):
+		case <-ctx.Done():
+		}
+	}
+	return false
+}
+
+func (q stalledQueue) Receive() <-chan *peerMsg {
+	return nil
+}
+
+func (q stalledQueue) Len() int {
+	return q.size
+}
+
+func (q stalledQueue) Cap() int {
+	return q.size
+}
+
+// refillingQueue is a messageQueue that another sender fills a place in just before the next send
+type refillingQueue struct {
+	chanQueue
+	sender *peerMsg
+}
+
+func (q *refillingQueue) Send(ctx context.Context, msg *peerMsg, timeout time.Duration) bool {
+	if q.sender != nil && q.chanQueue.Send(ctx, q.sender, 0) {
+		messageQueued()
+		q.sender = nil
+	}
+	return q.chanQueue.Send(ctx, msg, timeout)
+}
+
+func TestRequeueCountsMessagesThatLoseTheirPlace(t *testing.T) {
+	serverID, err := signIn(t, "renderingserver_refilling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(serverID)
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	server := peers[serverID]
+	defer func(previous messageQueue) { server.Channel = previous }(server.Channel)
+	queue := &refillingQueue{chanQueue: make(chanQueue, 2)}
+	server.Channel = queue
+	queue.chanQueue <- &peerMsg{FromID: "1", Message: "candidate"}
+	messageQueued()
+	queue.sender = &peerMsg{FromID: "2", Message: "offer"}
+
+	inFlight := atomic.LoadInt64(&inFlightMessages)
+	lost := atomic.LoadInt64(&lostMessages)
+	requeueUndelivered(server, &peerMsg{FromID: "1", Message: "answer"})
+
+	if counted := atomic.LoadInt64(&lostMessages) - lost; counted != 1 {
+		t.Errorf("Expected 1 lost message, %d were counted", counted)
+	}
+	if queued := atomic.LoadInt64(&inFlightMessages) - inFlight; queued != 1 {
+		t.Errorf("Expected 1 more message in flight (re-queued, sent and lost), got %d", queued)
+	}
+	if server.Channel.Len() != 2 {
+		t.Errorf("Expected 2 queued messages, got %d", server.Channel.Len())
+	}
+	for len(queue.chanQueue) > 0 {
+		<-queue.chanQueue
+		messagesDequeued(1)
+	}
+}
+
+func TestMessageToStalledPeerRejected(t *testing.T) {
+	clientID, err := signIn(t, "client_stalledqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_stalledqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+
+	server := peers[serverID]
+	defer func(previous messageQueue) { server.Channel = previous }(server.Channel)
+	server.Channel = stalledQueue{serverMessageBufferSize}
+
+	if rr := sendMessage(t, clientID, serverID, "offer"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusServiceUnavailable, rr.Code)
+	}
+	if server.BackedUpCount != 1 {
+		t.Errorf("Backed up delivery was not counted for the breaker, got %d", server.BackedUpCount)
+	}
+}
@@ -0,0 +1,84 @@
+package gosigsrv
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple token bucket rate limiter
+type tokenBucket struct {
+	Tokens     float64
+	LastRefill time.Time
+}
+
+// take refills the bucket for the time elapsed since the last call and
+// then tries to take a single token from it
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.Tokens += now.Sub(b.LastRefill).Seconds() * rate
+	if b.Tokens > float64(burst) {
+		b.Tokens = float64(burst)
+	}
+	b.LastRefill = now
+
+	if b.Tokens < 1 {
+		return false
+	}
+	b.Tokens--
+	return true
+}
+
+// peerPair is a directed (sender, recipient) pair of peer ids
+type peerPair struct {
+	FromID string
+	ToID   string
+}
+
+// pairMessageRate is the number of messages per second one peer may send to another (0 disables the limit)
+var pairMessageRate float64
+
+// pairMessageBurst is the number of messages one peer may send to another in a burst
+var pairMessageBurst = 20
+
+var pairLimiters = make(map[peerPair]*tokenBucket)
+var pairLimiterMutex sync.Mutex
+
+// allowPairMessage reports whether fromID may send another message to toID right now
+func allowPairMessage(fromID string, toID string) bool {
+	if pairMessageRate <= 0 {
+		return true
+	}
+
+	pairLimiterMutex.Lock()
+	defer pairLimiterMutex.Unlock()
+
+	now := time.Now()
+	pair := peerPair{fromID, toID}
+	bucket, exists := pairLimiters[pair]
+	if !exists {
+		bucket = &tokenBucket{float64(pairMessageBurst), now}
+		pairLimiters[pair] = bucket
+	}
+	return bucket.take(now, pairMessageRate, pairMessageBurst)
+}
+
+// forgetPairLimits drops the rate limiting state of every pair the peer is part of
+func forgetPairLimits(peerID string) {
+	pairLimiterMutex.Lock()
+	defer pairLimiterMutex.Unlock()
+
+	for pair := range pairLimiters {
+		if pair.FromID == peerID || pair.ToID == peerID {
+			delete(pairLimiters, pair)
+		}
+	}
+}
+
+// maxMessagesPerPeer is the most messages a peer may send between signing in and signing out (0 for no limit)
+var maxMessagesPerPeer int
+
+// messageAllowanceUsed reports whether a peer has sent maxMessagesPerPeer messages since it signed in
+//
+//   Must be called with peerMutex held
+func messageAllowanceUsed(peer *peerInfo) bool {
+	return maxMessagesPerPeer > 0 && peer.MessagesSent >= maxMessagesPerPeer
+}
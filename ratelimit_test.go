@@ -0,0 +1,121 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPairRateLimitOnlyAffectsOneDirection(t *testing.T) {
+	defer func(previousRate float64, previousBurst int) {
+		pairMessageRate = previousRate
+		pairMessageBurst = previousBurst
+	}(pairMessageRate, pairMessageBurst)
+	pairMessageRate = 0.001
+	pairMessageBurst = 3
+
+	peerA, err := signIn(t, "client_flooder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_flooded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+
+	for i := 0; i < pairMessageBurst; i++ {
+		if status := sendMessage(t, peerA, peerB, "offer").Code; status != http.StatusOK {
+			t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+		}
+	}
+
+	if status := sendMessage(t, peerA, peerB, "offer").Code; status != http.StatusTooManyRequests {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusTooManyRequests, status)
+	}
+
+	if status := sendMessage(t, peerB, peerA, "answer").Code; status != http.StatusOK {
+		t.Errorf("Reverse direction was limited, expected %v, got %v", http.StatusOK, status)
+	}
+}
+
+func TestPairRateLimitForgottenOnSignOut(t *testing.T) {
+	defer func(previous float64) { pairMessageRate = previous }(pairMessageRate)
+	pairMessageRate = 1
+
+	peerA, err := signIn(t, "client_forgotten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerA)
+	peerB, err := signIn(t, "renderingserver_forgotten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, peerB)
+	sendMessage(t, peerA, peerB, "offer")
+
+	if _, exists := pairLimiters[peerPair{peerA, peerB}]; !exists {
+		t.Fatalf("No limiter was created for the pair")
+	}
+
+	if status := signOut(t, peerB).Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+
+	if _, exists := pairLimiters[peerPair{peerA, peerB}]; exists {
+		t.Errorf("Limiter for the pair was not removed")
+	}
+}
+
+func TestMessagesPerPeerCapped(t *testing.T) {
+	defer func(previous int) { maxMessagesPerPeer = previous }(maxMessagesPerPeer)
+	maxMessagesPerPeer = 3
+
+	clientID, err := signIn(t, "client_msgcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverID, err := signIn(t, "renderingserver_msgcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+
+	for i := 0; i < maxMessagesPerPeer; i++ {
+		if rr := sendMessage(t, clientID, serverID, "candidate"); rr.Code != http.StatusOK {
+			t.Fatalf("Message %d was rejected with %d", i+1, rr.Code)
+		}
+	}
+	if rr := sendMessage(t, clientID, serverID, "candidate"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusTooManyRequests, rr.Code)
+	}
+
+	// Reconnecting starts the count over
+	rr := reconnectSignIn(t, "client_msgcap", clientID, reconnectToken(clientID))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Reconnect failed with %d", rr.Code)
+	}
+	clientID = rr.Header().Get("Pragma")
+	defer signOut(t, clientID)
+	if rr := sendMessage(t, clientID, serverID, "candidate"); rr.Code != http.StatusOK {
+		t.Errorf("Message after reconnecting was rejected with %d", rr.Code)
+	}
+}
+
+func TestValidateSettingsRejectsPairBurstBelowOne(t *testing.T) {
+	defer func(previousRate float64, previousBurst int) {
+		pairMessageRate = previousRate
+		pairMessageBurst = previousBurst
+	}(pairMessageRate, pairMessageBurst)
+
+	pairMessageRate = 1
+	pairMessageBurst = 0
+	if err := validateSettings(); err == nil {
+		t.Errorf("A pair burst of 0 should be rejected with a pair rate")
+	}
+	pairMessageRate = 0
+	if err := validateSettings(); err != nil {
+		t.Errorf("The pair burst should not matter without a pair rate, got %v", err)
+	}
+}
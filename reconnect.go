@@ -0,0 +1,124 @@
+package gosigsrv
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// previousIDParamName names the id a peer had before reconnecting on /sign_in
+const previousIDParamName string = "previous_id"
+
+// reconnectTokenParamName names the token proving a reconnecting peer owned its previous id
+const reconnectTokenParamName string = "reconnect_token"
+
+// reconnectTokenHeader is set on /sign_in responses to the token the peer reconnects with
+const reconnectTokenHeader string = "X-Reconnect-Token"
+
+// replayHeader is set on /wait responses with a replayed message
+const replayHeader string = "X-Replay"
+
+// replayLastMessage delivers the last message relayed to a peer again when it resumes or reconnects
+var replayLastMessage bool
+
+// reconnectToken is the token a peer is given at sign in, to prove it owned its id when it reconnects
+//
+//   Signed with the session key, but never valid as a session cookie signature
+func reconnectToken(peerID string) string {
+	return sessionSignature("reconnect:" + peerID)
+}
+
+// reconnectingPeer returns the peer a signing in peer had been before it reconnected (or nil)
+//
+//   The request must carry the previous peer's reconnect token, and the
+//   previous peer must have the same name and kind and have been seen
+//   from the same network, so that ids can't be taken over
+//   Must be called with peerMutex held
+func reconnectingPeer(req *http.Request, peer *peerInfo) *peerInfo {
+	previousID := req.URL.Query().Get(previousIDParamName)
+	if previousID == "" || previousID == peer.ID {
+		return nil
+	}
+	token := req.URL.Query().Get(reconnectTokenParamName)
+	if !hmac.Equal([]byte(token), []byte(reconnectToken(previousID))) {
+		fmt.Printf("WARNING: Peer %s tried to take over %s without its reconnect token\n", peer, previousID)
+		return nil
+	}
+
+	previous, exists := peers[previousID]
+	if !exists || previous == nil || previous.Name != peer.Name || previous.Kind != peer.Kind {
+		return nil
+	}
+	if previous.RemoteIP != nil && peer.RemoteIP != nil && !sameNetwork(previous.RemoteIP, peer.RemoteIP) {
+		fmt.Printf("WARNING: Peer %s tried to take over %s from a different network\n", peer, previous)
+		return nil
+	}
+	return previous
+}
+
+// takeOverPeer moves a previous peer's connections and queued messages over to the peer that replaced it
+//
+//   The previous peer's partners are sent a reconnect notice with the old
+//   and new ids, so they can keep talking to the peer without re-discovering it
+//   Must be called with peerMutex held
+func takeOverPeer(previous *peerInfo, peer *peerInfo) {
+	partnerIDs := previous.ConnectedWith.IDs()
+	previous.ConnectedWith = nil
+
+	peer.LastDelivered = previous.LastDelivered
+	queueReplay(peer)
+	moveQueuedMessages(previous, peer)
+
+	fmt.Printf("reconnect - Peer %s replaces %s\n", peer, previous)
+	peerEvent(eventSignOut, previous, "")
+	removePeer(previous, "reconnect")
+
+	for _, partnerID := range partnerIDs {
+		partner, exists := peers[partnerID]
+		if !exists || partner == nil {
+			continue
+		}
+		partner.Disconnect(previous.ID)
+		partner.Connect(peer.ID)
+		peer.Connect(partner.ID)
+		notifyPeerNotice(partner, reconnectNotice, map[string]string{"old_id": previous.ID, "new_id": peer.ID})
+	}
+}
+
+// moveQueuedMessages moves every message queued for one peer over to another
+func moveQueuedMessages(from *peerInfo, to *peerInfo) {
+	for {
+		var msg *peerMsg
+		select {
+		case msg = <-from.PriorityChannel.Receive():
+		case msg = <-from.Channel.Receive():
+		default:
+			return
+		}
+		messagesDequeued(1)
+		if queueFor(to, msg).Send(context.Background(), msg, 0) {
+			messageQueued()
+		} else {
+			countEvent(&lostMessages, "lost_messages")
+			fmt.Printf("WARNING: Lost message from ID %s moving it to peer %s, no room for it\n", msg.FromID, to)
+		}
+	}
+}
+
+// queueReplay queues the last relayed message delivered to a peer again, flagged as a replay
+//
+//   So a client that lost the response can recover its signaling state
+func queueReplay(peer *peerInfo) {
+	if !replayLastMessage || peer.LastDelivered == nil {
+		return
+	}
+	replay := *peer.LastDelivered
+	replay.Replay = true
+	replay.QueuedAt = time.Now()
+	if queueFor(peer, &replay).Send(context.Background(), &replay, 0) {
+		messageQueued()
+		fmt.Printf("Replaying last message from ID %s to peer %s\n", replay.FromID, peer)
+	}
+}
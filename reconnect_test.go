@@ -0,0 +1,133 @@
+package gosigsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func reconnectSignIn(t *testing.T, name string, previousID string, token string) *httptest.ResponseRecorder {
+	query := url.Values{previousIDParamName: {previousID}, reconnectTokenParamName: {token}}
+	req, err := http.NewRequest("GET", "/sign_in?"+name+"&"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestReconnectNotifiesPartner(t *testing.T) {
+	clientID, err := signIn(t, "client_reconnect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverID, err := signIn(t, "renderingserver_reconnect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	if rr := sendMessage(t, clientID, serverID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	discardMessages(serverID)
+
+	rr := reconnectSignIn(t, "client_reconnect", clientID, reconnectToken(clientID))
+	newID := rr.Header().Get("Pragma")
+	defer signOut(t, newID)
+
+	if _, exists := peers[clientID]; exists {
+		t.Errorf("Previous peer %s was not replaced", clientID)
+	}
+	if !peers[serverID].ConnectedWith.Has(newID) {
+		t.Errorf("Partner is connected with %s instead of the new id %s", peers[serverID].ConnectedWith, newID)
+	}
+
+	var notice map[string]string
+	if err = json.Unmarshal(waitForMessage(t, serverID).Body.Bytes(), &notice); err != nil {
+		t.Fatal(err)
+	}
+	if notice["type"] != reconnectNotice || notice["old_id"] != clientID || notice["new_id"] != newID {
+		t.Errorf("Partner got the wrong notice: %v", notice)
+	}
+}
+
+func TestReconnectRequiresSameName(t *testing.T) {
+	clientID, err := signIn(t, "client_reconnectA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+
+	rr := reconnectSignIn(t, "client_reconnectB", clientID, reconnectToken(clientID))
+	defer signOut(t, rr.Header().Get("Pragma"))
+
+	if _, exists := peers[clientID]; !exists {
+		t.Errorf("Peer %s was taken over by a peer with a different name", clientID)
+	}
+}
+
+func TestReconnectReplaysLastMessage(t *testing.T) {
+	defer func(previous bool) { replayLastMessage = previous }(replayLastMessage)
+	replayLastMessage = true
+
+	clientID, err := signIn(t, "client_replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverID, err := signIn(t, "renderingserver_replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(clientID)
+
+	if rr := sendMessage(t, serverID, clientID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if rr := waitForMessage(t, clientID); rr.Body.String() != "offer" || rr.Header().Get(replayHeader) != "" {
+		t.Fatalf("Expected the offer to be delivered normally, got %q (%s: %s)", rr.Body.String(), replayHeader, rr.Header().Get(replayHeader))
+	}
+
+	rr := reconnectSignIn(t, "client_replay", clientID, reconnectToken(clientID))
+	newID := rr.Header().Get("Pragma")
+	defer signOut(t, newID)
+
+	rr = waitForMessage(t, newID)
+	if rr.Body.String() != "offer" || rr.Header().Get(replayHeader) != "true" {
+		t.Errorf("Expected the offer to be replayed, got %q (%s: %s)", rr.Body.String(), replayHeader, rr.Header().Get(replayHeader))
+	}
+	if pragma := rr.Header().Get("Pragma"); pragma != serverID {
+		t.Errorf("Replay Pragma (%s) should be the original sender's id (%s)", pragma, serverID)
+	}
+}
+
+func TestReconnectRequiresToken(t *testing.T) {
+	req, err := http.NewRequest("GET", "/sign_in?client_reconnect_token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+	clientID := rr.Header().Get("Pragma")
+	token := rr.Header().Get(reconnectTokenHeader)
+	if token == "" {
+		t.Fatalf("Sign in did not return a reconnect token")
+	}
+
+	for _, wrongToken := range []string{"", reconnectToken(clientID + "0"), sessionSignature(clientID)} {
+		rr = reconnectSignIn(t, "client_reconnect_token", clientID, wrongToken)
+		signOut(t, rr.Header().Get("Pragma"))
+		if _, exists := peers[clientID]; !exists {
+			t.Fatalf("Peer %s was taken over with the token %q", clientID, wrongToken)
+		}
+	}
+
+	rr = reconnectSignIn(t, "client_reconnect_token", clientID, token)
+	defer signOut(t, rr.Header().Get("Pragma"))
+	if _, exists := peers[clientID]; exists {
+		t.Errorf("Peer %s was not taken over with its reconnect token", clientID)
+	}
+}
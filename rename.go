@@ -0,0 +1,48 @@
+package gosigsrv
+
+import (
+	"time"
+)
+
+// renameDebounce is how long after a rename other peers are told about it, so a burst of renames is sent as one (0 to send each right away)
+var renameDebounce time.Duration
+
+// notifyRenamed sends a peer's info line with its current name to every peer that can discover it
+//
+//   Must be called with peerMutex held
+func notifyRenamed(peer *peerInfo) {
+	peerInfoString := peer.InfoString()
+	for _, pInfo := range peers {
+		if pInfo != nil && canDiscover(pInfo, peer) {
+			notifyPeerInfo(pInfo, peer, peerInfoString)
+		}
+	}
+}
+
+// scheduleRenameNotification tells other peers about a peer's new name once it hasn't been renamed for renameDebounce
+//
+//   Each rename pushes the notification back, and only the name the peer
+//   ends up with is sent. Must be called with peerMutex held
+func scheduleRenameNotification(peer *peerInfo) {
+	if peer.RenameTimer != nil {
+		peer.RenameTimer.Stop()
+		peer.RenameTimer = nil
+	}
+	if renameDebounce <= 0 {
+		notifyRenamed(peer)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(renameDebounce, func() {
+		peerMutex.Lock()
+		defer peerMutex.Unlock()
+		// Renamed again (or signed out) since this was scheduled
+		if peer.RenameTimer != timer || peers[peer.ID] != peer {
+			return
+		}
+		peer.RenameTimer = nil
+		notifyRenamed(peer)
+	})
+	peer.RenameTimer = timer
+}
@@ -0,0 +1,55 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRapidRenamesSendOneNotification(t *testing.T) {
+	defer func(previous time.Duration) { renameDebounce = previous }(renameDebounce)
+	renameDebounce = 50 * time.Millisecond
+
+	serverID, err := signIn(t, "renderingserver_rapidrename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	clientID, err := signIn(t, "client_rapidrename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	discardMessages(serverID)
+
+	for _, name := range []string{"renderingserver_rapidrename1", "renderingserver_rapidrename2"} {
+		queryParams := make(url.Values)
+		queryParams.Add("peer_id", serverID)
+		queryParams.Add("name", name)
+		req, err := http.NewRequest("GET", "/rename?"+queryParams.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		renameHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Rename to %s failed with %d", name, rr.Code)
+		}
+	}
+
+	rr := waitForMessage(t, clientID)
+	expectedMessage := "renderingserver_rapidrename2," + serverID + ",1\n"
+	if message := rr.Body.String(); message != expectedMessage {
+		t.Errorf("Rename notification was (%s) expected (%s)", message, expectedMessage)
+	}
+
+	time.Sleep(3 * renameDebounce)
+	peerMutex.Lock()
+	messages := queuedMessages(peers[clientID])
+	peerMutex.Unlock()
+	if len(messages) != 0 {
+		t.Errorf("Partner got more rename notifications: %q", messages)
+	}
+}
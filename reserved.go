@@ -0,0 +1,76 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reservedIDTTL is how long the id of a reaped peer is kept from being given to a new peer (0 disables it)
+var reservedIDTTL = time.Minute
+
+var reservedIDs = make(map[string]time.Time)
+var reservedIDMutex sync.Mutex
+
+// reservePeerID keeps a peer id from being reused until reservedIDTTL has passed
+func reservePeerID(peerID string) {
+	if reservedIDTTL <= 0 {
+		return
+	}
+
+	reservedIDMutex.Lock()
+	defer reservedIDMutex.Unlock()
+	reservedIDs[peerID] = time.Now().Add(reservedIDTTL)
+}
+
+// isReservedPeerID reports whether a peer id belongs to a recently reaped peer
+func isReservedPeerID(peerID string) bool {
+	reservedIDMutex.Lock()
+	defer reservedIDMutex.Unlock()
+
+	expires, reserved := reservedIDs[peerID]
+	if reserved && time.Now().After(expires) {
+		delete(reservedIDs, peerID)
+		return false
+	}
+	return reserved
+}
+
+// expireReservedPeerIDs forgets reservations that have run out
+func expireReservedPeerIDs() {
+	reservedIDMutex.Lock()
+	defer reservedIDMutex.Unlock()
+
+	now := time.Now()
+	for peerID, expires := range reservedIDs {
+		if now.After(expires) {
+			delete(reservedIDs, peerID)
+		}
+	}
+}
+
+// reapPeer removes a peer the server gave up on and reserves its id
+//
+//   A client still using the id gets a 410 instead of reaching a new peer that was given the same id
+func reapPeer(peer *peerInfo, reason string) {
+	peerEvent(eventReap, peer, peer.ConnectedWith.String())
+	removePeer(peer, reason)
+	reservePeerID(peer.ID)
+}
+
+// unknownPeerError responds to a request for a peer that doesn't exist
+//
+//   Ids of recently reaped peers get a 410, as do peers signed out with
+//   their room (with the room closed notice they missed), anything else a 400
+func unknownPeerError(res http.ResponseWriter, peerID string) {
+	if room, closed := takeClosedRoom(peerID); closed {
+		writeJSON(res, http.StatusGone, map[string]string{"type": roomClosedNotice, "room": room})
+		return
+	}
+	if isReservedPeerID(peerID) {
+		http.Error(res, fmt.Sprintf("Peer %s was removed", peerID), http.StatusGone)
+		return
+	}
+	http.Error(res, "Unknown peer", http.StatusBadRequest)
+}
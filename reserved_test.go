@@ -0,0 +1,44 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReapedPeerIDReserved(t *testing.T) {
+	peerID, err := signIn(t, "client_reserved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers[peerID].LastContact = time.Now().UTC().Add(-2 * staleTimeout)
+	removeStalePeers()
+	if _, exists := peers[peerID]; exists {
+		t.Fatalf("Stale peer %s was not reaped", peerID)
+	}
+
+	if rr := waitForMessage(t, peerID); rr.Code != http.StatusGone {
+		t.Errorf("Recieved wrong status code for a reaped peer expected %v, got %v", http.StatusGone, rr.Code)
+	}
+
+	// Make the reaped peer's id the next one handed out
+	peerMutex.Lock()
+	previousCount := peerIDCount
+	peerIDCount--
+	peerMutex.Unlock()
+
+	newID, err := signIn(t, "client_reserved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, newID)
+	if newID == peerID {
+		t.Errorf("Reaped peer id %s was given to a new peer", peerID)
+	}
+
+	peerMutex.Lock()
+	if peerIDCount < previousCount {
+		peerIDCount = previousCount
+	}
+	peerMutex.Unlock()
+}
@@ -0,0 +1,138 @@
+// Package gosigsrv is a signaling server for WebRTC peers
+//
+//   The server keeps its peers and settings in package level state, so
+//   every Server in a process shares the same peers and configuration
+//   (the Settings of the last Server created).
+//   The gosigsrv command (cmd/gosigsrv) is a thin wrapper around Main
+package gosigsrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Config is how a Server is set up
+type Config struct {
+	// Addr is the address Run listens on when there's no Listener
+	Addr string
+
+	// Listener is served on by Run instead of listening on Addr (if set)
+	Listener net.Listener
+
+	// Settings are the server's limits, timeouts and features (start from DefaultSettings)
+	//
+	//   Nil keeps the settings in effect, e.g. the ones Main set from the flags
+	Settings *Settings
+}
+
+// Server is the signaling server, for mounting on another mux with
+// Handler or running standalone with Run (Main is a thin wrapper around one)
+//
+//   Peers are kept in the package level peer map and the settings in
+//   package level variables, so every Server in a process shares the
+//   same peers and (apart from its Addr and Listener) the same configuration
+type Server struct {
+	config  Config
+	handler http.Handler
+}
+
+// NewServer creates a server with every route registered on its own mux
+//
+//   The config's Settings (if any) are checked and put into effect first.
+//   Invalid settings are an error, and leave the settings in effect as they were
+func NewServer(config Config) (*Server, error) {
+	if config.Settings != nil {
+		previous := currentSettings()
+		config.Settings.apply()
+		if err := validateSettings(); err != nil {
+			previous.apply()
+			validateSettings()
+			return nil, err
+		}
+	} else if err := validateSettings(); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	return &Server{
+		config:  config,
+		handler: accessLogMiddleware(httpsProtoMiddleware(traceMiddleware(gzipMiddleware(routeNormalizingMiddleware(mux))))),
+	}, nil
+}
+
+// Handler returns the handler serving all of the server's routes
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Run serves until ctx is done and then shuts down gracefully (see shutdownServer)
+//
+//   The peer cleanup routine (and the statsd and slow waiter routines if
+//   enabled) run until Run returns. Returns nil after a clean shut down
+func (s *Server) Run(ctx context.Context) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go peerCleanupRoutine(stop)
+	if statsdAddr != "" {
+		go statsdRoutine(statsdAddr, statsdInterval, stop)
+	}
+	if slowWaiterInterval > 0 {
+		go slowWaiterRoutine(stop)
+	}
+
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv := newHTTPServer(requestCtx, s.config.Addr, s.handler)
+
+	shutdownDone := make(chan error, 1)
+	served := make(chan struct{})
+	defer close(served)
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownDone <- shutdownServer(srv, cancelRequests)
+		case <-served:
+		}
+	}()
+
+	var err error
+	if tlsEnabled() {
+		srv.TLSConfig, err = newTLSConfig()
+		if err != nil {
+			return err
+		}
+		if httpRedirectPort != "" {
+			defer serveHTTPSRedirects(s.port()).Close()
+		}
+		if s.config.Listener != nil {
+			err = srv.ServeTLS(s.config.Listener, tlsCertFile, tlsKeyFile)
+		} else {
+			err = srv.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+		}
+	} else if s.config.Listener != nil {
+		err = srv.Serve(s.config.Listener)
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	if err == http.ErrServerClosed {
+		return <-shutdownDone
+	}
+	return err
+}
+
+// port returns the port the server listens on (for redirecting http to)
+func (s *Server) port() string {
+	addr := s.config.Addr
+	if s.config.Listener != nil {
+		addr = s.config.Listener.Addr().String()
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return port
+	}
+	fmt.Printf("WARNING: Could not tell the port of %s\n", addr)
+	return ""
+}
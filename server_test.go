@@ -0,0 +1,111 @@
+package gosigsrv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, config Config) *Server {
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestServerHandlerThroughHTTPTest(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(t, Config{}).Handler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/sign_in?client_embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, res.StatusCode)
+	}
+	peerID := res.Header.Get("Pragma")
+	defer signOut(t, peerID)
+	if _, exists := peers[peerID]; !exists {
+		t.Errorf("Peer signed in through the server's handler was not added")
+	}
+
+	res, err = http.Get(ts.URL + "/Health/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Routes should be normalized by the server's handler, got %v", res.StatusCode)
+	}
+}
+
+func TestServerRunStopsWithContext(t *testing.T) {
+	defer func(previous time.Duration) { shutdownDrainTimeout = previous }(shutdownDrainTimeout)
+	shutdownDrainTimeout = 100 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan error, 1)
+	server := newTestServer(t, Config{Listener: listener})
+	go func() { runDone <- server.Run(ctx) }()
+
+	res, err := http.Get("http://" + listener.Addr().String() + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusOK, res.StatusCode)
+	}
+
+	cancel()
+	select {
+	case err = <-runDone:
+		if err != nil {
+			t.Errorf("Run should shut down cleanly, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after its context was cancelled")
+	}
+}
+
+func TestH2CRequestToHealth(t *testing.T) {
+	defer func(previous bool) { h2c = previous }(h2c)
+	h2c = true
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(context.Background(), "", newTestServer(t, Config{}).Handler())
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("http://" + listener.Addr().String() + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+			t.Fatalf("Expected a 200 over http/2, got %d over %s", res.StatusCode, res.Proto)
+		}
+		if connection := res.Header.Get("Connection"); connection != "" {
+			t.Errorf("Connection header (%s) was sent over http/2", connection)
+		}
+	}
+}
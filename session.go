@@ -0,0 +1,97 @@
+package gosigsrv
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// sessionCookieName is the name of the cookie peers are resumed with
+const sessionCookieName string = "gosigsrv_session"
+
+// sessionCookies makes sign in set a session cookie that resumes the same peer on a later sign in
+var sessionCookies bool
+
+// sessionSecret is the key session cookies are signed with (empty uses a random key)
+var sessionSecret string
+
+// sessionOrigins is a comma separated list of the origins allowed to make cross
+// origin requests with the session cookie
+//
+//   Any other origin only gets a * origin, which browsers never send cookies to
+var sessionOrigins string
+
+// credentialedOrigin reports whether cross origin requests from origin may carry the session cookie
+func credentialedOrigin(origin string) bool {
+	if !sessionCookies || origin == "" {
+		return false
+	}
+	for _, allowed := range strings.Split(sessionOrigins, ",") {
+		if strings.TrimSpace(allowed) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// randomSessionKey signs session cookies when no secret is configured,
+//
+//   so sessions don't survive a restart
+var randomSessionKey = randomSessionSecret()
+
+func randomSessionSecret() string {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(secret)
+}
+
+// sessionSignature returns the signature of a peer id for its session cookie
+func sessionSignature(peerID string) string {
+	key := sessionSecret
+	if key == "" {
+		key = randomSessionKey
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(peerID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setSessionCookie sets a signed session cookie for the peer
+func setSessionCookie(res http.ResponseWriter, req *http.Request, peerID string) {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    peerID + "." + sessionSignature(peerID),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	// Cross site (CORS) requests only send cookies that are SameSite=None, which must be Secure
+	if req.TLS != nil {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(res, cookie)
+}
+
+// sessionPeerID returns the peer id from a request's session cookie if it has a valid one
+func sessionPeerID(req *http.Request) (string, bool) {
+	cookie, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	separator := strings.LastIndex(cookie.Value, ".")
+	if separator < 0 {
+		return "", false
+	}
+	peerID, signature := cookie.Value[:separator], cookie.Value[separator+1:]
+	if !hmac.Equal([]byte(signature), []byte(sessionSignature(peerID))) {
+		return "", false
+	}
+	return peerID, true
+}
@@ -0,0 +1,117 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sessionSignIn signs in with the given cookies and returns the peer id and response
+func sessionSignIn(t *testing.T, peername string, cookies []*http.Cookie) (string, *httptest.ResponseRecorder) {
+	req, err := http.NewRequest("GET", "/sign_in?"+peername, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(signinHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Sign in failed with status %d", rr.Code)
+	}
+	return rr.Header().Get("Pragma"), rr
+}
+
+func TestSessionCookieResumesPeer(t *testing.T) {
+	defer func(previous bool) { sessionCookies = previous }(sessionCookies)
+	sessionCookies = true
+
+	peerID, rr := sessionSignIn(t, "sessionpeer", nil)
+	defer signOut(t, peerID)
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly session cookie, got %v", cookies)
+	}
+
+	resumedID, _ := sessionSignIn(t, "sessionpeer-renamed", cookies)
+	if resumedID != peerID {
+		t.Errorf("Expected to resume peer %s, got %s", peerID, resumedID)
+	}
+	if peers[peerID].Name != "sessionpeer-renamed" {
+		t.Errorf("Expected the resumed peer to take the new name, got %s", peers[peerID].Name)
+	}
+}
+
+func TestSessionCookieForged(t *testing.T) {
+	defer func(previous bool) { sessionCookies = previous }(sessionCookies)
+	sessionCookies = true
+
+	peerID, _ := sessionSignIn(t, "sessionpeer", nil)
+	defer signOut(t, peerID)
+
+	forged := &http.Cookie{Name: sessionCookieName, Value: peerID + ".0123"}
+	otherID, _ := sessionSignIn(t, "sessionpeer", []*http.Cookie{forged})
+	defer signOut(t, otherID)
+	if otherID == peerID {
+		t.Errorf("Expected a forged cookie to get a new peer")
+	}
+}
+
+func TestPeerNeverNotifiedAboutItself(t *testing.T) {
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+	defer func(previous bool) { sessionCookies = previous }(sessionCookies)
+	sessionCookies = true
+	defer func(previous string) { discoveryMode = previous }(discoveryMode)
+	discoveryMode = discoverAllPeers
+
+	peerID, rr := sessionSignIn(t, "client_selfA", nil)
+	otherID, _ := sessionSignIn(t, "client_selfB", nil)
+	if resumedID, _ := sessionSignIn(t, "client_selfA", rr.Result().Cookies()); resumedID != peerID {
+		t.Fatalf("Expected to resume peer %s, got %s", peerID, resumedID)
+	}
+	newID, _ := sessionSignIn(t, "client_selfB&previous_id="+otherID+"&reconnect_token="+reconnectToken(otherID), nil)
+	if newID == otherID {
+		t.Fatalf("Expected a reconnecting peer to get a new id")
+	}
+
+	notifyPeerInfo(peers[peerID], peers[peerID], peers[peerID].InfoString())
+
+	for _, id := range []string{peerID, newID} {
+		own := "," + id + ","
+		for _, message := range queuedMessages(peers[id]) {
+			if strings.Contains(message, own) {
+				t.Errorf("Peer %s was notified about itself: %q", id, message)
+			}
+		}
+	}
+}
+
+func TestSessionOriginsAllowCredentials(t *testing.T) {
+	defer func(previous bool) { sessionCookies = previous }(sessionCookies)
+	defer func(previous string) { sessionOrigins = previous }(sessionOrigins)
+	sessionOrigins = "https://app.example.com"
+
+	tests := []struct {
+		sessionCookies bool
+		origin         string
+		allowOrigin    string
+		credentials    string
+	}{
+		{true, "https://app.example.com", "https://app.example.com", "true"},
+		{true, "https://evil.example.com", "*", ""},
+		{false, "https://app.example.com", "*", ""},
+	}
+	for _, test := range tests {
+		sessionCookies = test.sessionCookies
+		header := make(http.Header)
+		addCorsHeaders(header, test.origin)
+		if header.Get("Access-Control-Allow-Origin") != test.allowOrigin || header.Get("Access-Control-Allow-Credentials") != test.credentials {
+			t.Errorf("Origin %s with session cookies %t: expected %s (credentials %q), got %s (credentials %q)", test.origin, test.sessionCookies,
+				test.allowOrigin, test.credentials, header.Get("Access-Control-Allow-Origin"), header.Get("Access-Control-Allow-Credentials"))
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"time"
+)
+
+// Settings are the limits, timeouts and features the command line flags set
+//
+//   Each field is the setting of the flag in its comment (see the README).
+//   Start from DefaultSettings, as the zero value turns off limits the
+//   server has by default. Settings that only the gosigsrv command uses
+//   (-addr, -profile, -state-file, -audit-file and the access log buffer)
+//   aren't included
+type Settings struct {
+	MaxInFlightMessages     int64         // -max-in-flight
+	StrictRoutes            bool          // -strict-routes
+	PairMessageRate         float64       // -pair-rate
+	PairMessageBurst        int           // -pair-burst
+	NotifyUndelivered       bool          // -notify-undelivered
+	MaxHeaderBytes          int           // -max-header-bytes
+	MaxFailedSends          int           // -max-failed-sends
+	ShutdownReconnectHint   time.Duration // -shutdown-reconnect-hint
+	ShutdownDrainTimeout    time.Duration // -shutdown-drain-timeout
+	MaxListedPeers          int           // -max-listed-peers
+	DiscoveryMode           string        // -discovery
+	TLSCertFile             string        // -tls-cert
+	TLSKeyFile              string        // -tls-key
+	HTTPRedirectPort        string        // -http-redirect-port
+	CleanupInterval         time.Duration // -cleanup-interval
+	StaleTimeout            time.Duration // -stale-timeout
+	ReportAvailability      bool          // -report-availability
+	MaxPeerLifetime         time.Duration // -max-peer-lifetime
+	AdminToken              string        // -admin-token
+	ServerMessageBufferSize int           // -server-msg-buffer
+	ClientMessageBufferSize int           // -client-msg-buffer
+	StrictContentEncoding   bool          // -strict-content-encoding
+	BreakerThreshold        int           // -breaker-threshold
+	BreakerWindow           time.Duration // -breaker-window
+	EnqueueTimeout          time.Duration // -enqueue-timeout
+	CORSExcludedRoutes      string        // -cors-exclude
+	TLSMinVersion           string        // -tls-min-version
+	TLSCipherSuites         string        // -tls-ciphers
+	SessionCookies          bool          // -session-cookies
+	SessionSecret           string        // -session-secret
+	LowercaseRooms          bool          // -lowercase-rooms
+	RequireRoom             bool          // -require-room
+	FIFOPairing             bool          // -fifo-pairing
+	TrustedProxies          string        // -trusted-proxies
+	RequireHTTPSProto       bool          // -require-https-proto
+	MaxNamesPerIP           int           // -max-names-per-ip
+	AccessLogFormat         string        // -access-log-format
+	ReservedIDTTL           time.Duration // -reserved-id-ttl
+	MessageReadTimeout      time.Duration // -message-read-timeout
+	NameAllowlist           []string      // -name-allowlist
+	MaxPeers                int           // -max-peers
+	KeepAlive               bool          // -keepalive
+	StatsdAddr              string        // -statsd-addr
+	StatsdPrefix            string        // -statsd-prefix
+	StatsdInterval          time.Duration // -statsd-interval
+	ExtraHeaders            string        // -extra-headers
+	ServeTestPage           bool          // -serve-testpage
+	SlowWaiterInterval      time.Duration // -slow-waiter-interval
+	SlowWaiterThreshold     time.Duration // -slow-waiter-threshold
+	SlowWaiterCount         int           // -slow-waiter-count
+	MaxPartners             int           // -max-partners
+	RejectBusy              bool          // -reject-busy
+	MaxRoomsPerName         int           // -max-rooms-per-name
+	PresenceMaxAge          time.Duration // -presence-max-age
+	IDBytes                 int           // -id-bytes
+	IDEncoding              string        // -id-encoding
+	ReplayLastMessage       bool          // -replay-last-message
+	StrictPeerIDs           bool          // -strict-peer-ids
+	MaxConcurrentSignIns    int64         // -max-concurrent-signins
+	MaxDecodedMessageBytes  int64         // -max-decoded-message-bytes
+	SessionOrigins          string        // -session-origins
+	GzipResponses           bool          // -gzip-responses
+	GzipMinBytes            int           // -gzip-min-bytes
+	HealthChecks            bool          // -health-checks
+	RenameDebounce          time.Duration // -rename-debounce
+	Matcher                 string        // -matcher
+	SignOutGrace            time.Duration // -sign-out-grace
+	MaxQueryParams          int           // -max-query-params
+	MaxQueryLength          int           // -max-query-length
+	MaxSignInNotifications  int           // -max-signin-notifications
+	SignInNotificationDelay time.Duration // -signin-notification-delay
+	MaxMessagesPerPeer      int           // -max-messages-per-peer
+	InactivityWarning       time.Duration // -inactivity-warning
+	H2C                     bool          // -h2c
+	Websocket               bool          // -websocket
+	ClientStaleTimeout      time.Duration // -client-stale-timeout
+	ServerStaleTimeout      time.Duration // -server-stale-timeout
+	WaitTakeover            bool          // -wait-takeover
+}
+
+// defaultSettings are the settings before any flags (or Configs) change them
+var defaultSettings = currentSettings()
+
+// DefaultSettings returns the settings the flags default to
+func DefaultSettings() Settings {
+	settings := defaultSettings
+	settings.NameAllowlist = append([]string(nil), defaultSettings.NameAllowlist...)
+	return settings
+}
+
+// currentSettings returns the settings in effect
+func currentSettings() Settings {
+	return Settings{
+		MaxInFlightMessages:     maxInFlightMessages,
+		StrictRoutes:            strictRoutes,
+		PairMessageRate:         pairMessageRate,
+		PairMessageBurst:        pairMessageBurst,
+		NotifyUndelivered:       notifyUndelivered,
+		MaxHeaderBytes:          maxHeaderBytes,
+		MaxFailedSends:          maxFailedSends,
+		ShutdownReconnectHint:   shutdownReconnectHint,
+		ShutdownDrainTimeout:    shutdownDrainTimeout,
+		MaxListedPeers:          maxListedPeers,
+		DiscoveryMode:           discoveryMode,
+		TLSCertFile:             tlsCertFile,
+		TLSKeyFile:              tlsKeyFile,
+		HTTPRedirectPort:        httpRedirectPort,
+		CleanupInterval:         cleanupInterval,
+		StaleTimeout:            staleTimeout,
+		ReportAvailability:      reportAvailability,
+		MaxPeerLifetime:         maxPeerLifetime,
+		AdminToken:              adminToken,
+		ServerMessageBufferSize: serverMessageBufferSize,
+		ClientMessageBufferSize: clientMessageBufferSize,
+		StrictContentEncoding:   strictContentEncoding,
+		BreakerThreshold:        breakerThreshold,
+		BreakerWindow:           breakerWindow,
+		EnqueueTimeout:          enqueueTimeout,
+		CORSExcludedRoutes:      corsExcludedRoutes,
+		TLSMinVersion:           tlsMinVersion,
+		TLSCipherSuites:         tlsCipherSuites,
+		SessionCookies:          sessionCookies,
+		SessionSecret:           sessionSecret,
+		LowercaseRooms:          lowercaseRooms,
+		RequireRoom:             requireRoom,
+		FIFOPairing:             fifoPairing,
+		TrustedProxies:          trustedProxies,
+		RequireHTTPSProto:       requireHTTPSProto,
+		MaxNamesPerIP:           maxNamesPerIP,
+		AccessLogFormat:         accessLogFormat,
+		ReservedIDTTL:           reservedIDTTL,
+		MessageReadTimeout:      messageReadTimeout,
+		NameAllowlist:           append([]string(nil), nameAllowlistPatterns...),
+		MaxPeers:                maxPeers,
+		KeepAlive:               keepAlive,
+		StatsdAddr:              statsdAddr,
+		StatsdPrefix:            statsdPrefix,
+		StatsdInterval:          statsdInterval,
+		ExtraHeaders:            extraHeaderList,
+		ServeTestPage:           serveTestPage,
+		SlowWaiterInterval:      slowWaiterInterval,
+		SlowWaiterThreshold:     slowWaiterThreshold,
+		SlowWaiterCount:         slowWaiterCount,
+		MaxPartners:             maxPartners,
+		RejectBusy:              rejectBusy,
+		MaxRoomsPerName:         maxRoomsPerName,
+		PresenceMaxAge:          presenceMaxAge,
+		IDBytes:                 idBytes,
+		IDEncoding:              idEncoding,
+		ReplayLastMessage:       replayLastMessage,
+		StrictPeerIDs:           strictPeerIDs,
+		MaxConcurrentSignIns:    maxConcurrentSignIns,
+		MaxDecodedMessageBytes:  maxDecodedMessageBytes,
+		SessionOrigins:          sessionOrigins,
+		GzipResponses:           gzipResponses,
+		GzipMinBytes:            gzipMinBytes,
+		HealthChecks:            healthChecks,
+		RenameDebounce:          renameDebounce,
+		Matcher:                 matcherName,
+		SignOutGrace:            signOutGrace,
+		MaxQueryParams:          maxQueryParams,
+		MaxQueryLength:          maxQueryLength,
+		MaxSignInNotifications:  maxSignInNotifications,
+		SignInNotificationDelay: signInNotificationDelay,
+		MaxMessagesPerPeer:      maxMessagesPerPeer,
+		InactivityWarning:       inactivityWarning,
+		H2C:                     h2c,
+		Websocket:               websocketEnabled,
+		ClientStaleTimeout:      clientStaleTimeout,
+		ServerStaleTimeout:      serverStaleTimeout,
+		WaitTakeover:            waitTakeover,
+	}
+}
+
+// apply makes the settings the ones in effect
+func (s Settings) apply() {
+	maxInFlightMessages = s.MaxInFlightMessages
+	strictRoutes = s.StrictRoutes
+	pairMessageRate = s.PairMessageRate
+	pairMessageBurst = s.PairMessageBurst
+	notifyUndelivered = s.NotifyUndelivered
+	maxHeaderBytes = s.MaxHeaderBytes
+	maxFailedSends = s.MaxFailedSends
+	shutdownReconnectHint = s.ShutdownReconnectHint
+	shutdownDrainTimeout = s.ShutdownDrainTimeout
+	maxListedPeers = s.MaxListedPeers
+	discoveryMode = s.DiscoveryMode
+	tlsCertFile = s.TLSCertFile
+	tlsKeyFile = s.TLSKeyFile
+	httpRedirectPort = s.HTTPRedirectPort
+	cleanupInterval = s.CleanupInterval
+	staleTimeout = s.StaleTimeout
+	reportAvailability = s.ReportAvailability
+	maxPeerLifetime = s.MaxPeerLifetime
+	adminToken = s.AdminToken
+	serverMessageBufferSize = s.ServerMessageBufferSize
+	clientMessageBufferSize = s.ClientMessageBufferSize
+	strictContentEncoding = s.StrictContentEncoding
+	breakerThreshold = s.BreakerThreshold
+	breakerWindow = s.BreakerWindow
+	enqueueTimeout = s.EnqueueTimeout
+	corsExcludedRoutes = s.CORSExcludedRoutes
+	tlsMinVersion = s.TLSMinVersion
+	tlsCipherSuites = s.TLSCipherSuites
+	sessionCookies = s.SessionCookies
+	sessionSecret = s.SessionSecret
+	lowercaseRooms = s.LowercaseRooms
+	requireRoom = s.RequireRoom
+	fifoPairing = s.FIFOPairing
+	trustedProxies = s.TrustedProxies
+	requireHTTPSProto = s.RequireHTTPSProto
+	maxNamesPerIP = s.MaxNamesPerIP
+	accessLogFormat = s.AccessLogFormat
+	reservedIDTTL = s.ReservedIDTTL
+	messageReadTimeout = s.MessageReadTimeout
+	nameAllowlistPatterns = append([]string(nil), s.NameAllowlist...)
+	maxPeers = s.MaxPeers
+	keepAlive = s.KeepAlive
+	statsdAddr = s.StatsdAddr
+	statsdPrefix = s.StatsdPrefix
+	statsdInterval = s.StatsdInterval
+	extraHeaderList = s.ExtraHeaders
+	serveTestPage = s.ServeTestPage
+	slowWaiterInterval = s.SlowWaiterInterval
+	slowWaiterThreshold = s.SlowWaiterThreshold
+	slowWaiterCount = s.SlowWaiterCount
+	maxPartners = s.MaxPartners
+	rejectBusy = s.RejectBusy
+	maxRoomsPerName = s.MaxRoomsPerName
+	presenceMaxAge = s.PresenceMaxAge
+	idBytes = s.IDBytes
+	idEncoding = s.IDEncoding
+	replayLastMessage = s.ReplayLastMessage
+	strictPeerIDs = s.StrictPeerIDs
+	maxConcurrentSignIns = s.MaxConcurrentSignIns
+	maxDecodedMessageBytes = s.MaxDecodedMessageBytes
+	sessionOrigins = s.SessionOrigins
+	gzipResponses = s.GzipResponses
+	gzipMinBytes = s.GzipMinBytes
+	healthChecks = s.HealthChecks
+	renameDebounce = s.RenameDebounce
+	matcherName = s.Matcher
+	signOutGrace = s.SignOutGrace
+	maxQueryParams = s.MaxQueryParams
+	maxQueryLength = s.MaxQueryLength
+	maxSignInNotifications = s.MaxSignInNotifications
+	signInNotificationDelay = s.SignInNotificationDelay
+	maxMessagesPerPeer = s.MaxMessagesPerPeer
+	inactivityWarning = s.InactivityWarning
+	h2c = s.H2C
+	websocketEnabled = s.Websocket
+	clientStaleTimeout = s.ClientStaleTimeout
+	serverStaleTimeout = s.ServerStaleTimeout
+	waitTakeover = s.WaitTakeover
+}
+
+// validateSettings checks the settings in effect, and prepares the ones that are parsed (headers, proxies, patterns)
+//
+//   Catches settings that would otherwise only fail once the server is running
+func validateSettings() error {
+	if serverMessageBufferSize < 1 || clientMessageBufferSize < 1 {
+		return fmt.Errorf("message buffers must hold at least 1 message, got %d (server) and %d (client)", serverMessageBufferSize, clientMessageBufferSize)
+	}
+	if discoveryMode != discoverOppositeKind && discoveryMode != discoverAllPeers {
+		return fmt.Errorf("unknown discovery mode %s", discoveryMode)
+	}
+	if accessLogFormat != "" && accessLogFormat != accessLogCombined && accessLogFormat != accessLogJSON {
+		return fmt.Errorf("unknown access log format %s", accessLogFormat)
+	}
+	if slowWaiterInterval > 0 && slowWaiterCount < 1 {
+		return fmt.Errorf("slow waiter count must be at least 1, got %d", slowWaiterCount)
+	}
+	if pairMessageRate > 0 && pairMessageBurst < 1 {
+		return fmt.Errorf("pair message burst must be at least 1, got %d", pairMessageBurst)
+	}
+	if breakerThreshold > 0 && breakerWindow <= 0 {
+		return fmt.Errorf("breaker window must be positive, got %s", breakerWindow)
+	}
+	if cleanupInterval <= 0 {
+		return fmt.Errorf("cleanup interval must be positive, got %s", cleanupInterval)
+	}
+	if statsdAddr != "" && statsdInterval <= 0 {
+		return fmt.Errorf("statsd interval must be positive, got %s", statsdInterval)
+	}
+	if err := parseExtraHeaders(); err != nil {
+		return err
+	}
+	if err := compileNameAllowlist(); err != nil {
+		return err
+	}
+	if err := parseTrustedProxies(); err != nil {
+		return err
+	}
+	if err := validateIDFormat(); err != nil {
+		return err
+	}
+	return validateMatcher()
+}
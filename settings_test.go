@@ -0,0 +1,78 @@
+package gosigsrv
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSettingsApplyEveryField(t *testing.T) {
+	previous := currentSettings()
+	defer previous.apply()
+
+	var settings Settings
+	value := reflect.ValueOf(&settings).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			field.SetInt(int64(i + 1))
+		case reflect.Float64:
+			field.SetFloat(float64(i + 1))
+		case reflect.String:
+			field.SetString(value.Type().Field(i).Name)
+		case reflect.Slice:
+			field.Set(reflect.ValueOf([]string{value.Type().Field(i).Name}))
+		default:
+			t.Fatalf("Unexpected kind of setting %s", value.Type().Field(i).Name)
+		}
+	}
+
+	settings.apply()
+	if applied := currentSettings(); !reflect.DeepEqual(applied, settings) {
+		t.Errorf("Settings were not all applied, expected %+v, got %+v", settings, applied)
+	}
+}
+
+func TestDefaultSettingsMatchFlagDefaults(t *testing.T) {
+	settings := DefaultSettings()
+	if settings.CleanupInterval != 30*time.Second || settings.ServerMessageBufferSize != 100 || settings.Matcher != matchDefault {
+		t.Errorf("Unexpected default settings %+v", settings)
+	}
+}
+
+func TestNewServerAppliesSettings(t *testing.T) {
+	previous := currentSettings()
+	defer previous.apply()
+
+	settings := DefaultSettings()
+	settings.MaxPeers = 7
+	settings.AdminToken = "embedded"
+	newTestServer(t, Config{Settings: &settings})
+	if maxPeers != 7 || adminToken != "embedded" {
+		t.Errorf("Settings were not applied, got max peers %d and admin token %q", maxPeers, adminToken)
+	}
+}
+
+func TestNewServerRejectsInvalidSettings(t *testing.T) {
+	previous := currentSettings()
+	defer previous.apply()
+
+	settings := DefaultSettings()
+	settings.MaxPeers = 7
+	settings.CleanupInterval = 0
+	if _, err := NewServer(Config{Settings: &settings}); err == nil {
+		t.Fatalf("A cleanup interval of 0 should be rejected")
+	}
+	if maxPeers != previous.MaxPeers || cleanupInterval != previous.CleanupInterval {
+		t.Errorf("Invalid settings were left in effect, got max peers %d and cleanup interval %s", maxPeers, cleanupInterval)
+	}
+
+	settings = DefaultSettings()
+	settings.NameAllowlist = []string{"("}
+	if _, err := NewServer(Config{Settings: &settings}); err == nil {
+		t.Errorf("An invalid name allowlist pattern should be rejected")
+	}
+}
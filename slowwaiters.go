@@ -0,0 +1,62 @@
+package gosigsrv
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// slowWaiterInterval is how often the slowest waiters are logged (0 disables it)
+var slowWaiterInterval time.Duration
+
+// slowWaiterThreshold is how long a peer has to have been waiting to be logged
+var slowWaiterThreshold = 5 * time.Minute
+
+// slowWaiterCount is how many of the slowest waiters are logged
+var slowWaiterCount = 5
+
+// slowWaiter is a peer that has been waiting a long time, as it was when the waiters were listed
+type slowWaiter struct {
+	Peer          string
+	WaitStartedAt time.Time
+}
+
+// slowestWaiters returns up to n peers that have been waiting longer than threshold, longest first
+func slowestWaiters(now time.Time, threshold time.Duration, n int) []slowWaiter {
+	peerMutex.Lock()
+	var waiters []slowWaiter
+	for _, v := range peers {
+		if v != nil && v.Waiting && now.Sub(v.WaitStartedAt) > threshold {
+			waiters = append(waiters, slowWaiter{v.String(), v.WaitStartedAt})
+		}
+	}
+	peerMutex.Unlock()
+
+	sort.Slice(waiters, func(i, j int) bool { return waiters[i].WaitStartedAt.Before(waiters[j].WaitStartedAt) })
+	if len(waiters) > n {
+		waiters = waiters[:n]
+	}
+	return waiters
+}
+
+// logSlowestWaiters logs the peers that have been waiting the longest
+func logSlowestWaiters() {
+	now := time.Now().UTC()
+	for _, v := range slowestWaiters(now, slowWaiterThreshold, slowWaiterCount) {
+		fmt.Printf("WARNING: Peer %s has been waiting for %s\n", v.Peer, now.Sub(v.WaitStartedAt).Round(time.Second))
+	}
+}
+
+// slowWaiterRoutine logs the slowest waiters every slowWaiterInterval until stop is closed
+func slowWaiterRoutine(stop chan struct{}) {
+	ticker := time.NewTicker(slowWaiterInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logSlowestWaiters()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package gosigsrv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowestWaitersLogged(t *testing.T) {
+	slowID, err := signIn(t, "client_slowwaiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, slowID)
+	fastID, err := signIn(t, "renderingserver_fastwaiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, fastID)
+
+	now := time.Now().UTC()
+	peers[slowID].Waiting = true
+	peers[slowID].WaitStartedAt = now.Add(-2 * slowWaiterThreshold)
+	peers[fastID].Waiting = true
+	peers[fastID].WaitStartedAt = now
+	defer func() {
+		peers[slowID].Waiting = false
+		peers[fastID].Waiting = false
+	}()
+
+	output := captureOutput(t, logSlowestWaiters)
+	if !strings.Contains(output, "Peer "+peers[slowID].String()+" has been waiting") {
+		t.Errorf("Long waiter was not logged: %s", output)
+	}
+	if strings.Contains(output, peers[fastID].String()) {
+		t.Errorf("Waiter under the threshold was logged: %s", output)
+	}
+}
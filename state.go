@@ -0,0 +1,133 @@
+package gosigsrv
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// stateFilePath is the file peers are saved to on shutdown and restored from on start (empty disables it)
+var stateFilePath string
+
+// stateCompress gzips the state file (also done whenever stateFilePath ends in .gz)
+var stateCompress bool
+
+// peerSnapshot is the saved state of a single peer
+type peerSnapshot struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Kind          peerKind  `json:"kind"`
+	ConnectedWith string    `json:"connected_with,omitempty"`
+	SignedInAt    time.Time `json:"signed_in_at"`
+	ClientVersion string    `json:"client_version,omitempty"`
+	Room          string    `json:"room,omitempty"`
+}
+
+// stateSnapshot is the contents of the state file
+type stateSnapshot struct {
+	PeerIDCount uint           `json:"peer_id_count"`
+	Peers       []peerSnapshot `json:"peers"`
+}
+
+// compressState reports whether the state file should be gzipped
+func compressState(path string) bool {
+	return stateCompress || strings.HasSuffix(path, ".gz")
+}
+
+// saveState writes a snapshot of the signed in peers to path
+//
+//   The snapshot is written to a temporary file first, so a failed
+//   save never leaves a truncated state file behind
+func saveState(path string) error {
+	peerMutex.Lock()
+	snapshot := stateSnapshot{PeerIDCount: peerIDCount, Peers: []peerSnapshot{}}
+	for _, v := range peers {
+		if v != nil {
+			snapshot.Peers = append(snapshot.Peers, peerSnapshot{v.ID, v.Name, v.Kind, v.ConnectedWith.String(), v.SignedInAt, v.ClientVersion, v.Room})
+		}
+	}
+	peerMutex.Unlock()
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	var out io.Writer = file
+	var zipper *gzip.Writer
+	if compressState(path) {
+		zipper = gzip.NewWriter(file)
+		out = zipper
+	}
+	if err = json.NewEncoder(out).Encode(snapshot); err != nil {
+		return err
+	}
+	if zipper != nil {
+		if err = zipper.Close(); err != nil {
+			return err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// loadState restores the peers saved in path
+//
+//   Gzipped files are detected and decompressed whatever they are named.
+//   Restored peers count as having just made contact, so they get a full
+//   stale timeout to come back before they are cleaned up
+func loadState(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var in io.Reader = bufio.NewReader(file)
+	if magic, _ := in.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzipper, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer unzipper.Close()
+		in = unzipper
+	}
+
+	var snapshot stateSnapshot
+	if err = json.NewDecoder(in).Decode(&snapshot); err != nil {
+		return fmt.Errorf("could not decode state file: %v", err)
+	}
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if snapshot.PeerIDCount > peerIDCount {
+		peerIDCount = snapshot.PeerIDCount
+	}
+	now := time.Now().UTC()
+	for _, saved := range snapshot.Peers {
+		peers[saved.ID] = &peerInfo{
+			Kind:            saved.Kind,
+			Name:            saved.Name,
+			ID:              saved.ID,
+			Channel:         newMessageQueue(messageBufferSize(saved.Kind)),
+			PriorityChannel: newMessageQueue(messageBufferSize(saved.Kind)),
+			ConnectedWith:   parsePartnerSet(saved.ConnectedWith),
+			LastContact:     now,
+			SignedInAt:      saved.SignedInAt,
+			ClientVersion:   saved.ClientVersion,
+			Room:            saved.Room,
+		}
+	}
+	notePeerCount()
+	fmt.Printf("Restored %d peers from %s\n", len(snapshot.Peers), path)
+	return nil
+}
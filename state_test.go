@@ -0,0 +1,47 @@
+package gosigsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateSnapshotCompressedRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosigsrv-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json.gz")
+
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+	peerID, err := signIn(t, "renderingserver_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = saveState(path); err != nil {
+		t.Fatalf("Could not save state: %v", err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) < 2 || contents[0] != 0x1f || contents[1] != 0x8b {
+		t.Errorf("State file was not gzipped")
+	}
+
+	peers = make(map[string]*peerInfo)
+	if err = loadState(path); err != nil {
+		t.Fatalf("Could not load state: %v", err)
+	}
+	restored, exists := peers[peerID]
+	if !exists {
+		t.Fatalf("Peer %s was not restored", peerID)
+	}
+	if restored.Name != "renderingserver_snapshot" || restored.Kind != server {
+		t.Errorf("Restored peer is wrong: %s (%s)", restored, restored.Kind)
+	}
+}
@@ -0,0 +1,223 @@
+package gosigsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// startTime is when the server started
+var startTime = time.Now().UTC()
+
+// healthResponse is the body of a /health response
+type healthResponse struct {
+	Status        string  `json:"status"`
+	StartedAt     string  `json:"started_at"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+
+	Dependencies map[string]dependencyStatus `json:"dependencies,omitempty"`
+}
+
+// statsResponse is the body of a /stats response
+type statsResponse struct {
+	StartedAt         string               `json:"started_at"`
+	UptimeSeconds     float64              `json:"uptime_seconds"`
+	Peers             int                  `json:"peers"`
+	Servers           int                  `json:"servers"`
+	Clients           int                  `json:"clients"`
+	InFlightMessages  int64                `json:"in_flight_messages"`
+	OutOfRoomMessages int64                `json:"out_of_room_messages"`
+	LostMessages      int64                `json:"lost_messages"`
+	PeakPeers         int64                `json:"peak_peers"`
+	PeakPeersReset    int64                `json:"peak_peers_since_reset"`
+	ClientVersions    map[string]int       `json:"client_versions"`
+	Rooms             map[string]roomStats `json:"rooms,omitempty"`
+}
+
+// roomStats are the peer counts of a single room
+type roomStats struct {
+	Servers int `json:"servers"`
+	Clients int `json:"clients"`
+	Waiting int `json:"waiting"`
+	Paired  int `json:"paired"`
+}
+
+// countRooms returns the peer counts of every room with peers in it (the default room is "")
+func countRooms() map[string]roomStats {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	rooms := make(map[string]roomStats)
+	for _, v := range peers {
+		if v == nil {
+			continue
+		}
+		room := rooms[v.Room]
+		switch v.Kind {
+		case server:
+			room.Servers++
+		case client:
+			room.Clients++
+		}
+		if v.Waiting {
+			room.Waiting++
+		}
+		if len(v.ConnectedWith) > 0 {
+			room.Paired++
+		}
+		rooms[v.Room] = room
+	}
+	return rooms
+}
+
+// unknownClientVersion is what peers that didn't report a version are counted as
+const unknownClientVersion string = "unknown"
+
+// countClientVersions returns the number of peers reporting each client version
+func countClientVersions() map[string]int {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	versions := make(map[string]int)
+	for _, v := range peers {
+		if v == nil {
+			continue
+		}
+		if v.ClientVersion == "" {
+			versions[unknownClientVersion]++
+		} else {
+			versions[v.ClientVersion]++
+		}
+	}
+	return versions
+}
+
+// countPeers returns the total number of peers and the number of servers and clients
+//
+//   Peers of other kinds are only included in the total
+func countPeers() (total int, servers int, clients int) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	for _, v := range peers {
+		if v == nil {
+			continue
+		}
+		switch v.Kind {
+		case server:
+			servers++
+		case client:
+			clients++
+		}
+	}
+	return len(peers), servers, clients
+}
+
+// uptime returns the time since the server started
+func uptime() time.Duration {
+	return time.Now().UTC().Sub(startTime)
+}
+
+// writeJSON writes a value as a json response with the given status
+func writeJSON(res http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if err = writeBody(res, status, string(body)); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+}
+
+// healthHandler reports that the server is up and how long it has been running
+//
+//   With -health-checks a failing dependency makes it a degraded 503
+func healthHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	health := healthResponse{
+		Status:        "ok",
+		StartedAt:     startTime.Format(time.RFC3339),
+		UptimeSeconds: uptime().Seconds(),
+		Dependencies:  checkDependencies(),
+	}
+	status := http.StatusOK
+	for _, dependency := range health.Dependencies {
+		if dependency.Status != "ok" {
+			health.Status = "degraded"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(res, status, health)
+}
+
+// statsHandler reports peer and message counts
+//
+//   With by=room the peer counts are also broken down per room
+func statsHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	by := req.URL.Query().Get("by")
+	if by != "" && by != "room" {
+		http.Error(res, "Invalid by", http.StatusBadRequest)
+		return
+	}
+
+	var stats statsResponse
+	stats.StartedAt = startTime.Format(time.RFC3339)
+	stats.UptimeSeconds = uptime().Seconds()
+	stats.Peers, stats.Servers, stats.Clients = countPeers()
+	stats.InFlightMessages = atomic.LoadInt64(&inFlightMessages)
+	stats.OutOfRoomMessages = atomic.LoadInt64(&outOfRoomMessages)
+	stats.LostMessages = atomic.LoadInt64(&lostMessages)
+	stats.PeakPeers = atomic.LoadInt64(&peakPeers)
+	stats.PeakPeersReset = atomic.LoadInt64(&peakPeersSinceReset)
+	stats.ClientVersions = countClientVersions()
+	if by == "room" {
+		stats.Rooms = countRooms()
+	}
+
+	writeJSON(res, http.StatusOK, stats)
+}
+
+// peersHandler lists every signed in peer (as json)
+func peersHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	list := sortPeers(allPeers(), sortByID)
+	views := make([]peerView, 0, len(list))
+	peerMutex.Lock()
+	for _, v := range list {
+		views = append(views, v.View())
+	}
+	peerMutex.Unlock()
+
+	writeJSON(res, http.StatusOK, views)
+}
+
+// allPeers returns every signed in peer
+func allPeers() []*peerInfo {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	list := make([]*peerInfo, 0, len(peers))
+	for _, v := range peers {
+		if v != nil {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,122 @@
+package gosigsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getJSON(t *testing.T, handler http.HandlerFunc, path string, value interface{}) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+	if err = json.Unmarshal(rr.Body.Bytes(), value); err != nil {
+		t.Fatalf("Response is not valid json (%v): %s", err, rr.Body.String())
+	}
+	return rr
+}
+
+func TestHealthReportsIncreasingUptime(t *testing.T) {
+	var first, second healthResponse
+	getJSON(t, healthHandler, "/health", &first)
+	time.Sleep(10 * time.Millisecond)
+	getJSON(t, healthHandler, "/health", &second)
+
+	if first.UptimeSeconds < 0 {
+		t.Errorf("Uptime is negative: %f", first.UptimeSeconds)
+	}
+	if second.UptimeSeconds <= first.UptimeSeconds {
+		t.Errorf("Uptime did not increase: %f then %f", first.UptimeSeconds, second.UptimeSeconds)
+	}
+	if _, err := time.Parse(time.RFC3339, first.StartedAt); err != nil {
+		t.Errorf("Start time (%s) is not RFC3339: %v", first.StartedAt, err)
+	}
+}
+
+func TestStatsReportsPeersAndUptime(t *testing.T) {
+	serverID, err := signIn(t, "renderingserver_stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+
+	var stats statsResponse
+	getJSON(t, statsHandler, "/stats", &stats)
+
+	if stats.UptimeSeconds < 0 {
+		t.Errorf("Uptime is negative: %f", stats.UptimeSeconds)
+	}
+	if stats.Servers < 1 || stats.Peers < stats.Servers+stats.Clients {
+		t.Errorf("Peer counts are wrong: %+v", stats)
+	}
+}
+
+func TestClientVersionTracked(t *testing.T) {
+	req, err := http.NewRequest("GET", "/sign_in?client_versioned", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Client-Version", "2.3.1")
+
+	rr := httptest.NewRecorder()
+	signInHandler := http.HandlerFunc(signinHandler)
+	signInHandler.ServeHTTP(rr, req)
+	peerID := rr.Header().Get("Pragma")
+	defer signOut(t, peerID)
+
+	var views []peerView
+	getJSON(t, peersHandler, "/peers", &views)
+	var found bool
+	for _, view := range views {
+		if view.ID == peerID {
+			found = true
+			if view.ClientVersion != "2.3.1" {
+				t.Errorf("Peer has wrong client version (%s)", view.ClientVersion)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Peer %s was not listed", peerID)
+	}
+
+	var stats statsResponse
+	getJSON(t, statsHandler, "/stats", &stats)
+	if count := stats.ClientVersions["2.3.1"]; count != 1 {
+		t.Errorf("Expected 1 peer with the client version, got %d", count)
+	}
+}
+
+func TestStatsByRoom(t *testing.T) {
+	defer func(previous map[string]*peerInfo) { peers = previous }(peers)
+	peers = make(map[string]*peerInfo)
+
+	for _, query := range []string{"client_roomA&room=blue", "renderingserver_roomA&room=blue", "client_roomB&room=green"} {
+		req, err := http.NewRequest("GET", "/sign_in?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		http.HandlerFunc(signinHandler).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var stats statsResponse
+	getJSON(t, statsHandler, "/stats?by=room", &stats)
+	if blue := stats.Rooms["blue"]; blue.Servers != 1 || blue.Clients != 1 {
+		t.Errorf("Wrong counts for room blue: %+v", blue)
+	}
+	if green := stats.Rooms["green"]; green.Servers != 0 || green.Clients != 1 {
+		t.Errorf("Wrong counts for room green: %+v", green)
+	}
+	if len(stats.Rooms) != 2 {
+		t.Errorf("Expected 2 rooms, got %v", stats.Rooms)
+	}
+}
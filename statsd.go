@@ -0,0 +1,59 @@
+package gosigsrv
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// statsdAddr is the host:port metrics are sent to over udp (empty disables statsd)
+var statsdAddr string
+
+// statsdPrefix is put in front of every statsd metric name
+var statsdPrefix = "gosigsrv."
+
+// statsdInterval is how often metrics are sent to statsd
+var statsdInterval = 10 * time.Second
+
+// statsdPacket formats metrics as statsd lines
+//
+//   Counters are sent as the change since the previous packet (tracked in
+//   lastCounters), gauges as their current value
+func statsdPacket(metrics []metric, lastCounters map[string]int64) []byte {
+	var packet bytes.Buffer
+	for _, m := range metrics {
+		switch m.Kind {
+		case counterMetric:
+			fmt.Fprintf(&packet, "%s%s:%d|c\n", statsdPrefix, m.Name, m.Value-lastCounters[m.Name])
+			lastCounters[m.Name] = m.Value
+		case gaugeMetric:
+			fmt.Fprintf(&packet, "%s%s:%d|g\n", statsdPrefix, m.Name, m.Value)
+		}
+	}
+	return packet.Bytes()
+}
+
+// statsdRoutine sends the metrics to statsd at addr every interval until stop is closed
+func statsdRoutine(addr string, interval time.Duration, stop chan struct{}) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		fmt.Printf("ERROR: Could not connect to statsd at %s: %v\n", addr, err)
+		return
+	}
+	defer conn.Close()
+
+	lastCounters := make(map[string]int64)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := conn.Write(statsdPacket(currentMetrics(), lastCounters)); err != nil {
+				fmt.Printf("ERROR: Could not send metrics to statsd: %v\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
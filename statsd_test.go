@@ -0,0 +1,55 @@
+package gosigsrv
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdSendsMetrics(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go statsdRoutine(listener.LocalAddr().String(), 10*time.Millisecond, stop)
+
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	packet := make([]byte, 1500)
+	n, _, err := listener.ReadFrom(packet)
+	if err != nil {
+		t.Fatalf("No statsd packet received: %v", err)
+	}
+	received := string(packet[:n])
+	if !strings.Contains(received, "gosigsrv.sign_ins:") || !strings.Contains(received, "gosigsrv.peers:") {
+		t.Errorf("Statsd packet is missing metrics: %s", received)
+	}
+}
+
+func TestStatsdCountersSentAsChanges(t *testing.T) {
+	lastCounters := make(map[string]int64)
+	statsdPacket([]metric{{"sign_ins", counterMetric, "", 5}}, lastCounters)
+	packet := string(statsdPacket([]metric{{"sign_ins", counterMetric, "", 8}, {"peers", gaugeMetric, "", 3}}, lastCounters))
+	if packet != "gosigsrv.sign_ins:3|c\ngosigsrv.peers:3|g\n" {
+		t.Errorf("Wrong statsd packet: %q", packet)
+	}
+}
+
+func TestValidateSettingsRejectsNonPositiveStatsdInterval(t *testing.T) {
+	defer func(previous string) { statsdAddr = previous }(statsdAddr)
+	defer func(previous time.Duration) { statsdInterval = previous }(statsdInterval)
+
+	statsdAddr = "127.0.0.1:8125"
+	statsdInterval = 0
+	if err := validateSettings(); err == nil {
+		t.Errorf("A statsd interval of 0 should be rejected with a statsd address")
+	}
+	statsdAddr = ""
+	if err := validateSettings(); err != nil {
+		t.Errorf("The statsd interval should not matter without a statsd address, got %v", err)
+	}
+}
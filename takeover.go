@@ -0,0 +1,32 @@
+package gosigsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// waitTakeover makes a new /wait for a peer that's already waiting cancel the earlier one and take over its messages
+var waitTakeover bool
+
+// errWaitTakenOver is the cause of a /wait cancelled by a newer /wait for the same peer
+var errWaitTakenOver = errors.New("wait taken over by a newer wait")
+
+// takeOverWait cancels a peer's current /wait, so the wait starting now is the only one receiving its messages
+//
+//   The cancelled wait returns a 409. A message it had already taken is
+//   still written to it, so nothing is lost to the takeover
+//   Must be called with peerMutex held
+func takeOverWait(peer *peerInfo) {
+	if !waitTakeover || !peer.Waiting || peer.CancelWait == nil {
+		return
+	}
+	fmt.Printf("wait: Peer %s started a new wait, cancelling the old one\n", peer)
+	peer.CancelWait(errWaitTakenOver)
+	peer.CancelWait = nil
+}
+
+// waitTakenOver reports whether a wait was cancelled by takeOverWait
+func waitTakenOver(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errWaitTakenOver)
+}
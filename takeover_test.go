@@ -0,0 +1,95 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewWaitTakesOverFromOldWait(t *testing.T) {
+	defer func(previous bool) { waitTakeover = previous }(waitTakeover)
+	waitTakeover = true
+
+	clientID, err := signIn(t, "client_takeover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_takeover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(clientID)
+	discardMessages(serverID)
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- waitForMessage(t, serverID) }()
+	for !peerWaiting(serverID) {
+		time.Sleep(time.Millisecond)
+	}
+
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- waitForMessage(t, serverID) }()
+	select {
+	case rr := <-first:
+		if rr.Code != http.StatusConflict {
+			t.Errorf("Recieved wrong status code for the old wait expected %v, got %v", http.StatusConflict, rr.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Old wait did not return after a new wait took over")
+	}
+
+	if rr := sendMessage(t, clientID, serverID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	select {
+	case rr := <-second:
+		if rr.Code != http.StatusOK || rr.Body.String() != "offer" {
+			t.Errorf("New wait did not receive the message: %d %s", rr.Code, rr.Body.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("New wait did not receive the message")
+	}
+}
+
+func TestWaitsAreNotTakenOverByDefault(t *testing.T) {
+	serverID, err := signIn(t, "renderingserver_notakeover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(serverID)
+
+	first := make(chan *httptest.ResponseRecorder, 1)
+	go func() { first <- waitForMessage(t, serverID) }()
+	for !peerWaiting(serverID) {
+		time.Sleep(time.Millisecond)
+	}
+
+	second := make(chan *httptest.ResponseRecorder, 1)
+	go func() { second <- waitForMessage(t, serverID) }()
+	select {
+	case rr := <-first:
+		t.Fatalf("Old wait returned without -wait-takeover: %d", rr.Code)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Both waits share the peer's messages, one each
+	for _, message := range []string{"one", "two"} {
+		if rr := sendMessage(t, serverID, serverID, message); rr.Code != http.StatusOK {
+			t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+		}
+	}
+	for _, waiting := range []chan *httptest.ResponseRecorder{first, second} {
+		select {
+		case rr := <-waiting:
+			if rr.Code != http.StatusOK {
+				t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Wait did not receive a message")
+		}
+	}
+}
@@ -5,7 +5,7 @@ set -u
 DP0=`dirname $0`
 
 echo building
-go install $DP0 || { echo Failed to build/install ; exit 1; }
+go install $DP0/cmd/gosigsrv || { echo Failed to build/install ; exit 1; }
 echo
 echo build complete
 echo
@@ -0,0 +1,29 @@
+package gosigsrv
+
+import (
+	"embed"
+	"net/http"
+)
+
+// serveTestPage serves a minimal test client on /test
+var serveTestPage bool
+
+//go:embed testpage/index.html
+var testPageFiles embed.FS
+
+// testPageHandler serves the test client page (or a 404 unless serveTestPage is set)
+func testPageHandler(res http.ResponseWriter, req *http.Request) {
+	if !serveTestPage {
+		http.NotFound(res, req)
+		return
+	}
+
+	page, err := testPageFiles.ReadFile("testpage/index.html")
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(http.StatusOK)
+	res.Write(page)
+}
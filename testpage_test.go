@@ -0,0 +1,37 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTestPageServedWhenEnabled(t *testing.T) {
+	defer func(previous bool) { serveTestPage = previous }(serveTestPage)
+
+	req, err := http.NewRequest("GET", "/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveTestPage = false
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(testPageHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("Recieved wrong status code with the test page disabled expected %v, got %v", http.StatusNotFound, status)
+	}
+
+	serveTestPage = true
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(testPageHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, status)
+	}
+	if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("Test page has the wrong content type %s", contentType)
+	}
+	if !strings.Contains(rr.Body.String(), "<html>") {
+		t.Errorf("Test page is not html: %s", rr.Body.String())
+	}
+}
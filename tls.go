@@ -0,0 +1,94 @@
+package gosigsrv
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// tlsCertFile and tlsKeyFile enable serving over https when both are set
+var tlsCertFile string
+var tlsKeyFile string
+
+// httpRedirectPort is the port of an optional plain http listener that redirects to https
+var httpRedirectPort string
+
+// tlsMinVersion is the minimum TLS version accepted ("1.0", "1.1", "1.2" or "1.3")
+var tlsMinVersion = "1.2"
+
+// tlsCipherSuites is a comma separated list of allowed cipher suite names (empty for Go's defaults)
+//
+//   Only applies to TLS 1.2 and lower, TLS 1.3 suites aren't configurable
+var tlsCipherSuites string
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the server's tls config from tlsMinVersion and tlsCipherSuites
+func newTLSConfig() (*tls.Config, error) {
+	minVersion, validVersion := tlsVersions[tlsMinVersion]
+	if !validVersion {
+		return nil, fmt.Errorf("unknown TLS version %s", tlsMinVersion)
+	}
+	config := &tls.Config{MinVersion: minVersion}
+
+	if tlsCipherSuites != "" {
+		suiteIDs := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suiteIDs[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(tlsCipherSuites, ",") {
+			id, known := suiteIDs[strings.TrimSpace(name)]
+			if !known {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	return config, nil
+}
+
+// tlsEnabled reports whether the server is configured to serve https
+func tlsEnabled() bool {
+	return tlsCertFile != "" && tlsKeyFile != ""
+}
+
+// httpsRedirectHandler permanently redirects every request to the same url
+// over https on the given port
+func httpsRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		target := *req.URL
+		target.Scheme = "https"
+		target.Host = host
+		http.Redirect(res, req, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+// serveHTTPSRedirects listens for plain http on httpRedirectPort and redirects it to https
+func serveHTTPSRedirects(httpsPort string) *http.Server {
+	redirectSrv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", httpRedirectPort),
+		Handler: httpsRedirectHandler(httpsPort),
+	}
+	go func() {
+		fmt.Printf("Redirecting http on port %s to https\n", httpRedirectPort)
+		if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("ERROR: https redirect listener failed: %v\n", err)
+		}
+	}()
+	return redirectSrv
+}
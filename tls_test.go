@@ -0,0 +1,88 @@
+package gosigsrv
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPRedirectsToHTTPS(t *testing.T) {
+	ts := httptest.NewServer(httpsRedirectHandler("8443"))
+	defer ts.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest("GET", ts.URL+"/sign_in?client_insecure", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "signal.example.com:8087"
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("Recieved wrong status code expected %v, got %v", http.StatusMovedPermanently, resp.StatusCode)
+	}
+	expectedLocation := "https://signal.example.com:8443/sign_in?client_insecure"
+	if location := resp.Header.Get("Location"); location != expectedLocation {
+		t.Errorf("Redirected to (%s) expected (%s)", location, expectedLocation)
+	}
+}
+
+func TestTLSMinVersionEnforced(t *testing.T) {
+	config, err := newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(healthHandler))
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	connect := func(maxVersion uint16) error {
+		conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS10,
+			MaxVersion:         maxVersion,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	if err = connect(tls.VersionTLS11); err == nil {
+		t.Errorf("TLS 1.1 handshake was accepted")
+	}
+	if err = connect(tls.VersionTLS12); err != nil {
+		t.Errorf("TLS 1.2 handshake failed: %v", err)
+	}
+}
+
+func TestTLSConfigRejectsUnknownCipherSuites(t *testing.T) {
+	defer func(previous string) { tlsCipherSuites = previous }(tlsCipherSuites)
+
+	tlsCipherSuites = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	config, err := newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.CipherSuites) != 2 {
+		t.Errorf("Expected 2 cipher suites, got %d", len(config.CipherSuites))
+	}
+
+	tlsCipherSuites = "TLS_RSA_WITH_RC4_128_SHA"
+	if _, err = newTLSConfig(); err == nil {
+		t.Errorf("Insecure cipher suite was accepted")
+	}
+}
@@ -0,0 +1,112 @@
+package gosigsrv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+)
+
+// traceBodyLimit is how much of a traced request's body is logged
+const traceBodyLimit int = 2048
+
+// traceRedactedHeaders are left out of traced requests as they carry credentials
+var traceRedactedHeaders = []string{"Authorization", "Cookie"}
+
+// traceBody keeps the start of a request body as the handler reads it
+type traceBody struct {
+	io.ReadCloser
+	prefix bytes.Buffer
+}
+
+func (b *traceBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := traceBodyLimit - b.prefix.Len(); room > 0 {
+		if n < room {
+			room = n
+		}
+		b.prefix.Write(p[:room])
+	}
+	return n, err
+}
+
+// traceMiddleware logs requests from traced peers in full (headers and the start of the body)
+//
+//   The peer is taken from the peer_id param, so this covers every request
+//   a traced peer makes after signing in. The body is logged once the handler
+//   has read it, so tracing doesn't change how (or how long) it's read
+func traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		peerID := req.URL.Query().Get(peerIDParamName)
+		if peerID == "" {
+			next.ServeHTTP(res, req)
+			return
+		}
+		peerMutex.Lock()
+		peer, exists := peers[peerID]
+		traced := exists && peer != nil && peer.Trace
+		peerMutex.Unlock()
+		if !traced {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		dumped := req.Clone(req.Context())
+		for _, name := range traceRedactedHeaders {
+			if dumped.Header.Get(name) != "" {
+				dumped.Header.Set(name, "[redacted]")
+			}
+		}
+		reqDump, err := httputil.DumpRequest(dumped, false)
+		if err != nil {
+			fmt.Printf("trace: Peer %s could not dump request: %v\n", peerID, err)
+		}
+		fmt.Printf("trace: Peer %s request from %s:\n%s\n", peerID, req.RemoteAddr, reqDump)
+
+		body := &traceBody{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+		start := time.Now()
+		next.ServeHTTP(res, req)
+		if body.prefix.Len() > 0 {
+			truncated := ""
+			if body.prefix.Len() >= traceBodyLimit {
+				truncated = "... (truncated)"
+			}
+			fmt.Printf("trace: Peer %s request body:\n%s%s\n", peerID, body.prefix.Bytes(), truncated)
+		}
+		fmt.Printf("trace: Peer %s request for %s handled in %s, response headers: %v\n", peerID, req.URL.Path, time.Since(start), res.Header())
+	})
+}
+
+// adminTraceHandler turns verbose request logging for a peer on or off
+func adminTraceHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	peerID := req.URL.Query().Get(peerIDParamName)
+	on, err := strconv.ParseBool(req.URL.Query().Get("on"))
+	if peerID == "" || err != nil {
+		http.Error(res, "Missing Peer ID or on", http.StatusBadRequest)
+		return
+	}
+
+	peerMutex.Lock()
+	peer, exists := peers[peerID]
+	if !exists || peer == nil {
+		peerMutex.Unlock()
+		unknownPeerError(res, peerID)
+		return
+	}
+	peer.Trace = on
+	fmt.Printf("admin trace - Peer %s trace=%t\n", peer, on)
+	peerMutex.Unlock()
+
+	res.WriteHeader(http.StatusOK)
+}
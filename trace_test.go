@@ -0,0 +1,50 @@
+package gosigsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTracedPeerLogsMore(t *testing.T) {
+	clientID, err := signIn(t, "client_traced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_traced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+
+	if rr := adminRequest(t, adminTraceHandler, "POST", "/admin/trace?peer_id="+clientID+"&on=true"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+
+	handler := traceMiddleware(http.HandlerFunc(messageHandler))
+	send := func(from string, to string) string {
+		return captureOutput(t, func() {
+			req, err := http.NewRequest("POST", "/message?peer_id="+from+"&to="+to, strings.NewReader("traced body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer tracedsecret")
+			req.Header.Set("Cookie", "session=tracedsecret")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		})
+	}
+
+	traced := send(clientID, serverID)
+	untraced := send(serverID, clientID)
+	if !strings.Contains(traced, "trace: Peer "+clientID) || strings.Count(traced, "traced body") < 2 {
+		t.Errorf("Traced peer's request was not logged in full:\n%s", traced)
+	}
+	if strings.Contains(untraced, "trace:") || len(untraced) >= len(traced) {
+		t.Errorf("Untraced peer's request was logged verbosely:\n%s", untraced)
+	}
+	if strings.Contains(traced, "tracedsecret") {
+		t.Errorf("Traced request's credentials were logged:\n%s", traced)
+	}
+}
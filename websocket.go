@@ -0,0 +1,272 @@
+package gosigsrv
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketEnabled serves /ws, delivering a peer's messages over a websocket instead of /wait
+var websocketEnabled bool
+
+// websocketMaxFrameBytes is the largest frame a client can send (messages are still sent with /message)
+const websocketMaxFrameBytes = 64 * 1024
+
+// websocketGUID is appended to the client's key to make the accept key (RFC 6455)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Websocket frame opcodes
+const (
+	websocketText  byte = 0x1
+	websocketClose byte = 0x8
+	websocketPing  byte = 0x9
+	websocketPong  byte = 0xa
+)
+
+// websocketEnvelope is a message delivered over a websocket, with the sender's id /wait puts in the Pragma header
+type websocketEnvelope struct {
+	From string `json:"from"`
+	Data string `json:"data"`
+}
+
+// headerHasToken reports whether a comma separated header has the given token (case insensitively)
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketAccept is the Sec-WebSocket-Accept value for a client's Sec-WebSocket-Key
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// writeFrame writes a single (unfragmented, unmasked) frame
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame reads a single frame, unmasking its payload
+//
+//   Clients must mask their frames, so with requireMask unmasked frames are an error
+func readFrame(r io.Reader, requireMask bool) (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err = io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err = io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if requireMask && !masked {
+		return 0, nil, errors.New("unmasked websocket frame")
+	}
+	if length > websocketMaxFrameBytes {
+		return 0, nil, fmt.Errorf("websocket frame of %d bytes is too large", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+// websocketHandler delivers a peer's messages over a websocket for as long as it stays open
+//
+//   The peer signs in and sends messages as usual, and connects to
+//   /ws?peer_id=<id> instead of waiting on /wait. Each message is sent as
+//   a text frame of {"from":"<sender id>","data":"<message>"}, and the peer
+//   counts as waiting (so it isn't removed as stale) while connected
+func websocketHandler(res http.ResponseWriter, req *http.Request) {
+	if !websocketEnabled {
+		http.NotFound(res, req)
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	peerID := req.URL.Query().Get(peerIDParamName)
+	if peerID == "" {
+		http.Error(res, "Missing Peer ID", http.StatusBadRequest)
+		return
+	}
+	if !wellFormedPeerID(peerID) {
+		http.Error(res, "Malformed Peer ID", http.StatusBadRequest)
+		return
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" || !headerHasToken(req.Header, "Connection", "upgrade") || !headerHasToken(req.Header, "Upgrade", "websocket") {
+		http.Error(res, "Expected a websocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		res.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(res, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	peerMutex.Lock()
+	peer, exists := peers[peerID]
+	if !exists || peer == nil {
+		peerMutex.Unlock()
+		unknownPeerError(res, peerID)
+		return
+	}
+	conn, rw, err := http.NewResponseController(res).Hijack()
+	if err != nil {
+		peerMutex.Unlock()
+		http.Error(res, "Websockets are not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	peer.LastContact = time.Now().UTC()
+	peer.Waiting = true
+	peer.WaitStartedAt = peer.LastContact
+	resetBreaker(peer)
+	waitStartedAt := peer.WaitStartedAt
+	fmt.Printf("ws: Peer %s connected\n", peer)
+	peerMutex.Unlock()
+	defer doneWaiting(peer, waitStartedAt)
+
+	// Nothing can be sent after a close frame
+	var writeMutex sync.Mutex
+	var closeSent bool
+	send := func(opcode byte, payload []byte) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		if closeSent {
+			return errors.New("websocket is closed")
+		}
+		closeSent = opcode == websocketClose
+		if err := writeFrame(rw, opcode, payload); err != nil {
+			return err
+		}
+		return rw.Flush()
+	}
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return
+	}
+
+	// Frames from the client are only pings, heartbeats and closing the socket
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func(reader *bufio.Reader) {
+		defer cancel()
+		for {
+			opcode, payload, err := readFrame(reader, true)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case websocketClose:
+				send(websocketClose, nil)
+				return
+			case websocketPing:
+				send(websocketPong, payload)
+			default:
+				peerMutex.Lock()
+				peer.LastContact = time.Now().UTC()
+				peerMutex.Unlock()
+			}
+		}
+	}(rw.Reader)
+
+	for {
+		peerMsg, cancelled := receiveMessage(peer, ctx.Done())
+		if cancelled {
+			break
+		}
+		messagesDequeued(1)
+		if peerMsg == nil {
+			continue
+		}
+
+		envelope, err := json.Marshal(websocketEnvelope{From: peerMsg.FromID, Data: peerMsg.Message})
+		if err == nil {
+			err = send(websocketText, envelope)
+		}
+		peerMutex.Lock()
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			requeueUndelivered(peer, peerMsg)
+			peerMutex.Unlock()
+			return
+		}
+		peer.FailedSends = 0
+		peer.LastContact = time.Now().UTC()
+		if peerMsg.FromID != peer.ID {
+			peer.LastReceivedContentType = peerMsg.ContentType
+			if replayLastMessage {
+				peer.LastDelivered = peerMsg
+			}
+		}
+		fmt.Printf("ws: Peer %s recieved message from ID %s\n\t%s\n\n", peer, peerMsg.FromID, peerMsg.Message)
+		peerMutex.Unlock()
+	}
+
+	// Going away (1001), if the client hasn't closed the socket already
+	send(websocketClose, []byte{0x03, 0xe9})
+	fmt.Printf("ws: Peer %s disconnected\n", peerID)
+}
@@ -0,0 +1,91 @@
+package gosigsrv
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebsocketAndLongPollPeersMessageEachOther(t *testing.T) {
+	defer func(previous bool) { websocketEnabled = previous }(websocketEnabled)
+	websocketEnabled = true
+
+	ts := httptest.NewServer(newTestServer(t, Config{}).Handler())
+	defer ts.Close()
+
+	clientID, err := signIn(t, "client_websocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, clientID)
+	serverID, err := signIn(t, "renderingserver_websocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signOut(t, serverID)
+	discardMessages(clientID)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, err := http.NewRequest("GET", ts.URL+"/ws?peer_id="+clientID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err = req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Upgrade failed with %d (accept %s)", res.StatusCode, res.Header.Get("Sec-WebSocket-Accept"))
+	}
+	if !peerWaiting(clientID) {
+		t.Errorf("Peer connected over a websocket doesn't count as waiting")
+	}
+
+	// Long-poll peer to websocket peer
+	if rr := sendMessage(t, serverID, clientID, "offer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	opcode, payload, err := readFrame(reader, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope websocketEnvelope
+	if err = json.Unmarshal(payload, &envelope); err != nil || opcode != websocketText {
+		t.Fatalf("Expected a json text frame, got %x %s (%v)", opcode, payload, err)
+	}
+	if envelope.From != serverID || envelope.Data != "offer" {
+		t.Errorf("Wrong message delivered over the websocket: %+v", envelope)
+	}
+
+	// Websocket peer to long-poll peer
+	if rr := sendMessage(t, clientID, serverID, "answer"); rr.Code != http.StatusOK {
+		t.Fatalf("Recieved wrong status code expected %v, got %v", http.StatusOK, rr.Code)
+	}
+	if rr := waitForMessage(t, serverID); rr.Body.String() != "answer" || rr.Header().Get("Pragma") != clientID {
+		t.Errorf("Wrong message delivered to the long-poll peer: %s from %s", rr.Body.String(), rr.Header().Get("Pragma"))
+	}
+
+	// A (masked) close frame is answered and ends the wait
+	if _, err = conn.Write([]byte{0x80 | websocketClose, 0x80, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, _, err = readFrame(reader, false); err != nil || opcode != websocketClose {
+		t.Fatalf("Expected a close frame back, got %x (%v)", opcode, err)
+	}
+}